@@ -1,18 +1,23 @@
 package apiserver
 
 import (
+	"crypto/subtle"
+	"dmexe.me/payloads"
 	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type handlers struct {
-	log      *logrus.Entry
-	provider Provider
-	broker   *Broker
+	log         *logrus.Entry
+	provider    Provider
+	broker      *Broker
+	revocations *payloads.Revocations
+	adminToken  string
 }
 
 func (h *handlers) getRouter() *mux.Router {
@@ -23,6 +28,11 @@ func (h *handlers) getRouter() *mux.Router {
 	api.Methods("GET").Path("/tasks").HandlerFunc(h.handleTasks)
 	api.Methods("GET").Path("/stream").HandlerFunc(h.handleStream)
 
+	if h.revocations != nil {
+		api.Methods("GET").Path("/revocations").HandlerFunc(h.requireAdmin(h.handleRevocations))
+		api.Methods("POST").Path("/revocations").HandlerFunc(h.requireAdmin(h.handleRevoke))
+	}
+
 	root.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		if t, err := route.GetPathTemplate(); err == nil {
 			h.log.Debugf("Add handler %s", t)
@@ -33,6 +43,21 @@ func (h *handlers) getRouter() *mux.Router {
 	return root
 }
 
+// requireAdmin rejects requests without the admin bearer token
+func (h *handlers) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if h.adminToken == "" || token == header || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			h.log.Warnf("Unauthorized request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func (h *handlers) renderJSON(w http.ResponseWriter, code int, obj interface{}) {
 	bb, err := json.Marshal(obj)
 	if err != nil {
@@ -64,6 +89,30 @@ func (h *handlers) handleTasks(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *handlers) handleRevocations(w http.ResponseWriter, r *http.Request) {
+	h.renderJSON(w, http.StatusOK, h.revocations.List())
+}
+
+func (h *handlers) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	entry := payloads.Revocation{}
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("Could not decode revocation (%s)", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := entry.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.revocations.Revoke(entry); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.renderJSON(w, http.StatusCreated, entry)
+}
+
 func (h *handlers) handleStream(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
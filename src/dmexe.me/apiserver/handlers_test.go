@@ -0,0 +1,61 @@
+package apiserver
+
+import (
+	"context"
+	"dmexe.me/payloads"
+	"dmexe.me/utils"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_RevocationHandlers(t *testing.T) {
+	revocations, err := payloads.NewRevocations(context.Background(), payloads.RevocationsOptions{})
+	require.NoError(t, err)
+
+	h := &handlers{
+		log:         utils.NewLogEntry("api.server"),
+		revocations: revocations,
+		adminToken:  "s3cret",
+	}
+	router := h.getRouter()
+
+	request := func(method string, authorization string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/a/v1/revocations", strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("should revoke and list tokens with admin token", func(t *testing.T) {
+		w := request("POST", "Bearer s3cret", `{"jti": "a"}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		require.True(t, revocations.IsRevoked("a"))
+
+		w = request("GET", "Bearer s3cret", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `"jti":"a"`)
+	})
+
+	t.Run("fail without admin token", func(t *testing.T) {
+		for _, authorization := range []string{"", "s3cret", "Bearer wrong", "Basic czNjcmV0"} {
+			w := request("POST", authorization, `{"jti": "b"}`)
+			require.Equal(t, http.StatusUnauthorized, w.Code, authorization)
+
+			w = request("GET", authorization, "")
+			require.Equal(t, http.StatusUnauthorized, w.Code, authorization)
+		}
+		require.False(t, revocations.IsRevoked("b"))
+	})
+
+	t.Run("fail to create server without admin token", func(t *testing.T) {
+		_, err := NewServer(context.Background(), ServerOptions{Revocations: revocations})
+		require.EqualError(t, err, "Admin token is required by revocation endpoints")
+	})
+}
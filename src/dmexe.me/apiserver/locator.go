@@ -0,0 +1,71 @@
+package apiserver
+
+import (
+	"context"
+	"dmexe.me/payloads"
+	"dmexe.me/utils"
+	"github.com/Sirupsen/logrus"
+)
+
+// TaskLocator finds agent hosts of task instances using the provider
+type TaskLocator struct {
+	provider Provider
+	ctx      context.Context
+	log      *logrus.Entry
+}
+
+// NewTaskLocator creates a new locator using given provider
+func NewTaskLocator(ctx context.Context, provider Provider) *TaskLocator {
+	return &TaskLocator{
+		provider: provider,
+		ctx:      ctx,
+		log:      utils.NewLogEntry("api.locator"),
+	}
+}
+
+// LocateAgent returns address of the agent running the instance referenced by the payload,
+// running instances are preferred
+func (l *TaskLocator) LocateAgent(payload payloads.Payload) (string, bool) {
+	result, err := l.provider.GetTasks(l.ctx)
+	if err != nil {
+		l.log.Warnf("Could not get tasks (%s)", err)
+		return "", false
+	}
+
+	var found *TaskInstance
+
+	for _, task := range result.Tasks {
+		for i := range task.Instances {
+			instance := &task.Instances[i]
+			if instance.Addr == nil || !isSameInstance(instance.Payload, payload) {
+				continue
+			}
+
+			if instance.State == TaskStatusRunning {
+				return instance.Addr.String(), true
+			}
+
+			if found == nil {
+				found = instance
+			}
+		}
+	}
+
+	if found == nil {
+		return "", false
+	}
+
+	return found.Addr.String(), true
+}
+
+func isSameInstance(instance payloads.Payload, payload payloads.Payload) bool {
+	if instance.ContainerID != "" && instance.ContainerID == payload.ContainerID {
+		return true
+	}
+
+	if instance.ContainerEnv != "" && instance.ContainerEnv == payload.ContainerEnv {
+		return true
+	}
+
+	return false
+}
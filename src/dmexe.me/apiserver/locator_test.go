@@ -0,0 +1,71 @@
+package apiserver
+
+import (
+	"context"
+	"dmexe.me/payloads"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+type testLocatorProvider struct {
+	result Result
+	err    error
+}
+
+func (p *testLocatorProvider) GetTasks(_ context.Context) (Result, error) {
+	return p.result, p.err
+}
+
+func Test_TaskLocator(t *testing.T) {
+	ctx := context.Background()
+
+	provider := &testLocatorProvider{
+		result: Result{
+			Tasks: []Task{{
+				ID: "app",
+				Instances: []TaskInstance{
+					{
+						Addr:    net.ParseIP("10.0.0.1"),
+						State:   TaskStatusFailed,
+						Payload: payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"},
+					},
+					{
+						Addr:    net.ParseIP("10.0.0.2"),
+						State:   TaskStatusRunning,
+						Payload: payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"},
+					},
+					{
+						Addr:    net.ParseIP("10.0.0.3"),
+						State:   TaskStatusFailed,
+						Payload: payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.2"},
+					},
+				},
+			}},
+		},
+	}
+
+	t.Run("should prefer running instance", func(t *testing.T) {
+		addr, ok := NewTaskLocator(ctx, provider).LocateAgent(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"})
+		require.True(t, ok)
+		require.Equal(t, "10.0.0.2", addr)
+	})
+
+	t.Run("should locate stopped instance", func(t *testing.T) {
+		addr, ok := NewTaskLocator(ctx, provider).LocateAgent(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.2"})
+		require.True(t, ok)
+		require.Equal(t, "10.0.0.3", addr)
+	})
+
+	t.Run("return false when not found", func(t *testing.T) {
+		_, ok := NewTaskLocator(ctx, provider).LocateAgent(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.3"})
+		require.False(t, ok)
+
+		_, ok = NewTaskLocator(ctx, provider).LocateAgent(payloads.Payload{})
+		require.False(t, ok)
+
+		_, ok = NewTaskLocator(ctx, &testLocatorProvider{err: errors.New("Boom")}).LocateAgent(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"})
+		require.False(t, ok)
+	})
+}
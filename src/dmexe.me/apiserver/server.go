@@ -2,7 +2,9 @@ package apiserver
 
 import (
 	"context"
+	"dmexe.me/payloads"
 	"dmexe.me/utils"
+	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	ghandlers "github.com/gorilla/handlers"
@@ -17,6 +19,12 @@ type ServerOptions struct {
 	Port     uint
 	Provider Provider
 	Broker   *Broker
+
+	// Revocations enables endpoints listing and revoking tokens
+	Revocations *payloads.Revocations
+
+	// AdminToken is a bearer token required by the revocation endpoints
+	AdminToken string
 }
 
 // Server instance
@@ -27,16 +35,24 @@ type Server struct {
 	provider      Provider
 	httpServer    *http.Server
 	broker        *Broker
+	revocations   *payloads.Revocations
+	adminToken    string
 }
 
 // NewServer creates a new server using given context and options
 func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
+	if opts.Revocations != nil && opts.AdminToken == "" {
+		return nil, errors.New("Admin token is required by revocation endpoints")
+	}
+
 	server := &Server{
 		provider:      opts.Provider,
 		listenAddress: fmt.Sprintf("%s:%d", opts.Host, opts.Port),
 		log:           utils.NewLogEntry("api.server"),
 		ctx:           ctx,
 		broker:        opts.Broker,
+		revocations:   opts.Revocations,
+		adminToken:    opts.AdminToken,
 	}
 	return server, nil
 }
@@ -45,9 +61,11 @@ func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
 func (s *Server) Run(wg *sync.WaitGroup) error {
 
 	h := &handlers{
-		log:      s.log,
-		provider: s.provider,
-		broker:   s.broker,
+		log:         s.log,
+		provider:    s.provider,
+		broker:      s.broker,
+		revocations: s.revocations,
+		adminToken:  s.adminToken,
 	}
 
 	router := h.getRouter()
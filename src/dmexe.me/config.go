@@ -8,13 +8,18 @@ import (
 	"dmexe.me/payloads"
 	"dmexe.me/sshd"
 	"dmexe.me/sshd/handlers"
+	"dmexe.me/tunnel"
 	"dmexe.me/utils"
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
+	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"log"
+	"net"
+	"os"
 	"strings"
 	"time"
 )
@@ -39,16 +44,198 @@ func (m *apiMarathonConfig) Set(value string) error {
 	return nil
 }
 
+type dockerEndpointsConfig struct {
+	endpoints []handlers.DockerEndpointOptions
+}
+
+func (d *dockerEndpointsConfig) description() string {
+	return `The named docker daemon in form name=url[,certPath], where certPath is a directory
+	with cert.pem, key.pem and ca.pem used for tcp+tls (eg. agent-1=tcp://10.0.0.1:2376,/etc/docker/agent-1).
+	Sessions are routed by the daemon payload claim or to the first daemon having the container.
+	(Can be specified multiple times, default from DOCKER_HOST environment)`
+}
+
+func (d *dockerEndpointsConfig) String() string {
+	names := make([]string, 0)
+	for _, endpoint := range d.endpoints {
+		names = append(names, endpoint.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func (d *dockerEndpointsConfig) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("Docker endpoint must be in form name=url[,certPath], got '%s'", value)
+	}
+
+	endpoint := handlers.DockerEndpointOptions{Name: fields[0]}
+
+	params := strings.SplitN(fields[1], ",", 2)
+	endpoint.Endpoint = params[0]
+	if len(params) == 2 {
+		endpoint.CertPath = params[1]
+	}
+
+	for _, known := range d.endpoints {
+		if known.Name == endpoint.Name {
+			return fmt.Errorf("Docker endpoint '%s' specified more than once", endpoint.Name)
+		}
+	}
+
+	d.endpoints = append(d.endpoints, endpoint)
+	return nil
+}
+
+type jwtConfig struct {
+	secretFile          string
+	keyring             string
+	keyringInterval     time.Duration
+	jwks                string
+	jwksInterval        time.Duration
+	issuer              string
+	audience            string
+	maxLifetime         time.Duration
+	leeway              time.Duration
+	allowMissingExp     bool
+	revocations         string
+	revocationsInterval time.Duration
+	singleUse           bool
+}
+
+type payloadConfig struct {
+	parsers              string
+	staticTokens         string
+	staticTokensInterval time.Duration
+}
+
+type introspectionConfig struct {
+	url              string
+	clientID         string
+	clientSecretFile string
+	issuer           string
+	audience         string
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	cacheSize        int
+	timeout          time.Duration
+}
+
+const (
+	payloadParserJwt           = "jwt"
+	payloadParserStatic        = "static"
+	payloadParserIntrospection = "introspection"
+)
+
+var payloadParsers = []string{payloadParserJwt, payloadParserStatic, payloadParserIntrospection}
+
 type debugConfig struct {
 	token   string
 	enabled bool
 }
 
 type shellConfig struct {
-	host    string
-	port    uint
-	keyFile string
-	enabled bool
+	host        string
+	port        uint
+	keyFile     string
+	handler     string
+	banner      string
+	maxSessions uint
+	accounting  bool
+	keyBinding  bool
+	networks    string
+	enabled     bool
+}
+
+const (
+	shellHandlerDocker     = "docker"
+	shellHandlerNsenter    = "nsenter"
+	shellHandlerKubernetes = "kubernetes"
+	shellHandlerBastion    = "bastion"
+	shellHandlerPlugin     = "plugin"
+)
+
+var shellHandlers = []string{shellHandlerDocker, shellHandlerNsenter, shellHandlerKubernetes, shellHandlerBastion, shellHandlerPlugin}
+
+type nsenterConfig struct {
+	procPath string
+	path     string
+	workDir  string
+}
+
+type kubernetesConfig struct {
+	url       string
+	tokenFile string
+	caFile    string
+	namespace string
+}
+
+type bastionConfig struct {
+	keyFile  string
+	hostKeys string
+	hosts    string
+	policy   execPolicyConfig
+}
+
+type pluginConfig struct {
+	path   string
+	args   string
+	policy execPolicyConfig
+}
+
+type dockerToolboxConfig struct {
+	archive  string
+	checksum string
+	path     string
+	remove   bool
+}
+
+type execPolicyConfig struct {
+	user       string
+	users      string
+	workingDir string
+	root       bool
+	privileged bool
+}
+
+type dockerAttachConfig struct {
+	detachKeys string
+	readOnly   bool
+}
+
+type dockerAgentConfig struct {
+	endpoint string
+	certPath string
+}
+
+type dockerConfig struct {
+	endpoints    dockerEndpointsConfig
+	agent        dockerAgentConfig
+	mode         string
+	sidecarImage string
+	shells       string
+	toolbox      dockerToolboxConfig
+	policy       execPolicyConfig
+	attach       dockerAttachConfig
+	postMortem   bool
+}
+
+type tunnelConfig struct {
+	host           string
+	port           uint
+	authorizedKeys string
+	enabled        bool
+}
+
+type agentConfig struct {
+	server    string
+	name      string
+	host      string
+	keyFile   string
+	serverKey string
+	docker    string
+	interval  time.Duration
+	enabled   bool
 }
 
 type appConfigKey string
@@ -58,27 +245,84 @@ type apiAggregatorConfig struct {
 }
 
 type apiConfig struct {
-	host       string
-	port       uint
-	marathon   apiMarathonConfig
-	aggregator apiAggregatorConfig
-	enabled    bool
+	host           string
+	port           uint
+	marathon       apiMarathonConfig
+	aggregator     apiAggregatorConfig
+	adminTokenFile string
+	enabled        bool
 }
 
 type appConfig struct {
-	shell shellConfig
-	api   apiConfig
-	debug debugConfig
-	log   *logrus.Entry
-	ctx   context.Context
+	shell         shellConfig
+	docker        dockerConfig
+	nsenter       nsenterConfig
+	kube          kubernetesConfig
+	bastion       bastionConfig
+	plugin        pluginConfig
+	tunnel        tunnelConfig
+	agent         agentConfig
+	api           apiConfig
+	jwt           jwtConfig
+	payload       payloadConfig
+	introspection introspectionConfig
+	debug         debugConfig
+	log           *logrus.Entry
+	ctx           context.Context
 }
 
 func newAppConfig(ctx context.Context) appConfig {
+	hostname, _ := os.Hostname()
+
 	return appConfig{
 		shell: shellConfig{
 			host:    "0.0.0.0",
 			port:    2200,
 			keyFile: "./id_rsa",
+			handler: shellHandlerDocker,
+		},
+		docker: dockerConfig{
+			mode:         handlers.DockerModeExec,
+			sidecarImage: handlers.DefaultSidecarImage,
+			shells:       strings.Join(handlers.DefaultShells, ","),
+			toolbox: dockerToolboxConfig{
+				path: handlers.DefaultToolboxPath,
+			},
+			policy: execPolicyConfig{
+				user: handlers.DefaultExecUser,
+			},
+			attach: dockerAttachConfig{
+				detachKeys: handlers.DefaultDetachKeys,
+			},
+		},
+		nsenter: nsenterConfig{
+			procPath: handlers.DefaultProcPath,
+			path:     handlers.DefaultNsenterPath,
+			workDir:  handlers.DefaultMesosWorkDir,
+		},
+		kube: kubernetesConfig{
+			namespace: handlers.DefaultKubernetesNamespace,
+		},
+		bastion: bastionConfig{
+			policy: execPolicyConfig{
+				user: handlers.DefaultExecUser,
+			},
+		},
+		plugin: pluginConfig{
+			policy: execPolicyConfig{
+				user: handlers.DefaultExecUser,
+			},
+		},
+		tunnel: tunnelConfig{
+			host: "0.0.0.0",
+			port: 2202,
+		},
+		agent: agentConfig{
+			name:     hostname,
+			host:     hostname,
+			keyFile:  "./id_rsa",
+			docker:   "unix:///var/run/docker.sock",
+			interval: tunnel.DefaultAgentInterval,
 		},
 		api: apiConfig{
 			host:     "0.0.0.0",
@@ -88,6 +332,22 @@ func newAppConfig(ctx context.Context) appConfig {
 				interval: time.Duration(time.Minute),
 			},
 		},
+		jwt: jwtConfig{
+			keyringInterval:     payloads.DefaultKeyringInterval,
+			jwksInterval:        payloads.DefaultKeySetInterval,
+			leeway:              30 * time.Second,
+			revocationsInterval: payloads.DefaultRevocationsInterval,
+		},
+		payload: payloadConfig{
+			parsers:              payloadParserJwt,
+			staticTokensInterval: payloads.DefaultStaticParserInterval,
+		},
+		introspection: introspectionConfig{
+			cacheTTL:         payloads.DefaultIntrospectionCacheTTL,
+			negativeCacheTTL: payloads.DefaultIntrospectionNegativeCacheTTL,
+			cacheSize:        payloads.DefaultIntrospectionCacheSize,
+			timeout:          payloads.DefaultIntrospectionTimeout,
+		},
 		debug: debugConfig{},
 		log:   utils.NewLogEntry("config"),
 		ctx:   ctx,
@@ -99,15 +359,118 @@ func (cfg *appConfig) parseArgs() {
 	flag.StringVar(&cfg.shell.host, "ssh.host", cfg.shell.host, "The local addresses ssh should listen on")
 	flag.UintVar(&cfg.shell.port, "ssh.port", cfg.shell.port, "The port number that ssh listens on")
 	flag.StringVar(&cfg.shell.keyFile, "ssh.key", cfg.shell.keyFile, "The file containing a private host key used by ssh")
+	flag.StringVar(&cfg.shell.handler, "ssh.handler", cfg.shell.handler, "The session handler (docker, nsenter, kubernetes, bastion, plugin)")
+	flag.StringVar(&cfg.shell.banner, "ssh.banner", cfg.shell.banner, "The file containing a banner shown before interactive sessions")
+	flag.UintVar(&cfg.shell.maxSessions, "ssh.max-sessions", cfg.shell.maxSessions, "The maximum number of running sessions (default unlimited)")
+	flag.BoolVar(&cfg.shell.accounting, "ssh.accounting", cfg.shell.accounting, "Log bytes transferred by sessions")
+	flag.StringVar(&cfg.shell.networks, "ssh.allowed-networks", cfg.shell.networks, "The comma separated list of networks allowed to connect (eg. 10.8.0.0/16,192.168.1.10)")
+	flag.BoolVar(&cfg.shell.keyBinding, "ssh.key-binding", cfg.shell.keyBinding, "Authenticate clients by public keys, tokens bound to a key by cnf claim are rejected without it")
 	flag.BoolVar(&cfg.shell.enabled, "ssh", cfg.shell.enabled, "Start the ssh server")
 
+	// docker config
+	flag.Var(&cfg.docker.endpoints, "docker.endpoint", cfg.docker.endpoints.description())
+	flag.StringVar(&cfg.docker.agent.endpoint, "docker.agent.endpoint", cfg.docker.agent.endpoint, "The docker url template of mesos agents (eg. tcp://{host}:2376), sessions are routed to the agent running the task")
+	flag.StringVar(&cfg.docker.agent.certPath, "docker.agent.certs", cfg.docker.agent.certPath, "The directory with cert.pem, key.pem and ca.pem used for agent docker daemons")
+	flag.StringVar(&cfg.docker.mode, "docker.mode", cfg.docker.mode, "The docker session mode (exec, sidecar, attach, logs), tokens must allow attach and logs modes")
+	flag.StringVar(&cfg.docker.sidecarImage, "docker.sidecar.image", cfg.docker.sidecarImage, "The toolbox image used in sidecar mode, the image must contain /bin/sh, the target root filesystem is linked at /target")
+	flag.StringVar(&cfg.docker.shells, "docker.shells", cfg.docker.shells, "The comma separated list of shells used when a user shell is not found in /etc/passwd")
+	flag.BoolVar(&cfg.docker.postMortem, "docker.postmortem", cfg.docker.postMortem, "Allow post-mortem sessions in a copy of stopped containers, exec mode only")
+	flag.StringVar(&cfg.docker.attach.detachKeys, "docker.attach.detach-keys", cfg.docker.attach.detachKeys, "The key sequence for detaching from the main process in attach mode")
+	flag.BoolVar(&cfg.docker.attach.readOnly, "docker.attach.readonly", cfg.docker.attach.readOnly, "Don't forward stdin to the main process in attach mode")
+	flag.StringVar(&cfg.docker.policy.user, "docker.policy.user", cfg.docker.policy.user, "The default user inside container, used when payload doesn't specify one")
+	flag.StringVar(&cfg.docker.policy.users, "docker.policy.users", cfg.docker.policy.users, "The comma separated list of users allowed in payloads (default any non root user)")
+	flag.StringVar(&cfg.docker.policy.workingDir, "docker.policy.workdir", cfg.docker.policy.workingDir, "The default working directory inside container")
+	flag.BoolVar(&cfg.docker.policy.root, "docker.policy.root", cfg.docker.policy.root, "Allow sessions as root")
+	flag.BoolVar(&cfg.docker.policy.privileged, "docker.policy.privileged", cfg.docker.policy.privileged, "Allow privileged sessions")
+	flag.StringVar(&cfg.docker.toolbox.archive, "docker.toolbox.archive", cfg.docker.toolbox.archive, "The file or url of a static toolbox tar archive injected into containers without a shell")
+	flag.StringVar(&cfg.docker.toolbox.checksum, "docker.toolbox.sha256", cfg.docker.toolbox.checksum, "The sha256 checksum of the toolbox archive")
+	flag.StringVar(&cfg.docker.toolbox.path, "docker.toolbox.path", cfg.docker.toolbox.path, "The path inside container where the toolbox is extracted")
+	flag.BoolVar(&cfg.docker.toolbox.remove, "docker.toolbox.remove", cfg.docker.toolbox.remove, "Remove the toolbox from container after the session ends")
+
+	// nsenter config
+	flag.StringVar(&cfg.nsenter.procPath, "nsenter.proc", cfg.nsenter.procPath, "The mount point of the host procfs")
+	flag.StringVar(&cfg.nsenter.path, "nsenter.path", cfg.nsenter.path, "The nsenter binary")
+	flag.StringVar(&cfg.nsenter.workDir, "nsenter.mesos-work-dir", cfg.nsenter.workDir, "The work directory of the mesos agent used to find task containers")
+
+	// kubernetes config
+	flag.StringVar(&cfg.kube.url, "kubernetes.url", cfg.kube.url, "The kubernetes api server url (default in cluster service account)")
+	flag.StringVar(&cfg.kube.tokenFile, "kubernetes.token-file", cfg.kube.tokenFile, "The file containing a bearer token for the api server")
+	flag.StringVar(&cfg.kube.caFile, "kubernetes.ca", cfg.kube.caFile, "The CA bundle used to verify the api server")
+	flag.StringVar(&cfg.kube.namespace, "kubernetes.namespace", cfg.kube.namespace, "The namespace used when payload doesn't specify one")
+
+	// bastion config
+	flag.StringVar(&cfg.bastion.keyFile, "bastion.key", cfg.bastion.keyFile, "The file containing a private key used for upstream hosts (default the agent forwarded by client only)")
+	flag.StringVar(&cfg.bastion.hostKeys, "bastion.host-keys", cfg.bastion.hostKeys, "The file containing trusted host keys of upstream hosts in known_hosts format")
+	flag.StringVar(&cfg.bastion.hosts, "bastion.hosts", cfg.bastion.hosts, "The comma separated list of allowed upstream host patterns (eg. 10.0.1.*,*.vm.example.com)")
+	flag.StringVar(&cfg.bastion.policy.user, "bastion.policy.user", cfg.bastion.policy.user, "The default upstream user, used when payload doesn't specify one")
+	flag.StringVar(&cfg.bastion.policy.users, "bastion.policy.users", cfg.bastion.policy.users, "The comma separated list of upstream users allowed in payloads (default any non root user)")
+	flag.StringVar(&cfg.bastion.policy.workingDir, "bastion.policy.workdir", cfg.bastion.policy.workingDir, "The default working directory on upstream hosts")
+	flag.BoolVar(&cfg.bastion.policy.root, "bastion.policy.root", cfg.bastion.policy.root, "Allow sessions as root on upstream hosts")
+
+	// plugin config
+	flag.StringVar(&cfg.plugin.path, "plugin.path", cfg.plugin.path, "The plugin executable started for every session")
+	flag.StringVar(&cfg.plugin.args, "plugin.args", cfg.plugin.args, "The space separated list of plugin arguments")
+	flag.StringVar(&cfg.plugin.policy.user, "plugin.policy.user", cfg.plugin.policy.user, "The default user passed to the plugin, used when payload doesn't specify one")
+	flag.StringVar(&cfg.plugin.policy.users, "plugin.policy.users", cfg.plugin.policy.users, "The comma separated list of users allowed in payloads (default any non root user)")
+	flag.StringVar(&cfg.plugin.policy.workingDir, "plugin.policy.workdir", cfg.plugin.policy.workingDir, "The default working directory passed to the plugin")
+	flag.BoolVar(&cfg.plugin.policy.root, "plugin.policy.root", cfg.plugin.policy.root, "Allow sessions as root")
+	flag.BoolVar(&cfg.plugin.policy.privileged, "plugin.policy.privileged", cfg.plugin.policy.privileged, "Allow privileged sessions")
+
+	// tunnel config
+	flag.StringVar(&cfg.tunnel.host, "tunnel.host", cfg.tunnel.host, "The local addresses tunnel server for agents should listen on")
+	flag.UintVar(&cfg.tunnel.port, "tunnel.port", cfg.tunnel.port, "The port number that tunnel server listens on")
+	flag.StringVar(&cfg.tunnel.authorizedKeys, "tunnel.authorized-keys", cfg.tunnel.authorizedKeys, "The file containing public keys of agents in authorized_keys format, the key comment is the agent name")
+	flag.BoolVar(&cfg.tunnel.enabled, "tunnel", cfg.tunnel.enabled, "Start the tunnel server for agents, sessions are routed through connected agents")
+
+	// agent config
+	flag.StringVar(&cfg.agent.server, "agent.server", cfg.agent.server, "The tunnel server address (eg. proxy.example.com:2202)")
+	flag.StringVar(&cfg.agent.name, "agent.name", cfg.agent.name, "The agent name, used as a docker daemon name in payloads")
+	flag.StringVar(&cfg.agent.host, "agent.host", cfg.agent.host, "The agent host reported to the tunnel server")
+	flag.StringVar(&cfg.agent.keyFile, "agent.key", cfg.agent.keyFile, "The file containing a private key used by agent")
+	flag.StringVar(&cfg.agent.serverKey, "agent.server-key", cfg.agent.serverKey, "The file containing the tunnel server public key in authorized_keys format")
+	flag.StringVar(&cfg.agent.docker, "agent.docker", cfg.agent.docker, "The local docker daemon url")
+	flag.DurationVar(&cfg.agent.interval, "agent.interval", cfg.agent.interval, "The containers report interval")
+	flag.BoolVar(&cfg.agent.enabled, "agent", cfg.agent.enabled, "Run as agent connected to the tunnel server")
+
 	// api server config
 	flag.StringVar(&cfg.api.host, "api.host", cfg.api.host, "The local addresses api server should listen on")
 	flag.UintVar(&cfg.api.port, "api.port", cfg.api.port, "The port number that api server listens on")
 	flag.Var(&cfg.api.marathon, "api.marathon.url", cfg.api.marathon.description())
 	flag.DurationVar(&cfg.api.aggregator.interval, "api.interval", cfg.api.aggregator.interval, "The pool interval")
+	flag.StringVar(&cfg.api.adminTokenFile, "api.admin-token-file", cfg.api.adminTokenFile, "The file containing the bearer token required by revocation endpoints (default API_ADMIN_TOKEN environment)")
 	flag.BoolVar(&cfg.api.enabled, "api", cfg.api.enabled, "Start the api server")
 
+	// payload config
+	flag.StringVar(&cfg.payload.parsers, "payload.parsers", cfg.payload.parsers, fmt.Sprintf("The comma separated list of credential backends tried in order, available [%s]", strings.Join(payloadParsers, "] [")))
+	flag.StringVar(&cfg.payload.staticTokens, "static.tokens", cfg.payload.staticTokens, "The JSON file of opaque tokens stored as sha256 hex digests, used by static parser")
+	flag.DurationVar(&cfg.payload.staticTokensInterval, "static.tokens.interval", cfg.payload.staticTokensInterval, "The static tokens file reload interval")
+
+	// introspection config
+	flag.StringVar(&cfg.introspection.url, "introspection.url", cfg.introspection.url, "The OAuth2 token introspection endpoint (RFC 7662), used by introspection parser")
+	flag.StringVar(&cfg.introspection.clientID, "introspection.client-id", cfg.introspection.clientID, "The client id used to authenticate introspection requests")
+	flag.StringVar(&cfg.introspection.clientSecretFile, "introspection.client-secret-file", cfg.introspection.clientSecretFile, "The file containing the client secret used to authenticate introspection requests (default INTROSPECTION_CLIENT_SECRET environment)")
+	flag.StringVar(&cfg.introspection.issuer, "introspection.issuer", cfg.introspection.issuer, "The required iss member of introspection responses")
+	flag.StringVar(&cfg.introspection.audience, "introspection.audience", cfg.introspection.audience, "The audience which must be contained in aud member of introspection responses")
+	flag.DurationVar(&cfg.introspection.cacheTTL, "introspection.cache-ttl", cfg.introspection.cacheTTL, "The cache duration of active tokens, limited by exp member")
+	flag.DurationVar(&cfg.introspection.negativeCacheTTL, "introspection.negative-cache-ttl", cfg.introspection.negativeCacheTTL, "The cache duration of rejected tokens")
+	flag.IntVar(&cfg.introspection.cacheSize, "introspection.cache-size", cfg.introspection.cacheSize, "The maximum number of cached tokens, rejected tokens are not cached when it's reached")
+	flag.DurationVar(&cfg.introspection.timeout, "introspection.timeout", cfg.introspection.timeout, "The introspection request timeout")
+
+	// jwt config
+	flag.StringVar(&cfg.jwt.secretFile, "jwt.secret-file", cfg.jwt.secretFile, "The file containing the secret used to verify HMAC tokens (default JWT_SECRET environment)")
+	flag.StringVar(&cfg.jwt.keyring, "jwt.keyring", cfg.jwt.keyring, "The directory of HMAC secrets selected by token kid, <kid>.key is the active key, <kid>.verify keys are used only for verification")
+	flag.DurationVar(&cfg.jwt.keyringInterval, "jwt.keyring.interval", cfg.jwt.keyringInterval, "The keyring directory reload interval")
+	flag.StringVar(&cfg.jwt.jwks, "jwt.jwks", cfg.jwt.jwks, "The file or url of the JWKS document used to verify asymmetric tokens (RS256, ES256, EdDSA)")
+	flag.DurationVar(&cfg.jwt.jwksInterval, "jwt.jwks.interval", cfg.jwt.jwksInterval, "The JWKS document refresh interval")
+	flag.StringVar(&cfg.jwt.issuer, "jwt.issuer", cfg.jwt.issuer, "The required iss claim of tokens")
+	flag.StringVar(&cfg.jwt.audience, "jwt.audience", cfg.jwt.audience, "The audience which must be contained in aud claim of tokens")
+	flag.DurationVar(&cfg.jwt.maxLifetime, "jwt.max-lifetime", cfg.jwt.maxLifetime, "The maximum token lifetime from iat claim (default unlimited)")
+	flag.DurationVar(&cfg.jwt.leeway, "jwt.leeway", cfg.jwt.leeway, "The clock skew tolerance for exp, nbf and iat claims")
+	flag.BoolVar(&cfg.jwt.allowMissingExp, "jwt.allow-missing-exp", cfg.jwt.allowMissingExp, "Accept tokens without exp claim, they never expire")
+	flag.StringVar(&cfg.jwt.revocations, "jwt.revocations", cfg.jwt.revocations, "The file of revoked token ids (jti claim), entries added by the api server are appended to it")
+	flag.DurationVar(&cfg.jwt.revocationsInterval, "jwt.revocations.interval", cfg.jwt.revocationsInterval, "The revocations file reload interval")
+	flag.BoolVar(&cfg.jwt.singleUse, "jwt.single-use", cfg.jwt.singleUse, "Require jti and exp claims and reject tokens used more than once, used tokens are remembered by each proxy instance until restart")
+
 	// debug config
 	flag.StringVar(&cfg.debug.token, "debug.token", cfg.debug.token, "The debug token")
 	flag.BoolVar(&cfg.debug.enabled, "debug", false, "Enable debug output")
@@ -120,16 +483,184 @@ func (cfg *appConfig) validate() error {
 		if len(cfg.api.marathon.urls) == 0 {
 			return errors.New("API server enabled, but no urls specified, please add at least one [-api.marathon.url] flag")
 		}
+
+		if cfg.jwt.revocations != "" && cfg.api.adminTokenFile == "" && os.Getenv("API_ADMIN_TOKEN") == "" {
+			return errors.New("API server serves revocations, but no admin token specified, please set API_ADMIN_TOKEN environment or add [-api.admin-token-file] flag")
+		}
+	}
+
+	if err := cfg.validatePayloadParsers(); err != nil {
+		return err
 	}
 
-	if !cfg.api.enabled && !cfg.shell.enabled {
-		return errors.New("No listeners, please add at least one of this flags [-ssh] [-api]")
+	if cfg.shell.enabled && cfg.debug.token == "" && cfg.hasPayloadParser(payloadParserStatic) && cfg.payload.staticTokens == "" {
+		return errors.New("Static parser enabled, but no tokens file specified, please add [-static.tokens] flag")
 	}
 
+	if cfg.shell.enabled && cfg.debug.token == "" && cfg.hasPayloadParser(payloadParserIntrospection) && cfg.introspection.url == "" {
+		return errors.New("Introspection parser enabled, but no endpoint specified, please add [-introspection.url] flag")
+	}
+
+	if cfg.shell.enabled && cfg.debug.token == "" && cfg.hasPayloadParser(payloadParserJwt) && cfg.jwt.secretFile == "" && cfg.jwt.keyring == "" && cfg.jwt.jwks == "" && os.Getenv("JWT_SECRET") == "" {
+		return errors.New("No JWT keys specified, please set JWT_SECRET environment or add [-jwt.secret-file], [-jwt.keyring] or [-jwt.jwks] flag")
+	}
+
+	if cfg.docker.agent.endpoint != "" && len(cfg.api.marathon.urls) == 0 {
+		return errors.New("Agent routing enabled, but no urls specified, please add at least one [-api.marathon.url] flag")
+	}
+
+	if err := cfg.validateShellHandler(); err != nil {
+		return err
+	}
+
+	if cfg.shell.handler == shellHandlerBastion && (cfg.bastion.hostKeys == "" || cfg.bastion.hosts == "") {
+		return errors.New("Bastion handler enabled, but no upstream hosts specified, please add [-bastion.host-keys] and [-bastion.hosts] flags")
+	}
+
+	if cfg.shell.handler == shellHandlerPlugin && cfg.plugin.path == "" {
+		return errors.New("Plugin handler enabled, but no executable specified, please add [-plugin.path] flag")
+	}
+
+	if err := cfg.validateDockerMode(); err != nil {
+		return err
+	}
+
+	if cfg.docker.toolbox.archive != "" && cfg.docker.toolbox.checksum == "" {
+		return errors.New("Toolbox archive specified, but no checksum, please add [-docker.toolbox.sha256] flag")
+	}
+
+	if cfg.tunnel.enabled && !cfg.shell.enabled {
+		return errors.New("Tunnel server enabled, but ssh server is not, please add [-ssh] flag")
+	}
+
+	if cfg.tunnel.enabled && cfg.tunnel.authorizedKeys == "" {
+		return errors.New("Tunnel server enabled, but no agent keys specified, please add [-tunnel.authorized-keys] flag")
+	}
+
+	if cfg.agent.enabled && (cfg.agent.server == "" || cfg.agent.serverKey == "") {
+		return errors.New("Agent enabled, but no server specified, please add [-agent.server] and [-agent.server-key] flags")
+	}
+
+	if !cfg.api.enabled && !cfg.shell.enabled && !cfg.agent.enabled {
+		return errors.New("No listeners, please add at least one of this flags [-ssh] [-api] [-agent]")
+	}
+
+	return nil
+}
+
+func (cfg *appConfig) getPayloadParserNames() []string {
+	names := strings.Split(cfg.payload.parsers, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	return names
+}
+
+func (cfg *appConfig) hasPayloadParser(name string) bool {
+	for _, it := range cfg.getPayloadParserNames() {
+		if it == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *appConfig) validatePayloadParsers() error {
+	for _, name := range cfg.getPayloadParserNames() {
+		known := false
+		for _, it := range payloadParsers {
+			known = known || it == name
+		}
+
+		if !known {
+			return fmt.Errorf("Unknown payload parser '%s', please use one of [%s]", name, strings.Join(payloadParsers, "] ["))
+		}
+	}
 	return nil
 }
 
-func (cfg *appConfig) getPayloadParser() payloads.Parser {
+func (cfg *appConfig) validateShellHandler() error {
+	for _, handler := range shellHandlers {
+		if handler == cfg.shell.handler {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown ssh handler '%s', please use one of [%s]", cfg.shell.handler, strings.Join(shellHandlers, "] ["))
+}
+
+func (cfg *appConfig) validateDockerMode() error {
+	for _, mode := range handlers.DockerModes {
+		if mode == cfg.docker.mode {
+			if cfg.docker.postMortem && mode != handlers.DockerModeExec {
+				return fmt.Errorf("Post-mortem sessions require docker mode '%s', got '%s'", handlers.DockerModeExec, mode)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown docker mode '%s', please use one of [%s]", cfg.docker.mode, strings.Join(handlers.DockerModes, "] ["))
+}
+
+func (cfg *appConfig) getRevocations() *payloads.Revocations {
+	if cfg.jwt.revocations == "" {
+		return nil
+	}
+
+	revocations, err := payloads.NewRevocations(cfg.newChildContext(), payloads.RevocationsOptions{
+		Path:     cfg.jwt.revocations,
+		Interval: cfg.jwt.revocationsInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return revocations
+}
+
+func (cfg *appConfig) getKeyring() *payloads.Keyring {
+	if cfg.jwt.keyring == "" {
+		return nil
+	}
+
+	keyring, err := payloads.NewKeyring(cfg.newChildContext(), payloads.KeyringOptions{
+		Path:     cfg.jwt.keyring,
+		Interval: cfg.jwt.keyringInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keyring
+}
+
+func (cfg *appConfig) getKeySet() *payloads.KeySet {
+	if cfg.jwt.jwks == "" {
+		return nil
+	}
+
+	keySet, err := payloads.NewKeySet(cfg.newChildContext(), payloads.KeySetOptions{
+		Source:   cfg.jwt.jwks,
+		Interval: cfg.jwt.jwksInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keySet
+}
+
+func (cfg *appConfig) getStaticParser() *payloads.StaticParser {
+	if cfg.debug.token != "" || !cfg.hasPayloadParser(payloadParserStatic) {
+		return nil
+	}
+
+	staticParser, err := payloads.NewStaticParser(cfg.newChildContext(), payloads.StaticParserOptions{
+		Path:     cfg.payload.staticTokens,
+		Interval: cfg.payload.staticTokensInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return staticParser
+}
+
+func (cfg *appConfig) getPayloadParser(keyring *payloads.Keyring, keySet *payloads.KeySet, revocations *payloads.Revocations, staticParser *payloads.StaticParser) payloads.Parser {
 	if cfg.debug.token != "" {
 		cfg.log.Warnf("Force payload to ContainerID=%s", cfg.debug.token)
 		return &payloads.EchoParser{
@@ -137,7 +668,79 @@ func (cfg *appConfig) getPayloadParser() payloads.Parser {
 		}
 	}
 
-	jwtParser, err := payloads.NewJwtParserFromEnv()
+	parsers := make([]payloads.NamedParser, 0)
+	for _, name := range cfg.getPayloadParserNames() {
+		var parser payloads.Parser
+
+		switch name {
+		case payloadParserJwt:
+			parser = cfg.getJwtParser(keyring, keySet, revocations)
+		case payloadParserStatic:
+			parser = staticParser
+		case payloadParserIntrospection:
+			parser = cfg.getIntrospectionParser()
+		}
+
+		parsers = append(parsers, payloads.NamedParser{Name: name, Parser: parser})
+	}
+
+	chainParser, err := payloads.NewChainParser(payloads.ChainParserOptions{Parsers: parsers})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return chainParser
+}
+
+func (cfg *appConfig) getIntrospectionParser() payloads.Parser {
+	opts := payloads.IntrospectionParserOptions{
+		URL:              cfg.introspection.url,
+		ClientID:         cfg.introspection.clientID,
+		ClientSecret:     os.Getenv("INTROSPECTION_CLIENT_SECRET"),
+		Issuer:           cfg.introspection.issuer,
+		Audience:         cfg.introspection.audience,
+		CacheTTL:         cfg.introspection.cacheTTL,
+		NegativeCacheTTL: cfg.introspection.negativeCacheTTL,
+		CacheSize:        cfg.introspection.cacheSize,
+		Timeout:          cfg.introspection.timeout,
+	}
+
+	if cfg.introspection.clientSecretFile != "" {
+		secret, err := ioutil.ReadFile(cfg.introspection.clientSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.ClientSecret = strings.TrimSpace(string(secret))
+	}
+
+	introspectionParser, err := payloads.NewIntrospectionParser(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return introspectionParser
+}
+
+func (cfg *appConfig) getJwtParser(keyring *payloads.Keyring, keySet *payloads.KeySet, revocations *payloads.Revocations) payloads.Parser {
+	opts := payloads.JwtParserOptions{
+		Keyring:         keyring,
+		KeySet:          keySet,
+		Issuer:          cfg.jwt.issuer,
+		Audience:        cfg.jwt.audience,
+		MaxLifetime:     cfg.jwt.maxLifetime,
+		Leeway:          cfg.jwt.leeway,
+		AllowMissingExp: cfg.jwt.allowMissingExp,
+		Revocations:     revocations,
+		SingleUse:       cfg.jwt.singleUse,
+	}
+
+	if cfg.jwt.secretFile != "" {
+		secret, err := ioutil.ReadFile(cfg.jwt.secretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Secret = strings.TrimSpace(string(secret))
+	}
+
+	jwtParser, err := payloads.NewJwtParserFromEnv(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -152,15 +755,276 @@ func (cfg *appConfig) getDockerClient() *docker.Client {
 	return dockerClient
 }
 
-func (cfg *appConfig) getDockerShellHandler(dockerClient *docker.Client) handlers.HandlerFunc {
+func (cfg *appConfig) getDockerEndpoints() []handlers.DockerEndpoint {
+	if len(cfg.docker.endpoints.endpoints) == 0 {
+		return []handlers.DockerEndpoint{{Name: handlers.DefaultDockerEndpoint, Client: cfg.getDockerClient()}}
+	}
+
+	endpoints := make([]handlers.DockerEndpoint, 0)
+	for _, opts := range cfg.docker.endpoints.endpoints {
+		endpoint, err := handlers.NewDockerEndpoint(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+func (cfg *appConfig) getDockerToolbox() *handlers.Toolbox {
+	if cfg.docker.toolbox.archive == "" {
+		return nil
+	}
+
+	toolbox, err := handlers.NewToolbox(handlers.ToolboxOptions{
+		Archive:  cfg.docker.toolbox.archive,
+		Checksum: cfg.docker.toolbox.checksum,
+		Path:     cfg.docker.toolbox.path,
+		Remove:   cfg.docker.toolbox.remove,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := toolbox.Load(); err != nil {
+		log.Fatal(err)
+	}
+
+	return toolbox
+}
+
+func (cfg *appConfig) getDockerPolicy() handlers.ExecPolicy {
+	return cfg.docker.policy.execPolicy()
+}
+
+func (p execPolicyConfig) execPolicy() handlers.ExecPolicy {
+	policy := handlers.ExecPolicy{
+		DefaultUser:       p.user,
+		DefaultWorkingDir: p.workingDir,
+		AllowRoot:         p.root,
+		AllowPrivileged:   p.privileged,
+	}
+
+	if p.users != "" {
+		policy.AllowedUsers = strings.Split(p.users, ",")
+	}
+
+	return policy
+}
+
+func (cfg *appConfig) getDockerAgents(provider apiserver.Provider) *handlers.AgentEndpoints {
+	if cfg.docker.agent.endpoint == "" {
+		return nil
+	}
+
+	agents, err := handlers.NewAgentEndpoints(handlers.AgentEndpointsOptions{
+		Endpoint: cfg.docker.agent.endpoint,
+		CertPath: cfg.docker.agent.certPath,
+		Locator:  apiserver.NewTaskLocator(cfg.newChildContext(), provider),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return agents
+}
+
+func (cfg *appConfig) getDockerRouters(provider apiserver.Provider, tunnelServer *tunnel.Server) []handlers.DockerRouter {
+	routers := make([]handlers.DockerRouter, 0)
+
+	if tunnelServer != nil {
+		routers = append(routers, tunnelServer)
+	}
+
+	if agents := cfg.getDockerAgents(provider); agents != nil {
+		routers = append(routers, agents)
+	}
+
+	return routers
+}
+
+func (cfg *appConfig) getDockerShellHandler(endpoints []handlers.DockerEndpoint, routers []handlers.DockerRouter) handlers.HandlerFunc {
+	toolbox := cfg.getDockerToolbox()
+	policy := cfg.getDockerPolicy()
+
 	handler := func() (handlers.Handler, error) {
 		return handlers.NewDockerHandler(handlers.DockerHandlerOptions{
-			Client: dockerClient,
+			Endpoints:    endpoints,
+			Routers:      routers,
+			Mode:         cfg.docker.mode,
+			SidecarImage: cfg.docker.sidecarImage,
+			Toolbox:      toolbox,
+			Shells:       strings.Split(cfg.docker.shells, ","),
+			Policy:       policy,
+			Attach: handlers.AttachOptions{
+				DetachKeys: cfg.docker.attach.detachKeys,
+				ReadOnly:   cfg.docker.attach.readOnly,
+			},
+			PostMortem: cfg.docker.postMortem,
+		})
+	}
+	return handler
+}
+
+func (cfg *appConfig) getNsenterShellHandler() handlers.HandlerFunc {
+	policy := cfg.getDockerPolicy()
+
+	handler := func() (handlers.Handler, error) {
+		return handlers.NewNsenterHandler(handlers.NsenterHandlerOptions{
+			ProcPath:     cfg.nsenter.procPath,
+			Nsenter:      cfg.nsenter.path,
+			MesosWorkDir: cfg.nsenter.workDir,
+			Shells:       strings.Split(cfg.docker.shells, ","),
+			Policy:       policy,
 		})
 	}
 	return handler
 }
 
+func (cfg *appConfig) getKubernetesClient() *handlers.KubernetesClient {
+	if cfg.kube.url == "" {
+		kubeClient, err := handlers.NewKubernetesClientInCluster()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return kubeClient
+	}
+
+	opts := handlers.KubernetesClientOptions{
+		Endpoint: cfg.kube.url,
+	}
+
+	if cfg.kube.tokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.kube.tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Token = strings.TrimSpace(string(token))
+	}
+
+	if cfg.kube.caFile != "" {
+		tlsConfig, err := handlers.NewKubernetesTLSConfig(cfg.kube.caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	kubeClient, err := handlers.NewKubernetesClient(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return kubeClient
+}
+
+func (cfg *appConfig) getKubernetesShellHandler(kubeClient *handlers.KubernetesClient) handlers.HandlerFunc {
+	policy := cfg.getDockerPolicy()
+
+	handler := func() (handlers.Handler, error) {
+		return handlers.NewKubernetesHandler(handlers.KubernetesHandlerOptions{
+			Client:    kubeClient,
+			Namespace: cfg.kube.namespace,
+			Policy:    policy,
+		})
+	}
+
+	// pods/exec can't switch users, the policy must allow root
+	if _, err := handler(); err != nil {
+		log.Fatalf("%s, use -docker.policy.root", err)
+	}
+	return handler
+}
+
+func (cfg *appConfig) getBastionShellHandler() handlers.HandlerFunc {
+	policy := cfg.bastion.policy.execPolicy()
+
+	knownHosts, err := handlers.ParseKnownHosts(cfg.bastion.hostKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var signer ssh.Signer
+	if cfg.bastion.keyFile != "" {
+		privateKey, err := ioutil.ReadFile(cfg.bastion.keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		signer, err = ssh.ParsePrivateKey(privateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	handler := func() (handlers.Handler, error) {
+		return handlers.NewBastionHandler(handlers.BastionHandlerOptions{
+			Signer:       signer,
+			KnownHosts:   knownHosts,
+			AllowedHosts: strings.Split(cfg.bastion.hosts, ","),
+			Policy:       policy,
+		})
+	}
+	return handler
+}
+
+func (cfg *appConfig) getPluginShellHandler() handlers.HandlerFunc {
+	policy := cfg.plugin.policy.execPolicy()
+
+	handler := func() (handlers.Handler, error) {
+		return handlers.NewPluginHandler(handlers.PluginHandlerOptions{
+			Path:   cfg.plugin.path,
+			Args:   strings.Fields(cfg.plugin.args),
+			Policy: policy,
+		})
+	}
+	return handler
+}
+
+// getShellHandler returns the configured handler, api clients are created only for the used handler
+func (cfg *appConfig) getShellHandler(provider apiserver.Provider, tunnelServer *tunnel.Server) handlers.HandlerFunc {
+	switch cfg.shell.handler {
+	case shellHandlerNsenter:
+		return cfg.getNsenterShellHandler()
+	case shellHandlerKubernetes:
+		return cfg.getKubernetesShellHandler(cfg.getKubernetesClient())
+	case shellHandlerBastion:
+		return cfg.getBastionShellHandler()
+	case shellHandlerPlugin:
+		return cfg.getPluginShellHandler()
+	}
+	return cfg.getDockerShellHandler(cfg.getDockerEndpoints(), cfg.getDockerRouters(provider, tunnelServer))
+}
+
+// getShellModeFunc returns session modes of the configured handler, only docker handler serves logs and attach
+func (cfg *appConfig) getShellModeFunc() handlers.ModeFunc {
+	if cfg.shell.handler != shellHandlerDocker {
+		return handlers.ShellMode
+	}
+	return handlers.DockerModeFunc(cfg.docker.mode)
+}
+
+// getShellMiddlewares returns middlewares wrapping any shell handler, the first is the outermost
+func (cfg *appConfig) getShellMiddlewares() []handlers.Middleware {
+	middlewares := make([]handlers.Middleware, 0)
+
+	if cfg.shell.maxSessions > 0 {
+		middlewares = append(middlewares, handlers.LimitMiddleware(int(cfg.shell.maxSessions)))
+	}
+
+	if cfg.shell.accounting {
+		middlewares = append(middlewares, handlers.AccountingMiddleware())
+	}
+
+	if cfg.shell.banner != "" {
+		banner, err := ioutil.ReadFile(cfg.shell.banner)
+		if err != nil {
+			log.Fatal(err)
+		}
+		middlewares = append(middlewares, handlers.BannerMiddleware(string(banner)))
+	}
+
+	return middlewares
+}
+
 func (cfg *appConfig) getPrivateKey() []byte {
 	privateKey, err := ioutil.ReadFile(cfg.shell.keyFile)
 	if err != nil {
@@ -170,12 +1034,24 @@ func (cfg *appConfig) getPrivateKey() []byte {
 }
 
 func (cfg *appConfig) getShellServer(privateKey []byte, handlerFunc handlers.HandlerFunc, payloadParser payloads.Parser) *sshd.Server {
+	var networks []*net.IPNet
+	if cfg.shell.networks != "" {
+		parsed, err := utils.ParseNetworks(strings.Split(cfg.shell.networks, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		networks = parsed
+	}
+
 	serverOptions := sshd.ServerOptions{
-		PrivateKey:  privateKey,
-		Host:        cfg.shell.host,
-		Port:        cfg.shell.port,
-		HandlerFunc: handlerFunc,
-		Parser:      payloadParser,
+		PrivateKey:      privateKey,
+		Host:            cfg.shell.host,
+		Port:            cfg.shell.port,
+		HandlerFunc:     handlerFunc,
+		ModeFunc:        cfg.getShellModeFunc(),
+		Parser:          payloadParser,
+		KeyBinding:      cfg.shell.keyBinding,
+		AllowedNetworks: networks,
 	}
 
 	server, err := sshd.NewServer(cfg.newChildContext(), serverOptions)
@@ -186,6 +1062,56 @@ func (cfg *appConfig) getShellServer(privateKey []byte, handlerFunc handlers.Han
 	return server
 }
 
+func (cfg *appConfig) getTunnelServer(privateKey []byte) *tunnel.Server {
+	authorizedKeys, err := tunnel.ParseAgentKeys(cfg.tunnel.authorizedKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := tunnel.ServerOptions{
+		PrivateKey:     privateKey,
+		AuthorizedKeys: authorizedKeys,
+		Host:           cfg.tunnel.host,
+		Port:           cfg.tunnel.port,
+	}
+
+	server, err := tunnel.NewServer(cfg.newChildContext(), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return server
+}
+
+func (cfg *appConfig) getTunnelAgent() *tunnel.Agent {
+	privateKey, err := ioutil.ReadFile(cfg.agent.keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serverKeys, err := tunnel.ParseAuthorizedKeys(cfg.agent.serverKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := tunnel.AgentOptions{
+		Server:         cfg.agent.server,
+		Name:           cfg.agent.name,
+		Host:           cfg.agent.host,
+		PrivateKey:     privateKey,
+		ServerKeys:     serverKeys,
+		DockerEndpoint: cfg.agent.docker,
+		Interval:       cfg.agent.interval,
+	}
+
+	agent, err := tunnel.NewAgent(cfg.newChildContext(), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return agent
+}
+
 func (cfg *appConfig) getBroker() *apiserver.Broker {
 	return apiserver.NewBroker(cfg.newChildContext())
 }
@@ -218,12 +1144,22 @@ func (cfg *appConfig) getAPIProvider(broker *apiserver.Broker) apiserver.Runnabl
 	return manager
 }
 
-func (cfg *appConfig) getAPIServer(provider apiserver.Provider, broker *apiserver.Broker) *apiserver.Server {
+func (cfg *appConfig) getAPIServer(provider apiserver.Provider, broker *apiserver.Broker, revocations *payloads.Revocations) *apiserver.Server {
 	opts := apiserver.ServerOptions{
-		Host:     cfg.api.host,
-		Port:     cfg.api.port,
-		Provider: provider,
-		Broker:   broker,
+		Host:        cfg.api.host,
+		Port:        cfg.api.port,
+		Provider:    provider,
+		Broker:      broker,
+		Revocations: revocations,
+		AdminToken:  os.Getenv("API_ADMIN_TOKEN"),
+	}
+
+	if cfg.api.adminTokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.api.adminTokenFile)
+		if err != nil {
+			cfg.log.Fatal(err)
+		}
+		opts.AdminToken = strings.TrimSpace(string(token))
 	}
 
 	apiServer, err := apiserver.NewServer(cfg.newChildContext(), opts)
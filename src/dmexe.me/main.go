@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"dmexe.me/apiserver"
+	"dmexe.me/sshd/handlers"
+	"dmexe.me/tunnel"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"os"
@@ -28,35 +31,87 @@ func main() {
 		log.Debug("Debug output enabled")
 	}
 
-	if cfg.api.enabled {
-		broker := cfg.getBroker()
+	var (
+		broker   *apiserver.Broker
+		provider apiserver.RunnableProvider
+	)
+
+	// tasks are also loaded when the ssh server routes sessions to agents
+	if cfg.api.enabled || cfg.docker.agent.endpoint != "" {
+		broker = cfg.getBroker()
 		if err := broker.Run(&wg); err != nil {
 			log.Fatal(err)
 		}
 
-		provider := cfg.getAPIProvider(broker)
+		provider = cfg.getAPIProvider(broker)
 		if err := provider.Run(&wg); err != nil {
 			log.Fatal(err)
 		}
+	}
 
-		server := cfg.getAPIServer(provider, broker)
+	// revocations are shared by the api server and the ssh server
+	revocations := cfg.getRevocations()
+	if revocations != nil {
+		if err := revocations.Run(&wg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.api.enabled {
+		server := cfg.getAPIServer(provider, broker, revocations)
 		if err := server.Run(&wg); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 	if cfg.shell.enabled {
-		payloadParser := cfg.getPayloadParser()
-		dockerClient := cfg.getDockerClient()
-		dockerShellHandler := cfg.getDockerShellHandler(dockerClient)
+		keyring := cfg.getKeyring()
+		if keyring != nil {
+			if err := keyring.Run(&wg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		keySet := cfg.getKeySet()
+		if keySet != nil {
+			if err := keySet.Run(&wg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		staticParser := cfg.getStaticParser()
+		if staticParser != nil {
+			if err := staticParser.Run(&wg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		payloadParser := cfg.getPayloadParser(keyring, keySet, revocations, staticParser)
 		privateKey := cfg.getPrivateKey()
-		shellServer := cfg.getShellServer(privateKey, dockerShellHandler, payloadParser)
+
+		var tunnelServer *tunnel.Server
+		if cfg.tunnel.enabled {
+			tunnelServer = cfg.getTunnelServer(privateKey)
+			if err := tunnelServer.Run(&wg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		shellHandler := handlers.Chain(cfg.getShellHandler(provider, tunnelServer), cfg.getShellMiddlewares()...)
+		shellServer := cfg.getShellServer(privateKey, shellHandler, payloadParser)
 
 		if err := shellServer.Run(&wg); err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	if cfg.agent.enabled {
+		agent := cfg.getTunnelAgent()
+		if err := agent.Run(&wg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
@@ -0,0 +1,92 @@
+package payloads
+
+import (
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// NamedParser is a backend of the chain parser
+type NamedParser struct {
+	Name   string
+	Parser Parser
+}
+
+// ChainParserOptions keeps parameters for chain parser instance
+type ChainParserOptions struct {
+	// Parsers are tried in order, the first one accepted the token wins
+	Parsers []NamedParser
+}
+
+// ChainParser tries several credential backends, the name of the matched one
+// is recorded in the payload
+type ChainParser struct {
+	parsers []NamedParser
+	log     *logrus.Entry
+}
+
+// NewChainParser constructs a new parser instance using given options
+func NewChainParser(opts ChainParserOptions) (*ChainParser, error) {
+	if len(opts.Parsers) == 0 {
+		return nil, errors.New("Chain parser requires at least one parser")
+	}
+
+	for _, it := range opts.Parsers {
+		if it.Name == "" || it.Parser == nil {
+			return nil, errors.New("Chain parser requires named parsers")
+		}
+	}
+
+	parser := &ChainParser{
+		parsers: opts.Parsers,
+		log:     utils.NewLogEntry("payloads.chain"),
+	}
+	return parser, nil
+}
+
+// Parse tries parsers in order, fails with errors of all parsers when none accepted the token
+func (p *ChainParser) Parse(token string) (Payload, error) {
+	errs := make([]string, 0, len(p.parsers))
+
+	for _, it := range p.parsers {
+		payload, err := it.Parser.Parse(token)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", it.Name, err))
+			continue
+		}
+
+		p.log.Debugf("Token accepted by %s parser", it.Name)
+		payload.Parser = it.Name
+		return payload, nil
+	}
+
+	return Payload{}, fmt.Errorf("Token is not accepted by any parser (%s)", strings.Join(errs, "; "))
+}
+
+// Consume passes the payload to the parser accepted the token
+func (p *ChainParser) Consume(payload Payload) error {
+	for _, it := range p.parsers {
+		if it.Name != payload.Parser {
+			continue
+		}
+		if consumer, ok := it.Parser.(Consumer); ok {
+			return consumer.Consume(payload)
+		}
+		return nil
+	}
+	return nil
+}
+
+// BoundKey returns the first key fingerprint found by parsers
+func (p *ChainParser) BoundKey(token string) string {
+	for _, it := range p.parsers {
+		if binder, ok := it.Parser.(KeyBinder); ok {
+			if fingerprint := binder.BoundKey(token); fingerprint != "" {
+				return fingerprint
+			}
+		}
+	}
+	return ""
+}
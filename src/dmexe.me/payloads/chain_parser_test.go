@@ -0,0 +1,92 @@
+package payloads
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_ChainParser(t *testing.T) {
+	failing := &EchoParser{err: errors.New("unknown token")}
+	static := &EchoParser{Payload: Payload{ContainerID: "static"}}
+
+	t.Run("should use the first accepted parser", func(t *testing.T) {
+		parser, err := NewChainParser(ChainParserOptions{
+			Parsers: []NamedParser{
+				{Name: "jwt", Parser: newTestJwtParser(t)},
+				{Name: "static", Parser: static},
+			},
+		})
+		require.NoError(t, err)
+
+		payload, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"cid": "jwt", "exp": time.Now().Add(time.Minute).Unix()}))
+		require.NoError(t, err)
+		require.Equal(t, "jwt", payload.ContainerID)
+		require.Equal(t, "jwt", payload.Parser)
+
+		payload, err = parser.Parse("token")
+		require.NoError(t, err)
+		require.Equal(t, "static", payload.ContainerID)
+		require.Equal(t, "static", payload.Parser)
+	})
+
+	t.Run("should return bound key from parsers", func(t *testing.T) {
+		parser, err := NewChainParser(ChainParserOptions{
+			Parsers: []NamedParser{
+				{Name: "static", Parser: static},
+				{Name: "jwt", Parser: newTestJwtParser(t)},
+			},
+		})
+		require.NoError(t, err)
+
+		token := newTestJwtToken(t, jwt.MapClaims{"cnf": map[string]string{"ssh": "SHA256:key"}})
+		require.Equal(t, "SHA256:key", parser.BoundKey(token))
+		require.Equal(t, "", parser.BoundKey("token"))
+	})
+
+	t.Run("should consume token by the accepted parser", func(t *testing.T) {
+		single, err := NewJwtParser(JwtParserOptions{Secret: "secret", SingleUse: true})
+		require.NoError(t, err)
+
+		parser, err := NewChainParser(ChainParserOptions{
+			Parsers: []NamedParser{
+				{Name: "jwt", Parser: single},
+				{Name: "static", Parser: static},
+			},
+		})
+		require.NoError(t, err)
+
+		token := newTestJwtToken(t, jwt.MapClaims{"jti": "once", "exp": time.Now().Add(time.Minute).Unix()})
+		require.NoError(t, parser.Consume(Payload{Parser: "static"}))
+
+		payload, err := parser.Parse(token)
+		require.NoError(t, err)
+		require.Equal(t, "jwt", payload.Parser)
+
+		require.NoError(t, parser.Consume(payload))
+		require.EqualError(t, parser.Consume(payload), "Token 'once' is already used")
+	})
+
+	t.Run("fail when no parser accepted the token", func(t *testing.T) {
+		parser, err := NewChainParser(ChainParserOptions{
+			Parsers: []NamedParser{
+				{Name: "first", Parser: failing},
+				{Name: "second", Parser: failing},
+			},
+		})
+		require.NoError(t, err)
+
+		_, err = parser.Parse("token")
+		require.EqualError(t, err, "Token is not accepted by any parser (first: unknown token; second: unknown token)")
+	})
+
+	t.Run("fail without parsers", func(t *testing.T) {
+		_, err := NewChainParser(ChainParserOptions{})
+		require.EqualError(t, err, "Chain parser requires at least one parser")
+
+		_, err = NewChainParser(ChainParserOptions{Parsers: []NamedParser{{Parser: static}}})
+		require.EqualError(t, err, "Chain parser requires named parsers")
+	})
+}
@@ -0,0 +1,292 @@
+package payloads
+
+import (
+	"crypto/sha256"
+	"dmexe.me/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default introspection parameters
+const (
+	DefaultIntrospectionCacheTTL         = time.Minute
+	DefaultIntrospectionNegativeCacheTTL = 10 * time.Second
+	DefaultIntrospectionCacheSize        = 10000
+	DefaultIntrospectionTimeout          = 10 * time.Second
+)
+
+// introspectionLeeway is a clock skew tolerance, the server decides whether
+// the token is active, local checks only guard against stale responses
+const introspectionLeeway = 30 * time.Second
+
+// IntrospectionParserOptions keeps parameters for introspection parser instance
+type IntrospectionParserOptions struct {
+	// URL is the RFC 7662 introspection endpoint
+	URL string
+
+	// ClientID and ClientSecret authenticate the proxy with HTTP basic auth,
+	// requests are not authenticated when the client id is empty
+	ClientID     string
+	ClientSecret string
+
+	// Issuer is a required value of iss member
+	Issuer string
+
+	// Audience must be contained in aud member
+	Audience string
+
+	// CacheTTL limits caching of active tokens, the entry never outlives exp member
+	CacheTTL time.Duration
+
+	// NegativeCacheTTL limits caching of rejected tokens, server failures are not cached
+	NegativeCacheTTL time.Duration
+
+	// CacheSize limits the number of cached tokens, rejected tokens are not cached
+	// when the cache is full, active ones replace the entry expiring first
+	CacheSize int
+
+	Timeout time.Duration
+}
+
+// IntrospectionParser is a parser implementation for opaque access tokens validated
+// by the introspection endpoint, response members are mapped like JWT claims
+// (cid, usr, pol, sub, groups, etc.), results are cached by token digests
+type IntrospectionParser struct {
+	sync.Mutex
+	url              string
+	clientID         string
+	clientSecret     string
+	claims           claimsPolicy
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	cacheSize        int
+	cache            map[string]introspectionEntry
+	inflight         map[string]*introspectionCall
+	client           *http.Client
+	log              *logrus.Entry
+}
+
+type introspectionEntry struct {
+	payload   Payload
+	err       error
+	expiresAt time.Time
+}
+
+// introspectionCall is a pending request, concurrent parses of the same token wait for it
+type introspectionCall struct {
+	entry introspectionEntry
+	done  chan struct{}
+}
+
+// NewIntrospectionParser constructs a new parser instance using given options
+func NewIntrospectionParser(opts IntrospectionParserOptions) (*IntrospectionParser, error) {
+	if !strings.HasPrefix(opts.URL, "http://") && !strings.HasPrefix(opts.URL, "https://") {
+		return nil, fmt.Errorf("Introspection url must be http(s) url, got '%s'", opts.URL)
+	}
+
+	if opts.ClientID == "" && opts.ClientSecret != "" {
+		return nil, errors.New("Introspection client secret requires client id")
+	}
+
+	cacheTTL := opts.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = DefaultIntrospectionCacheTTL
+	}
+
+	negativeCacheTTL := opts.NegativeCacheTTL
+	if negativeCacheTTL == 0 {
+		negativeCacheTTL = DefaultIntrospectionNegativeCacheTTL
+	}
+
+	if opts.CacheSize < 0 {
+		return nil, fmt.Errorf("Introspection cache size cannot be negative, got %d", opts.CacheSize)
+	}
+
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultIntrospectionCacheSize
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultIntrospectionTimeout
+	}
+
+	parser := &IntrospectionParser{
+		url:          opts.URL,
+		clientID:     opts.ClientID,
+		clientSecret: opts.ClientSecret,
+		claims: claimsPolicy{
+			issuer:          opts.Issuer,
+			audience:        opts.Audience,
+			leeway:          introspectionLeeway,
+			allowMissingExp: true,
+		},
+		cacheTTL:         cacheTTL,
+		negativeCacheTTL: negativeCacheTTL,
+		cacheSize:        cacheSize,
+		cache:            make(map[string]introspectionEntry),
+		inflight:         make(map[string]*introspectionCall),
+		client:           &http.Client{Timeout: timeout},
+		log:              utils.NewLogEntry("payloads.introspection").WithField("url", opts.URL),
+	}
+	return parser, nil
+}
+
+// Parse returns the cached result or introspects the token, concurrent parses
+// of the same token share a single request
+func (p *IntrospectionParser) Parse(token string) (Payload, error) {
+	digest := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(digest[:])
+	now := time.Now()
+
+	p.Lock()
+	entry, ok := p.cache[key]
+	if ok && now.Before(entry.expiresAt) {
+		p.Unlock()
+		return entry.payload, entry.err
+	}
+
+	call, pending := p.inflight[key]
+	if !pending {
+		call = &introspectionCall{done: make(chan struct{})}
+		p.inflight[key] = call
+	}
+	p.Unlock()
+
+	if pending {
+		<-call.done
+	} else {
+		p.resolve(token, key, call, now)
+	}
+
+	return call.entry.payload, call.entry.err
+}
+
+// resolve introspects the token and releases callers waiting for the call
+func (p *IntrospectionParser) resolve(token string, key string, call *introspectionCall, now time.Time) {
+	defer close(call.done)
+
+	claims, err := p.introspect(token)
+
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.inflight, key)
+
+	if err != nil {
+		p.log.Warnf("Could not introspect token (%s)", err)
+		call.entry = introspectionEntry{err: fmt.Errorf("Could not introspect token (%s)", err)}
+		return
+	}
+
+	call.entry = p.verify(claims, now)
+	p.store(key, call.entry, now)
+}
+
+// store caches the entry, expired entries are forgotten first, the lock must be held
+func (p *IntrospectionParser) store(key string, entry introspectionEntry, now time.Time) {
+	for it, cached := range p.cache {
+		if !now.Before(cached.expiresAt) {
+			delete(p.cache, it)
+		}
+	}
+
+	if _, ok := p.cache[key]; !ok && len(p.cache) >= p.cacheSize {
+		if entry.err != nil {
+			return
+		}
+
+		oldest := ""
+		for it, cached := range p.cache {
+			if oldest == "" || cached.expiresAt.Before(p.cache[oldest].expiresAt) {
+				oldest = it
+			}
+		}
+		delete(p.cache, oldest)
+	}
+
+	p.cache[key] = entry
+}
+
+// BoundKey returns the key fingerprint from cnf member, the token is introspected
+// since opaque tokens have no readable claims
+func (p *IntrospectionParser) BoundKey(token string) string {
+	payload, err := p.Parse(token)
+	if err != nil {
+		return ""
+	}
+	return payload.KeyFingerprint
+}
+
+// verify maps the response to the cache entry, rejected tokens are cached for the negative ttl
+func (p *IntrospectionParser) verify(claims jwtClaims, now time.Time) introspectionEntry {
+	rejected := introspectionEntry{expiresAt: now.Add(p.negativeCacheTTL)}
+
+	if active, _ := claims["active"].(bool); !active {
+		rejected.err = errors.New("Token is not active")
+		return rejected
+	}
+
+	if err := p.claims.validate(claims, now); err != nil {
+		rejected.err = err
+		return rejected
+	}
+
+	payload, err := claims.payload()
+	if err != nil {
+		rejected.err = err
+		return rejected
+	}
+
+	expiresAt := now.Add(p.cacheTTL)
+	if exp, ok, _ := claims.time("exp"); ok && exp.Before(expiresAt) {
+		expiresAt = exp
+	}
+
+	return introspectionEntry{payload: payload, expiresAt: expiresAt}
+}
+
+func (p *IntrospectionParser) introspect(token string) (jwtClaims, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequest(http.MethodPost, p.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if p.clientID != "" {
+		// RFC 6749 requires form encoding of client credentials
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response code, expected=200, actual=%d", resp.StatusCode)
+	}
+
+	claims := jwtClaims{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
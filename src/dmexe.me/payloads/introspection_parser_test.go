@@ -0,0 +1,194 @@
+package payloads
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestIntrospectionServer responds with claims of known tokens and counts requests
+func newTestIntrospectionServer(t *testing.T, tokens map[string]map[string]interface{}, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		if id, secret, ok := r.BasicAuth(); !ok || id != "proxy" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "access_token", r.PostFormValue("token_type_hint"))
+
+		claims, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			claims = map[string]interface{}{"active": false}
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(claims))
+	}))
+}
+
+func Test_IntrospectionParser(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	tokens := map[string]map[string]interface{}{
+		"valid": {
+			"active": true,
+			"exp":    exp,
+			"iss":    "sso",
+			"aud":    []string{"proxy"},
+			"cid":    "web",
+			"usr":    "app",
+			"sub":    "alice",
+			"groups": []string{"ops"},
+			"pol":    map[string]interface{}{"modes": []string{"exec"}},
+		},
+		"other-issuer": {"active": true, "iss": "other", "aud": "proxy"},
+		"invalid-pol":  {"active": true, "iss": "sso", "aud": "proxy", "pol": "exec"},
+	}
+
+	var requests int32
+	server := newTestIntrospectionServer(t, tokens, &requests)
+	defer server.Close()
+
+	newParser := func(clientSecret string) *IntrospectionParser {
+		parser, err := NewIntrospectionParser(IntrospectionParserOptions{
+			URL:          server.URL,
+			ClientID:     "proxy",
+			ClientSecret: clientSecret,
+			Issuer:       "sso",
+			Audience:     "proxy",
+		})
+		require.NoError(t, err)
+		return parser
+	}
+
+	t.Run("should map active token claims to payload", func(t *testing.T) {
+		parser := newParser("s3cret")
+
+		payload, err := parser.Parse("valid")
+		require.NoError(t, err)
+
+		expected := Payload{
+			ContainerID: "web",
+			User:        "app",
+			Policy:      Policy{Modes: []string{ModeExec}},
+			Identity:    Identity{Subject: "alice", Groups: []string{"ops"}},
+		}
+		require.Equal(t, expected, payload)
+	})
+
+	t.Run("should cache responses", func(t *testing.T) {
+		parser := newParser("s3cret")
+		atomic.StoreInt32(&requests, 0)
+
+		for i := 0; i < 3; i++ {
+			_, err := parser.Parse("valid")
+			require.NoError(t, err)
+
+			_, err = parser.Parse("unknown")
+			require.EqualError(t, err, "Token is not active")
+		}
+		require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("should expire cached responses", func(t *testing.T) {
+		parser := newParser("s3cret")
+		parser.negativeCacheTTL = time.Millisecond
+		atomic.StoreInt32(&requests, 0)
+
+		_, err := parser.Parse("unknown")
+		require.Error(t, err)
+
+		time.Sleep(5 * time.Millisecond)
+
+		_, err = parser.Parse("unknown")
+		require.Error(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+		require.Len(t, parser.cache, 1, "expired entries are forgotten")
+	})
+
+	t.Run("should limit cache size", func(t *testing.T) {
+		parser := newParser("s3cret")
+		parser.cacheSize = 2
+		atomic.StoreInt32(&requests, 0)
+
+		for _, token := range []string{"unknown-1", "unknown-2", "unknown-3"} {
+			_, err := parser.Parse(token)
+			require.EqualError(t, err, "Token is not active")
+		}
+		require.Len(t, parser.cache, 2, "rejected tokens are not cached when full")
+
+		_, err := parser.Parse("unknown-3")
+		require.Error(t, err)
+		require.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+		_, err = parser.Parse("valid")
+		require.NoError(t, err)
+		require.Len(t, parser.cache, 2, "active tokens replace the entry expiring first")
+
+		_, err = parser.Parse("valid")
+		require.NoError(t, err)
+		require.Equal(t, int32(5), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("should share request of concurrent parses", func(t *testing.T) {
+		var slowRequests int32
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&slowRequests, 1)
+			time.Sleep(50 * time.Millisecond)
+			require.NoError(t, json.NewEncoder(w).Encode(tokens["valid"]))
+		}))
+		defer slow.Close()
+
+		parser, err := NewIntrospectionParser(IntrospectionParserOptions{URL: slow.URL, Issuer: "sso", Audience: "proxy"})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				payload, err := parser.Parse("valid")
+				require.NoError(t, err)
+				require.Equal(t, "web", payload.ContainerID)
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, int32(1), atomic.LoadInt32(&slowRequests))
+		require.Empty(t, parser.inflight)
+	})
+
+	t.Run("fail on rejected claims", func(t *testing.T) {
+		parser := newParser("s3cret")
+
+		_, err := parser.Parse("other-issuer")
+		require.EqualError(t, err, "Unexpected token issuer 'other'")
+
+		_, err = parser.Parse("invalid-pol")
+		require.EqualError(t, err, "Claim pol must be an object")
+	})
+
+	t.Run("should not cache server failures", func(t *testing.T) {
+		parser := newParser("wrong")
+		atomic.StoreInt32(&requests, 0)
+
+		for i := 0; i < 2; i++ {
+			_, err := parser.Parse("valid")
+			require.EqualError(t, err, "Could not introspect token (Unexpected response code, expected=200, actual=401)")
+		}
+		require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("fail on invalid options", func(t *testing.T) {
+		_, err := NewIntrospectionParser(IntrospectionParserOptions{URL: "sso.example.com/introspect"})
+		require.EqualError(t, err, "Introspection url must be http(s) url, got 'sso.example.com/introspect'")
+
+		_, err = NewIntrospectionParser(IntrospectionParserOptions{URL: server.URL, ClientSecret: "s3cret"})
+		require.EqualError(t, err, "Introspection client secret requires client id")
+	})
+}
@@ -0,0 +1,349 @@
+package payloads
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"dmexe.me/utils"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeySetInterval is a period of key set refreshes
+const DefaultKeySetInterval = 10 * time.Minute
+
+// keySetMaxSize limits JWKS documents fetched from urls
+const keySetMaxSize = 1024 * 1024
+
+// ecCurves maps curves of EC keys to their algorithms
+var ecCurves = map[string]struct {
+	curve elliptic.Curve
+	alg   string
+}{
+	"P-256": {elliptic.P256(), "ES256"},
+	"P-384": {elliptic.P384(), "ES384"},
+	"P-521": {elliptic.P521(), "ES512"},
+}
+
+// KeySetOptions keeps parameters for key set instance
+type KeySetOptions struct {
+	// Source is a file or http(s) url of the JWKS document
+	Source string
+
+	Interval time.Duration
+}
+
+// KeySet keeps public keys from the JWKS document by their key ids,
+// the document is reloaded periodically and previous keys are kept when reload fails
+type KeySet struct {
+	sync.RWMutex
+	source   string
+	interval time.Duration
+	keys     map[string]jwtKey
+	client   *http.Client
+	log      *logrus.Entry
+	ctx      context.Context
+}
+
+// jwtKey is a verification key pinned to the single algorithm
+type jwtKey struct {
+	alg string
+	key interface{}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// NewKeySet creates a new key set and loads the document, fails when it cannot be loaded
+func NewKeySet(ctx context.Context, opts KeySetOptions) (*KeySet, error) {
+	if opts.Source == "" {
+		return nil, errors.New("Key set source cannot be empty")
+	}
+
+	interval := opts.Interval
+	if interval == 0 {
+		interval = DefaultKeySetInterval
+	}
+
+	keySet := &KeySet{
+		source:   opts.Source,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		log:      utils.NewLogEntry("payloads.jwks").WithField("source", opts.Source),
+		ctx:      ctx,
+	}
+
+	if err := keySet.reload(); err != nil {
+		return nil, err
+	}
+
+	return keySet, nil
+}
+
+// Run refreshes the key set until the context done
+func (k *KeySet) Run(wg *sync.WaitGroup) error {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-k.ctx.Done():
+				k.log.Debug("Context done")
+				return
+			case <-time.After(k.interval):
+				if err := k.reload(); err != nil {
+					k.log.Errorf("Could not refresh key set, previous keys are kept (%s)", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (k *KeySet) reload() error {
+	data, err := k.fetch()
+	if err != nil {
+		return fmt.Errorf("Could not load key set (%s)", err)
+	}
+
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return fmt.Errorf("Could not parse key set (%s)", err)
+	}
+
+	k.Lock()
+	k.keys = keys
+	k.Unlock()
+
+	k.log.Debugf("Key set loaded (%d keys)", len(keys))
+
+	return nil
+}
+
+func (k *KeySet) fetch() ([]byte, error) {
+	if !strings.HasPrefix(k.source, "http://") && !strings.HasPrefix(k.source, "https://") {
+		return ioutil.ReadFile(k.source)
+	}
+
+	resp, err := k.client.Get(k.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response code, expected=200, actual=%d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, keySetMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > keySetMaxSize {
+		return nil, fmt.Errorf("Key set is larger than %d bytes", keySetMaxSize)
+	}
+
+	return data, nil
+}
+
+// lookup returns the key by id, the key id may be omitted when the set has the single key
+func (k *KeySet) lookup(kid string) (jwtKey, bool) {
+	k.RLock()
+	defer k.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// parseKeySet returns signature keys by their ids, keys of unsupported types are skipped
+func parseKeySet(data []byte) (map[string]jwtKey, error) {
+	set := jsonWebKeySet{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]jwtKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key '%s' (%s)", jwk.Kid, err)
+		}
+
+		if key.key == nil {
+			continue
+		}
+
+		if _, ok := keys[jwk.Kid]; ok {
+			return nil, fmt.Errorf("Key id '%s' is used more than once", jwk.Kid)
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No signature keys found")
+	}
+
+	return keys, nil
+}
+
+// parseJSONWebKey converts the key, the algorithm is taken from the key or derived from its type
+func parseJSONWebKey(jwk jsonWebKey) (jwtKey, error) {
+	var (
+		key  interface{}
+		algs []string
+		err  error
+	)
+
+	switch jwk.Kty {
+	case "RSA":
+		key, err = parseRSAKey(jwk)
+		algs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+
+	case "EC":
+		if _, ok := ecCurves[jwk.Crv]; !ok {
+			return jwtKey{}, nil
+		}
+		var alg string
+		key, alg, err = parseECKey(jwk)
+		algs = []string{alg}
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return jwtKey{}, nil
+		}
+		key, err = parseEd25519Key(jwk)
+		algs = []string{SigningMethodEdDSA.Alg()}
+
+	default:
+		return jwtKey{}, nil
+	}
+
+	if err != nil {
+		return jwtKey{}, err
+	}
+
+	alg := jwk.Alg
+	if alg == "" {
+		alg = algs[0]
+	}
+
+	for _, it := range algs {
+		if it == alg {
+			return jwtKey{alg: alg, key: key}, nil
+		}
+	}
+
+	return jwtKey{}, fmt.Errorf("Algorithm %s cannot be used with %s key", alg, jwk.Kty)
+}
+
+func parseRSAKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decodeBigInt(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA key is too short (%d bits)", n.BitLen())
+	}
+
+	if e.BitLen() > 31 || e.Int64() < 3 {
+		return nil, errors.New("Invalid RSA exponent")
+	}
+
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseECKey(jwk jsonWebKey) (*ecdsa.PublicKey, string, error) {
+	params, ok := ecCurves[jwk.Crv]
+	if !ok {
+		return nil, "", fmt.Errorf("Unsupported curve '%s'", jwk.Crv)
+	}
+	curve, alg := params.curve, params.alg
+
+	x, err := decodeBigInt(jwk.X)
+	if err != nil {
+		return nil, "", err
+	}
+
+	y, err := decodeBigInt(jwk.Y)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !curve.IsOnCurve(x, y) {
+		return nil, "", errors.New("Point is not on curve")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, alg, nil
+}
+
+func parseEd25519Key(jwk jsonWebKey) (ed25519.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid Ed25519 key size %d", len(x))
+	}
+
+	return ed25519.PublicKey(x), nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, errors.New("Missing key parameter")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,214 @@
+package payloads
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKeys keeps private keys of the test key set
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return testKeys{rsa: rsaKey, ecdsa: ecdsaKey, ed25519: ed25519Key}
+}
+
+func encodeTestBigInt(value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
+
+// jwks returns the document with rsa-1, ec-1 and ed-1 keys, keys of unknown curves are skipped
+func (k testKeys) jwks(t *testing.T) []byte {
+	set := jsonWebKeySet{
+		Keys: []jsonWebKey{
+			{
+				Kty: "RSA",
+				Kid: "rsa-1",
+				Use: "sig",
+				N:   encodeTestBigInt(k.rsa.N),
+				E:   encodeTestBigInt(big.NewInt(int64(k.rsa.E))),
+			},
+			{
+				Kty: "EC",
+				Kid: "ec-1",
+				Crv: "P-256",
+				X:   encodeTestBigInt(k.ecdsa.X),
+				Y:   encodeTestBigInt(k.ecdsa.Y),
+			},
+			{
+				Kty: "OKP",
+				Kid: "ed-1",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(k.ed25519.Public().(ed25519.PublicKey)),
+			},
+			{
+				Kty: "RSA",
+				Kid: "enc-1",
+				Use: "enc",
+			},
+			{
+				Kty: "EC",
+				Kid: "k1-1",
+				Crv: "secp256k1",
+			},
+			{
+				Kty: "OKP",
+				Kid: "x-1",
+				Crv: "X25519",
+			},
+		},
+	}
+
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	return data
+}
+
+func newTestKeySetFile(t *testing.T, data []byte) string {
+	file, err := ioutil.TempFile("", "jwks")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.Write(data)
+	require.NoError(t, err)
+
+	return file.Name()
+}
+
+func Test_KeySet(t *testing.T) {
+	keys := newTestKeys(t)
+
+	t.Run("should parse key set", func(t *testing.T) {
+		parsed, err := parseKeySet(keys.jwks(t))
+		require.NoError(t, err)
+		require.Len(t, parsed, 3)
+
+		require.Equal(t, "RS256", parsed["rsa-1"].alg)
+		require.Equal(t, &keys.rsa.PublicKey, parsed["rsa-1"].key)
+
+		require.Equal(t, "ES256", parsed["ec-1"].alg)
+		require.Equal(t, &keys.ecdsa.PublicKey, parsed["ec-1"].key)
+
+		require.Equal(t, "EdDSA", parsed["ed-1"].alg)
+		require.Equal(t, keys.ed25519.Public(), parsed["ed-1"].key)
+	})
+
+	t.Run("should load key set from file", func(t *testing.T) {
+		filename := newTestKeySetFile(t, keys.jwks(t))
+		defer os.Remove(filename)
+
+		keySet, err := NewKeySet(context.Background(), KeySetOptions{Source: filename})
+		require.NoError(t, err)
+
+		_, ok := keySet.lookup("ec-1")
+		require.True(t, ok)
+
+		_, ok = keySet.lookup("")
+		require.False(t, ok)
+	})
+
+	t.Run("should refresh key set from url", func(t *testing.T) {
+		var (
+			mu       sync.Mutex
+			document = []byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"old","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`)
+		)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Write(document)
+		}))
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		keySet, err := NewKeySet(ctx, KeySetOptions{Source: server.URL, Interval: 10 * time.Millisecond})
+		require.NoError(t, err)
+		require.NoError(t, keySet.Run(&wg))
+
+		_, ok := keySet.lookup("")
+		require.True(t, ok, "the single key is used without kid")
+
+		mu.Lock()
+		document = keys.jwks(t)
+		mu.Unlock()
+
+		for i := 0; i < 100; i++ {
+			if _, ok = keySet.lookup("rsa-1"); ok {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.True(t, ok, "key set is refreshed")
+
+		mu.Lock()
+		document = []byte("broken")
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		_, ok = keySet.lookup("rsa-1")
+		require.True(t, ok, "previous keys are kept")
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on too large key set", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, keySetMaxSize+1))
+		}))
+		defer server.Close()
+
+		_, err := NewKeySet(context.Background(), KeySetOptions{Source: server.URL})
+		require.EqualError(t, err, fmt.Sprintf("Could not load key set (Key set is larger than %d bytes)", keySetMaxSize))
+	})
+
+	t.Run("fail on algorithm not matching key type", func(t *testing.T) {
+		_, err := parseKeySet([]byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"ed","alg":"RS256","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`))
+		require.EqualError(t, err, "Invalid key 'ed' (Algorithm RS256 cannot be used with OKP key)")
+	})
+
+	t.Run("fail on short rsa key", func(t *testing.T) {
+		short, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.NoError(t, err)
+
+		_, err = parseJSONWebKey(jsonWebKey{Kty: "RSA", N: encodeTestBigInt(short.N), E: "AQAB"})
+		require.EqualError(t, err, "RSA key is too short (1024 bits)")
+	})
+
+	t.Run("fail on empty key set", func(t *testing.T) {
+		_, err := parseKeySet([]byte(`{"keys":[]}`))
+		require.EqualError(t, err, "No signature keys found")
+	})
+}
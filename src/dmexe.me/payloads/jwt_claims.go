@@ -0,0 +1,321 @@
+package payloads
+
+import (
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// jwtClaims skips the jwt-go time checks, it has no clock skew tolerance,
+// registered claims are validated by the parser instead
+type jwtClaims map[string]interface{}
+
+// Valid is called by jwt-go, validation is done in validateClaims
+func (c *jwtClaims) Valid() error {
+	return nil
+}
+
+// claimsPolicy keeps required values of registered claims
+type claimsPolicy struct {
+	issuer          string
+	audience        string
+	maxLifetime     time.Duration
+	leeway          time.Duration
+	allowMissingExp bool
+}
+
+func (p claimsPolicy) validate(claims jwtClaims, now time.Time) error {
+	exp, hasExp, err := claims.time("exp")
+	if err != nil {
+		return err
+	}
+
+	nbf, hasNbf, err := claims.time("nbf")
+	if err != nil {
+		return err
+	}
+
+	iat, hasIat, err := claims.time("iat")
+	if err != nil {
+		return err
+	}
+
+	if !hasExp && !p.allowMissingExp {
+		return errors.New("Token must contain exp claim")
+	}
+
+	if hasExp && now.After(exp.Add(p.leeway)) {
+		return fmt.Errorf("Token is expired by %s", now.Sub(exp))
+	}
+
+	if hasNbf && now.Add(p.leeway).Before(nbf) {
+		return errors.New("Token is not valid yet")
+	}
+
+	if hasIat && now.Add(p.leeway).Before(iat) {
+		return errors.New("Token is issued in the future")
+	}
+
+	if p.maxLifetime > 0 {
+		if !hasExp {
+			return errors.New("Token must contain exp claim")
+		}
+
+		issued := now
+		if hasIat {
+			issued = iat
+		}
+
+		if exp.Sub(issued) > p.maxLifetime+p.leeway {
+			return fmt.Errorf("Token lifetime exceeds %s", p.maxLifetime)
+		}
+	}
+
+	if p.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != p.issuer {
+			return fmt.Errorf("Unexpected token issuer '%s'", iss)
+		}
+	}
+
+	if p.audience != "" && !claims.hasAudience(p.audience) {
+		return errors.New("Token is not issued for this audience")
+	}
+
+	return nil
+}
+
+// time returns NumericDate claim, fails when it's not a number
+func (c jwtClaims) time(name string) (time.Time, bool, error) {
+	value, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("Claim %s must be a number", name)
+	}
+
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// hasAudience checks aud claim, it's a string or an array of strings
+func (c jwtClaims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, it := range aud {
+			if it == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyFingerprint returns the ssh member of cnf claim (eg. {"ssh": "SHA256:..."}),
+// tokens confirmed by other methods are rejected since they cannot be verified
+func (c jwtClaims) keyFingerprint() (string, error) {
+	value, ok := c["cnf"]
+	if !ok {
+		return "", nil
+	}
+
+	cnf, ok := value.(map[string]interface{})
+	if !ok {
+		return "", errors.New("Claim cnf must be an object")
+	}
+
+	fingerprint, ok := cnf["ssh"].(string)
+	if !ok || len(cnf) != 1 {
+		return "", errors.New("Claim cnf must contain only ssh key fingerprint")
+	}
+
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return "", fmt.Errorf("Unsupported key fingerprint '%s'", fingerprint)
+	}
+
+	return fingerprint, nil
+}
+
+// networks returns CIDR blocks, the claim is a comma separated string or an array of strings
+func (c jwtClaims) networks(name string) ([]string, error) {
+	var networks []string
+
+	switch value := c[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		networks = strings.Split(value, ",")
+	case []interface{}:
+		var err error
+		if networks, err = stringsClaim(name, value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Claim %s must be a string or an array", name)
+	}
+
+	for i := range networks {
+		networks[i] = strings.TrimSpace(networks[i])
+	}
+
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("Claim %s cannot be empty", name)
+	}
+
+	if _, err := utils.ParseNetworks(networks); err != nil {
+		return nil, err
+	}
+
+	return networks, nil
+}
+
+// policy returns pol claim (eg. {"modes": ["exec"], "cmds": ["uptime"], "usr": "app", "ttl": 3600, "ro": true}),
+// unknown members are rejected since they may be restrictions which cannot be enforced
+func (c jwtClaims) policy() (Policy, error) {
+	policy := Policy{}
+
+	value, ok := c["pol"]
+	if !ok {
+		return policy, nil
+	}
+
+	pol, ok := value.(map[string]interface{})
+	if !ok {
+		return policy, errors.New("Claim pol must be an object")
+	}
+
+	var err error
+	for name, member := range pol {
+		switch name {
+		case "modes":
+			if policy.Modes, err = stringsClaim("pol.modes", member); err != nil {
+				return policy, err
+			}
+			for _, mode := range policy.Modes {
+				if !containsMode(mode) {
+					return policy, fmt.Errorf("Unknown session mode '%s', expected one of [%s]", mode, strings.Join(Modes, "] ["))
+				}
+			}
+
+		case "cmds":
+			if policy.Commands, err = stringsClaim("pol.cmds", member); err != nil {
+				return policy, err
+			}
+
+		case "usr":
+			if policy.User, ok = member.(string); !ok {
+				return policy, errors.New("Claim pol.usr must be a string")
+			}
+
+		case "ttl":
+			seconds, ok := member.(float64)
+			if !ok || seconds <= 0 {
+				return policy, errors.New("Claim pol.ttl must be a positive number")
+			}
+			policy.MaxDuration = time.Duration(seconds) * time.Second
+
+		case "ro":
+			if policy.ReadOnly, ok = member.(bool); !ok {
+				return policy, errors.New("Claim pol.ro must be a boolean")
+			}
+
+		default:
+			return policy, fmt.Errorf("Unknown policy member '%s'", name)
+		}
+	}
+
+	return policy, nil
+}
+
+// identity returns sub, name and groups claims
+func (c jwtClaims) identity() (Identity, error) {
+	identity := Identity{}
+	identity.Subject, _ = c["sub"].(string)
+	identity.Name, _ = c["name"].(string)
+
+	if groups, ok := c["groups"]; ok {
+		var err error
+		if identity.Groups, err = stringsClaim("groups", groups); err != nil {
+			return identity, err
+		}
+	}
+
+	return identity, nil
+}
+
+// payload maps claims to the payload, values of unexpected types are ignored
+func (c jwtClaims) payload() (Payload, error) {
+	payload := Payload{}
+
+	fingerprint, err := c.keyFingerprint()
+	if err != nil {
+		return payload, err
+	}
+
+	networks, err := c.networks(jwtSourceNetworks)
+	if err != nil {
+		return payload, err
+	}
+
+	policy, err := c.policy()
+	if err != nil {
+		return payload, err
+	}
+
+	identity, err := c.identity()
+	if err != nil {
+		return payload, err
+	}
+
+	payload.KeyFingerprint = fingerprint
+	payload.SourceNetworks = networks
+	payload.Policy = policy
+	payload.Identity = identity
+
+	payload.ContainerID, _ = c[jwtContainerID].(string)
+	payload.ContainerEnv, _ = c[jwtContainerEnv].(string)
+	payload.ContainerLabel, _ = c[jwtContainerLabel].(string)
+	payload.User, _ = c[jwtUser].(string)
+	payload.WorkingDir, _ = c[jwtWorkingDir].(string)
+	payload.Privileged, _ = c[jwtPrivileged].(bool)
+	payload.Namespace, _ = c[jwtNamespace].(string)
+	payload.PodSelector, _ = c[jwtPodSelector].(string)
+	payload.ContainerName, _ = c[jwtContainerName].(string)
+	payload.Daemon, _ = c[jwtDaemon].(string)
+	payload.Host, _ = c[jwtHost].(string)
+
+	return payload, nil
+}
+
+// stringsClaim converts an array of strings
+func stringsClaim(name string, value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Claim %s must be an array", name)
+	}
+
+	result := make([]string, 0, len(items))
+	for _, it := range items {
+		item, ok := it.(string)
+		if !ok {
+			return nil, fmt.Errorf("Claim %s must contain only strings", name)
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+func containsMode(mode string) bool {
+	for _, it := range Modes {
+		if it == mode {
+			return true
+		}
+	}
+	return false
+}
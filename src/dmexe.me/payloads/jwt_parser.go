@@ -1,8 +1,13 @@
 package payloads
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	jwt "github.com/dgrijalva/jwt-go"
 	"os"
+	"strings"
+	"time"
 )
 
 // JwtParser is a parser implementation for JWT tokens,
@@ -10,63 +15,257 @@ import (
 // * cid - container id identifier
 // * env - container environment variable (eg. FOO=bar)
 // * lab - container label
+// * usr - user inside container (eg. nobody, 1000:1000)
+// * dir - working directory inside container
+// * prv - privileged session
+// * ns  - kubernetes namespace
+// * sel - kubernetes pod label selector (eg. app=web,tier=frontend)
+// * cnt - container name inside kubernetes pod
+// * dmn - docker daemon name
+// * hst - upstream ssh host (eg. 10.0.0.1, vm-1.example.com:2222)
+// * cnf - client ssh key binding (eg. {"ssh": "SHA256:..."}, ssh-keygen -l fingerprint)
+// * src - allowed client networks (eg. 10.8.0.0/16,192.168.1.10 or an array)
+// * pol - session policy (eg. {"modes": ["exec"], "cmds": ["uptime"], "usr": "app", "ttl": 3600, "ro": true})
+// * sub, name, groups - human identity of the token holder
+//
+// HMAC tokens are verified by the keyring key selected by kid or by the shared secret
+// when the token has no kid, asymmetric tokens (RS256, ES256, EdDSA) by the key set key
+// selected by kid, the token algorithm must match the key algorithm.
+// Tokens must contain exp claim unless it's explicitly allowed, tokens with revoked jti
+// claim are rejected, single-use tokens are rejected after the first use
 type JwtParser struct {
-	secret string
+	secret      string
+	keyring     *Keyring
+	keys        *KeySet
+	claims      claimsPolicy
+	revocations *Revocations
+	consumed    *consumedTokens
+}
+
+// JwtParserOptions keeps parameters for parser instance
+type JwtParserOptions struct {
+	// Secret verifies HMAC tokens, they are rejected when it's empty
+	Secret string
+
+	// Keyring verifies HMAC tokens by their kid, tokens without kid are verified
+	// by the secret or by the single keyring key
+	Keyring *Keyring
+
+	// KeySet verifies asymmetric tokens, they are rejected when it's nil
+	KeySet *KeySet
+
+	// Issuer is a required value of iss claim
+	Issuer string
+
+	// Audience must be contained in aud claim
+	Audience string
+
+	// MaxLifetime limits exp claim from iat claim or the current time
+	MaxLifetime time.Duration
+
+	// Leeway is a clock skew tolerance used for exp, nbf and iat claims
+	Leeway time.Duration
+
+	// AllowMissingExp accepts tokens without exp claim, they never expire
+	AllowMissingExp bool
+
+	// Revocations rejects tokens by jti claim
+	Revocations *Revocations
+
+	// SingleUse requires jti and exp claims, the token id is remembered until
+	// the token is expired and the token is rejected when it's used again.
+	// Used ids are kept in memory of the proxy instance, so the token is accepted
+	// once by each instance and again after a restart
+	SingleUse bool
 }
 
 const (
 	jwtContainerID    = "cid"
 	jwtContainerEnv   = "env"
 	jwtContainerLabel = "lab"
+	jwtUser           = "usr"
+	jwtWorkingDir     = "dir"
+	jwtPrivileged     = "prv"
+	jwtNamespace      = "ns"
+	jwtPodSelector    = "sel"
+	jwtContainerName  = "cnt"
+	jwtDaemon         = "dmn"
+	jwtHost           = "hst"
+	jwtSourceNetworks = "src"
 )
 
-// NewJwtParser constructs a new parser instance using given JWT secret
-func NewJwtParser(secret string) (*JwtParser, error) {
+// NewJwtParser constructs a new parser instance using given options
+func NewJwtParser(opts JwtParserOptions) (*JwtParser, error) {
+	if opts.Secret == "" && opts.Keyring == nil && opts.KeySet == nil {
+		return nil, errors.New("Neither JWT secret, keyring nor key set specified")
+	}
+
 	config := &JwtParser{
-		secret: secret,
+		secret:  opts.Secret,
+		keyring: opts.Keyring,
+		keys:    opts.KeySet,
+		claims: claimsPolicy{
+			issuer:          opts.Issuer,
+			audience:        opts.Audience,
+			maxLifetime:     opts.MaxLifetime,
+			leeway:          opts.Leeway,
+			allowMissingExp: opts.AllowMissingExp,
+		},
+		revocations: opts.Revocations,
 	}
+
+	if opts.SingleUse {
+		config.consumed = newConsumedTokens()
+	}
+
 	return config, nil
 }
 
 // NewJwtParserFromEnv construct a new parser instance using JWT_SECRET
-// environment variable
-func NewJwtParserFromEnv() (*JwtParser, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "none"
+// environment variable when options don't specify a secret
+func NewJwtParserFromEnv(opts JwtParserOptions) (*JwtParser, error) {
+	if opts.Secret == "" {
+		opts.Secret = os.Getenv("JWT_SECRET")
+	}
+
+	return NewJwtParser(opts)
+}
+
+// keyFunc returns the verification key for the token algorithm
+func (p *JwtParser) keyFunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return p.hmacKey(alg, kid)
+	}
+
+	if p.keys == nil {
+		return nil, fmt.Errorf("Signing method %s is not allowed", alg)
+	}
+
+	key, ok := p.keys.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("Unknown key id '%s'", kid)
+	}
+
+	if key.alg != alg {
+		return nil, fmt.Errorf("Signing method %s doesn't match key '%s' algorithm %s", alg, kid, key.alg)
+	}
+
+	return key.key, nil
+}
+
+// hmacKey selects the secret, tokens issued before the keyring was enabled have no kid
+// and keep being verified by the shared secret
+func (p *JwtParser) hmacKey(alg, kid string) (interface{}, error) {
+	if p.keyring != nil && (kid != "" || p.secret == "") {
+		secret, ok := p.keyring.lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("Unknown key id '%s'", kid)
+		}
+		return secret, nil
+	}
+
+	if p.secret == "" {
+		return nil, fmt.Errorf("Signing method %s is not allowed", alg)
 	}
 
-	return NewJwtParser(secret)
+	return []byte(p.secret), nil
+}
+
+// checkTokenID rejects revoked and already used tokens, single-use tokens are consumed by Consume
+func (p *JwtParser) checkTokenID(claims jwtClaims, payload *Payload, now time.Time) error {
+	jti, ok := claims["jti"].(string)
+	if !ok && claims["jti"] != nil {
+		return errors.New("Claim jti must be a string")
+	}
+
+	if jti != "" && p.revocations != nil && p.revocations.IsRevoked(jti) {
+		return fmt.Errorf("Token '%s' is revoked", jti)
+	}
+
+	payload.TokenID = jti
+
+	if p.consumed == nil {
+		return nil
+	}
+
+	exp, hasExp, _ := claims.time("exp")
+	if jti == "" || !hasExp {
+		return errors.New("Single-use token must contain jti and exp claims")
+	}
+
+	if p.consumed.used(jti, now) {
+		return fmt.Errorf("Token '%s' is already used", jti)
+	}
+
+	payload.TokenExpiresAt = exp.Add(p.claims.leeway)
+	return nil
+}
+
+// Consume marks the single-use token as used, the token is rejected when it was used
+// by a concurrent session after Parse
+func (p *JwtParser) Consume(payload Payload) error {
+	if p.consumed == nil {
+		return nil
+	}
+
+	if payload.TokenID == "" || payload.TokenExpiresAt.IsZero() {
+		return errors.New("Single-use token must contain jti and exp claims")
+	}
+
+	if !p.consumed.consume(payload.TokenID, payload.TokenExpiresAt, time.Now()) {
+		return fmt.Errorf("Token '%s' is already used", payload.TokenID)
+	}
+
+	return nil
+}
+
+// BoundKey returns the key fingerprint from cnf claim without the token verification
+func (p *JwtParser) BoundKey(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	data, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	claims := jwtClaims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return ""
+	}
+
+	fingerprint, _ := claims.keyFingerprint()
+	return fingerprint
 }
 
 // Parse construct a payload from given string
 func (p *JwtParser) Parse(token string) (Payload, error) {
-	payload := Payload{}
-
-	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return []byte(p.secret), nil
-	})
+	parsed, err := jwt.ParseWithClaims(token, &jwtClaims{}, p.keyFunc)
 
 	if err != nil {
-		return payload, err
+		return Payload{}, err
 	}
 
-	claims := parsed.Claims.(jwt.MapClaims)
+	claims := *parsed.Claims.(*jwtClaims)
 
-	containerID := claims[jwtContainerID]
-	containerEnv := claims[jwtContainerEnv]
-	containerLabel := claims[jwtContainerLabel]
+	now := time.Now()
 
-	if containerID != nil {
-		payload.ContainerID = containerID.(string)
+	if err := p.claims.validate(claims, now); err != nil {
+		return Payload{}, err
 	}
 
-	if containerEnv != nil {
-		payload.ContainerEnv = containerEnv.(string)
+	payload, err := claims.payload()
+	if err != nil {
+		return Payload{}, err
 	}
 
-	if containerLabel != nil {
-		payload.ContainerLabel = containerLabel.(string)
+	if err := p.checkTokenID(claims, &payload, now); err != nil {
+		return Payload{}, err
 	}
 
 	return payload, nil
@@ -1,8 +1,13 @@
 package payloads
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,6 +19,15 @@ func Test_JwtParser(t *testing.T) {
 			"cid": "cid",
 			"env": "cenv",
 			"lab": "clabel",
+			"usr": "app",
+			"dir": "/app",
+			"prv": true,
+			"ns":  "web",
+			"sel": "app=web",
+			"cnt": "nginx",
+			"dmn": "agent-1",
+			"hst": "10.0.0.1",
+			"exp": time.Now().Add(time.Minute).Unix(),
 		})
 		parser := newTestJwtParser(t)
 		payload, err := parser.Parse(token)
@@ -24,6 +38,14 @@ func Test_JwtParser(t *testing.T) {
 		require.Equal(t, payload.ContainerID, "cid")
 		require.Equal(t, payload.ContainerLabel, "clabel")
 		require.Equal(t, payload.ContainerEnv, "cenv")
+		require.Equal(t, payload.User, "app")
+		require.Equal(t, payload.WorkingDir, "/app")
+		require.Equal(t, payload.Privileged, true)
+		require.Equal(t, payload.Namespace, "web")
+		require.Equal(t, payload.PodSelector, "app=web")
+		require.Equal(t, payload.ContainerName, "nginx")
+		require.Equal(t, payload.Daemon, "agent-1")
+		require.Equal(t, payload.Host, "10.0.0.1")
 	})
 
 	t.Run("fail on invalid token", func(t *testing.T) {
@@ -44,9 +66,412 @@ func Test_JwtParser(t *testing.T) {
 	})
 }
 
+func Test_JwtParserClaims(t *testing.T) {
+	now := time.Now()
+
+	newParser := func(opts JwtParserOptions) *JwtParser {
+		opts.Secret = "secret"
+		parser, err := NewJwtParser(opts)
+		require.NoError(t, err)
+		return parser
+	}
+
+	t.Run("should validate issuer and audience", func(t *testing.T) {
+		parser := newParser(JwtParserOptions{Issuer: "https://id.example.com", Audience: "proxy"})
+
+		_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{
+			"iss": "https://id.example.com",
+			"aud": []string{"api", "proxy"},
+			"exp": now.Add(time.Minute).Unix(),
+		}))
+		require.NoError(t, err)
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{
+			"iss": "https://other.example.com",
+			"aud": "proxy",
+			"exp": now.Add(time.Minute).Unix(),
+		}))
+		require.EqualError(t, err, "Unexpected token issuer 'https://other.example.com'")
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{
+			"iss": "https://id.example.com",
+			"aud": "api",
+			"exp": now.Add(time.Minute).Unix(),
+		}))
+		require.EqualError(t, err, "Token is not issued for this audience")
+	})
+
+	t.Run("should require exp claim", func(t *testing.T) {
+		_, err := newParser(JwtParserOptions{}).Parse(newTestJwtToken(t, jwt.MapClaims{}))
+		require.EqualError(t, err, "Token must contain exp claim")
+
+		_, err = newParser(JwtParserOptions{AllowMissingExp: true}).Parse(newTestJwtToken(t, jwt.MapClaims{}))
+		require.NoError(t, err)
+	})
+
+	t.Run("should limit token lifetime", func(t *testing.T) {
+		parser := newParser(JwtParserOptions{MaxLifetime: time.Hour})
+
+		_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{
+			"iat": now.Unix(),
+			"exp": now.Add(30 * time.Minute).Unix(),
+		}))
+		require.NoError(t, err)
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{
+			"exp": now.Add(24 * time.Hour).Unix(),
+		}))
+		require.EqualError(t, err, "Token lifetime exceeds 1h0m0s")
+	})
+
+	t.Run("should tolerate clock skew", func(t *testing.T) {
+		claims := jwt.MapClaims{
+			"nbf": now.Add(10 * time.Second).Unix(),
+			"iat": now.Add(10 * time.Second).Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+		}
+
+		_, err := newParser(JwtParserOptions{Leeway: 30 * time.Second}).Parse(newTestJwtToken(t, claims))
+		require.NoError(t, err)
+
+		_, err = newParser(JwtParserOptions{}).Parse(newTestJwtToken(t, claims))
+		require.EqualError(t, err, "Token is not valid yet")
+
+		expired := jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()}
+
+		_, err = newParser(JwtParserOptions{Leeway: 30 * time.Second}).Parse(newTestJwtToken(t, expired))
+		require.NoError(t, err)
+
+		_, err = newParser(JwtParserOptions{}).Parse(newTestJwtToken(t, expired))
+		require.Error(t, err)
+	})
+
+	t.Run("fail without keys", func(t *testing.T) {
+		_, err := NewJwtParser(JwtParserOptions{})
+		require.EqualError(t, err, "Neither JWT secret, keyring nor key set specified")
+	})
+}
+
+func Test_JwtParserKeySet(t *testing.T) {
+	keys := newTestKeys(t)
+
+	filename := newTestKeySetFile(t, keys.jwks(t))
+	defer os.Remove(filename)
+
+	keySet, err := NewKeySet(context.Background(), KeySetOptions{Source: filename})
+	require.NoError(t, err)
+
+	parser, err := NewJwtParser(JwtParserOptions{KeySet: keySet})
+	require.NoError(t, err)
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"cid": kid, "exp": time.Now().Add(time.Minute).Unix()})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	t.Run("should verify asymmetric tokens", func(t *testing.T) {
+		tokens := map[string]string{
+			"rsa-1": sign(jwt.SigningMethodRS256, "rsa-1", keys.rsa),
+			"ec-1":  sign(jwt.SigningMethodES256, "ec-1", keys.ecdsa),
+			"ed-1":  sign(SigningMethodEdDSA, "ed-1", keys.ed25519),
+		}
+
+		for kid, token := range tokens {
+			payload, err := parser.Parse(token)
+			require.NoError(t, err, kid)
+			require.Equal(t, kid, payload.ContainerID)
+		}
+	})
+
+	t.Run("fail on algorithm not matching key", func(t *testing.T) {
+		_, err := parser.Parse(sign(jwt.SigningMethodRS512, "rsa-1", keys.rsa))
+		require.EqualError(t, err, "Signing method RS512 doesn't match key 'rsa-1' algorithm RS256")
+	})
+
+	t.Run("fail on hmac token signed by public key", func(t *testing.T) {
+		der, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+		require.NoError(t, err)
+
+		public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		_, err = parser.Parse(sign(jwt.SigningMethodHS256, "rsa-1", public))
+		require.EqualError(t, err, "Signing method HS256 is not allowed")
+	})
+
+	t.Run("fail on unknown key id", func(t *testing.T) {
+		_, err := parser.Parse(sign(jwt.SigningMethodES256, "ec-2", keys.ecdsa))
+		require.EqualError(t, err, "Unknown key id 'ec-2'")
+
+		_, err = parser.Parse(sign(jwt.SigningMethodES256, "", keys.ecdsa))
+		require.EqualError(t, err, "Unknown key id ''")
+	})
+
+	t.Run("fail on wrong signature", func(t *testing.T) {
+		other := newTestKeys(t)
+
+		_, err := parser.Parse(sign(SigningMethodEdDSA, "ed-1", other.ed25519))
+		require.Error(t, err)
+	})
+
+	t.Run("fail on unsigned token", func(t *testing.T) {
+		_, err := parser.Parse(sign(jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType))
+		require.Error(t, err)
+	})
+}
+
+func Test_JwtParserKeyring(t *testing.T) {
+	dir := newTestKeyringDir(t, map[string]string{
+		"new.key":    "new-secret",
+		"old.verify": "old-secret",
+	})
+	defer os.RemoveAll(dir)
+
+	keyring, err := NewKeyring(context.Background(), KeyringOptions{Path: dir})
+	require.NoError(t, err)
+
+	sign := func(kid string, secret string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"cid": "cid", "exp": time.Now().Add(time.Minute).Unix()})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString([]byte(secret))
+		require.NoError(t, err)
+		return signed
+	}
+
+	t.Run("should verify tokens by active and verify-only keys", func(t *testing.T) {
+		parser, err := NewJwtParser(JwtParserOptions{Keyring: keyring})
+		require.NoError(t, err)
+
+		signed, err := keyring.Sign(jwt.MapClaims{"cid": "cid", "exp": time.Now().Add(time.Minute).Unix()})
+		require.NoError(t, err)
+
+		for _, token := range []string{signed, sign("new", "new-secret"), sign("old", "old-secret")} {
+			payload, err := parser.Parse(token)
+			require.NoError(t, err)
+			require.Equal(t, "cid", payload.ContainerID)
+		}
+	})
+
+	t.Run("should verify tokens without kid by the secret", func(t *testing.T) {
+		parser, err := NewJwtParser(JwtParserOptions{Secret: "secret", Keyring: keyring})
+		require.NoError(t, err)
+
+		_, err = parser.Parse(sign("", "secret"))
+		require.NoError(t, err)
+
+		_, err = parser.Parse(sign("new", "new-secret"))
+		require.NoError(t, err)
+
+		_, err = parser.Parse(sign("new", "secret"))
+		require.Error(t, err)
+	})
+
+	t.Run("fail on unknown key id", func(t *testing.T) {
+		parser, err := NewJwtParser(JwtParserOptions{Keyring: keyring})
+		require.NoError(t, err)
+
+		_, err = parser.Parse(sign("other", "new-secret"))
+		require.EqualError(t, err, "Unknown key id 'other'")
+
+		_, err = parser.Parse(sign("", "new-secret"))
+		require.EqualError(t, err, "Unknown key id ''")
+	})
+
+	t.Run("fail on wrong key", func(t *testing.T) {
+		parser, err := NewJwtParser(JwtParserOptions{Keyring: keyring})
+		require.NoError(t, err)
+
+		_, err = parser.Parse(sign("old", "new-secret"))
+		require.Error(t, err)
+	})
+}
+
+func Test_JwtParserTokenID(t *testing.T) {
+	revocations, err := NewRevocations(context.Background(), RevocationsOptions{})
+	require.NoError(t, err)
+	require.NoError(t, revocations.Revoke(Revocation{ID: "leaked"}))
+
+	newParser := func(opts JwtParserOptions) *JwtParser {
+		opts.Secret = "secret"
+		opts.Revocations = revocations
+		parser, err := NewJwtParser(opts)
+		require.NoError(t, err)
+		return parser
+	}
+
+	exp := time.Now().Add(time.Minute).Unix()
+
+	t.Run("should reject revoked tokens", func(t *testing.T) {
+		parser := newParser(JwtParserOptions{})
+
+		_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"jti": "leaked", "exp": exp}))
+		require.EqualError(t, err, "Token 'leaked' is revoked")
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{"jti": "other", "exp": exp}))
+		require.NoError(t, err)
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{"exp": exp}))
+		require.NoError(t, err)
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{"jti": 1, "exp": exp}))
+		require.EqualError(t, err, "Claim jti must be a string")
+	})
+
+	t.Run("should reject single-use tokens used twice", func(t *testing.T) {
+		parser := newParser(JwtParserOptions{SingleUse: true})
+		token := newTestJwtToken(t, jwt.MapClaims{"jti": "once", "exp": exp})
+
+		payload, err := parser.Parse(token)
+		require.NoError(t, err)
+		require.Equal(t, "once", payload.TokenID)
+
+		_, err = parser.Parse(token)
+		require.NoError(t, err, "token is used only when consumed")
+
+		require.NoError(t, parser.Consume(payload))
+		require.EqualError(t, parser.Consume(payload), "Token 'once' is already used")
+
+		_, err = parser.Parse(token)
+		require.EqualError(t, err, "Token 'once' is already used")
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{"jti": "leaked", "exp": exp}))
+		require.EqualError(t, err, "Token 'leaked' is revoked")
+	})
+
+	t.Run("fail on single-use token without jti", func(t *testing.T) {
+		parser := newParser(JwtParserOptions{SingleUse: true, AllowMissingExp: true})
+
+		_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"exp": exp}))
+		require.EqualError(t, err, "Single-use token must contain jti and exp claims")
+
+		_, err = parser.Parse(newTestJwtToken(t, jwt.MapClaims{"jti": "no-exp"}))
+		require.EqualError(t, err, "Single-use token must contain jti and exp claims")
+	})
+}
+
+func Test_JwtParserKeyBinding(t *testing.T) {
+	parser := newTestJwtParser(t)
+	exp := time.Now().Add(time.Minute).Unix()
+	fingerprint := "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"
+
+	t.Run("should parse bound token", func(t *testing.T) {
+		token := newTestJwtToken(t, jwt.MapClaims{"cnf": map[string]string{"ssh": fingerprint}, "exp": exp})
+
+		payload, err := parser.Parse(token)
+		require.NoError(t, err)
+		require.Equal(t, fingerprint, payload.KeyFingerprint)
+
+		require.Equal(t, fingerprint, parser.BoundKey(token))
+		require.Equal(t, "", parser.BoundKey(newTestJwtToken(t, jwt.MapClaims{"exp": exp})))
+		require.Equal(t, "", parser.BoundKey("broken"))
+	})
+
+	t.Run("fail on unsupported confirmation", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"Claim cnf must be an object":                     fingerprint,
+			"Claim cnf must contain only ssh key fingerprint": map[string]string{"jkt": "thumbprint"},
+			"Unsupported key fingerprint 'MD5:00:11'":         map[string]string{"ssh": "MD5:00:11"},
+		}
+
+		for message, cnf := range claims {
+			_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"cnf": cnf, "exp": exp}))
+			require.EqualError(t, err, message)
+		}
+	})
+}
+
+func Test_JwtParserSourceNetworks(t *testing.T) {
+	parser := newTestJwtParser(t)
+	exp := time.Now().Add(time.Minute).Unix()
+
+	t.Run("should parse source networks", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"10.8.0.0/16,192.168.1.10": "10.8.0.0/16, 192.168.1.10",
+			"10.8.0.0/16,fd00::/8":     []string{"10.8.0.0/16", "fd00::/8"},
+		}
+
+		for expected, src := range claims {
+			payload, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"src": src, "exp": exp}))
+			require.NoError(t, err)
+			require.Equal(t, expected, strings.Join(payload.SourceNetworks, ","))
+		}
+	})
+
+	t.Run("fail on invalid source networks", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"Invalid network '10.8.0.0/33' (invalid CIDR address: 10.8.0.0/33)": "10.8.0.0/33",
+			"Invalid network address 'vpn'":                                     []string{"vpn"},
+			"Claim src must contain only strings":                               []int{10},
+			"Claim src must be a string or an array":                            10,
+		}
+
+		for message, src := range claims {
+			_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"src": src, "exp": exp}))
+			require.EqualError(t, err, message)
+		}
+	})
+}
+
+func Test_JwtParserPolicy(t *testing.T) {
+	parser := newTestJwtParser(t)
+	exp := time.Now().Add(time.Minute).Unix()
+
+	t.Run("should parse policy and identity", func(t *testing.T) {
+		payload, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{
+			"pol": map[string]interface{}{
+				"modes": []string{"exec", "forwarding"},
+				"cmds":  []string{"uptime"},
+				"usr":   "app",
+				"ttl":   3600,
+				"ro":    true,
+			},
+			"sub":    "jdoe",
+			"name":   "John Doe",
+			"groups": []string{"oncall"},
+			"exp":    exp,
+		}))
+		require.NoError(t, err)
+
+		require.Equal(t, Policy{
+			Modes:       []string{"exec", "forwarding"},
+			Commands:    []string{"uptime"},
+			User:        "app",
+			MaxDuration: time.Hour,
+			ReadOnly:    true,
+		}, payload.Policy)
+
+		require.Equal(t, Identity{Subject: "jdoe", Name: "John Doe", Groups: []string{"oncall"}}, payload.Identity)
+	})
+
+	t.Run("fail on invalid policy", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"Claim pol must be an object": "exec",
+			"Unknown session mode 'x11', expected one of [shell] [exec] [forwarding] [attach] [logs]": map[string]interface{}{"modes": []string{"x11"}},
+			"Claim pol.cmds must be an array":         map[string]interface{}{"cmds": "uptime"},
+			"Claim pol.ttl must be a positive number": map[string]interface{}{"ttl": -1},
+			"Claim pol.ro must be a boolean":          map[string]interface{}{"ro": "yes"},
+			"Unknown policy member 'ip'":              map[string]interface{}{"ip": "10.0.0.1"},
+		}
+
+		for message, pol := range claims {
+			_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"pol": pol, "exp": exp}))
+			require.EqualError(t, err, message)
+		}
+
+		_, err := parser.Parse(newTestJwtToken(t, jwt.MapClaims{"groups": "oncall", "exp": exp}))
+		require.EqualError(t, err, "Claim groups must be an array")
+	})
+}
+
 func newTestJwtParser(t *testing.T) *JwtParser {
 	secret := "secret"
-	parser, err := NewJwtParser(secret)
+	parser, err := NewJwtParser(JwtParserOptions{Secret: secret})
 
 	require.NoError(t, err)
 	require.NotNil(t, parser)
@@ -0,0 +1,238 @@
+package payloads
+
+import (
+	"bytes"
+	"context"
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeyringInterval is a period of keyring directory checks
+const DefaultKeyringInterval = 10 * time.Second
+
+// suffixes of keyring files, the file name without suffix is a key id
+const (
+	keyringActiveSuffix = ".key"
+	keyringVerifySuffix = ".verify"
+)
+
+// KeyringOptions keeps parameters for keyring instance
+type KeyringOptions struct {
+	// Path is a directory with HMAC secrets, <kid>.key files are active keys used
+	// for signing and verification, <kid>.verify files are used only for verification
+	Path string
+
+	Interval time.Duration
+}
+
+// Keyring keeps named HMAC secrets selected by the token kid header, the directory
+// is reloaded periodically and previous keys are kept when reload fails.
+// Secrets are rotated by adding a new active key and turning the previous one
+// into verify-only key until all tokens signed by it are expired
+type Keyring struct {
+	sync.RWMutex
+	path     string
+	interval time.Duration
+	keys     map[string]hmacKey
+	log      *logrus.Entry
+	ctx      context.Context
+}
+
+type hmacKey struct {
+	secret []byte
+	active bool
+}
+
+// NewKeyring creates a new keyring and loads the directory, fails when it cannot be loaded
+func NewKeyring(ctx context.Context, opts KeyringOptions) (*Keyring, error) {
+	if opts.Path == "" {
+		return nil, errors.New("Keyring path cannot be empty")
+	}
+
+	interval := opts.Interval
+	if interval == 0 {
+		interval = DefaultKeyringInterval
+	}
+
+	keyring := &Keyring{
+		path:     opts.Path,
+		interval: interval,
+		log:      utils.NewLogEntry("payloads.keyring").WithField("path", opts.Path),
+		ctx:      ctx,
+	}
+
+	if err := keyring.reload(); err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+// Run reloads the keyring until the context done
+func (k *Keyring) Run(wg *sync.WaitGroup) error {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-k.ctx.Done():
+				k.log.Debug("Context done")
+				return
+			case <-time.After(k.interval):
+				if err := k.reload(); err != nil {
+					k.log.Errorf("Could not reload keyring, previous keys are kept (%s)", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (k *Keyring) reload() error {
+	keys, err := loadKeyring(k.path)
+	if err != nil {
+		return fmt.Errorf("Could not load keyring (%s)", err)
+	}
+
+	k.Lock()
+	changed := !sameKeys(k.keys, keys)
+	k.keys = keys
+	k.Unlock()
+
+	if changed {
+		k.log.Infof("Keyring loaded (%s)", describeKeys(keys))
+	}
+
+	return nil
+}
+
+// lookup returns the secret by key id, the key id may be omitted when the keyring has the single key
+func (k *Keyring) lookup(kid string) ([]byte, bool) {
+	k.RLock()
+	defer k.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key.secret, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+	return key.secret, ok
+}
+
+// Sign the claims using the active key, the key id is added to the token header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.RLock()
+	defer k.RUnlock()
+
+	for kid, key := range k.keys {
+		if key.active {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			token.Header["kid"] = kid
+			return token.SignedString(key.secret)
+		}
+	}
+
+	return "", errors.New("Keyring has no active key")
+}
+
+// loadKeyring reads secrets from the directory, other files are ignored
+func loadKeyring(dir string) (map[string]hmacKey, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]hmacKey)
+	actives := make([]string, 0)
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		var kid string
+		active := strings.HasSuffix(name, keyringActiveSuffix)
+
+		switch {
+		case active:
+			kid = strings.TrimSuffix(name, keyringActiveSuffix)
+		case strings.HasSuffix(name, keyringVerifySuffix):
+			kid = strings.TrimSuffix(name, keyringVerifySuffix)
+		default:
+			continue
+		}
+
+		secret, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("Key '%s' is empty", kid)
+		}
+
+		if _, ok := keys[kid]; ok {
+			return nil, fmt.Errorf("Key id '%s' is used more than once", kid)
+		}
+
+		keys[kid] = hmacKey{secret: secret, active: active}
+		if active {
+			actives = append(actives, kid)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No keys found")
+	}
+
+	if len(actives) > 1 {
+		sort.Strings(actives)
+		return nil, fmt.Errorf("Only one key can be active, got %s", strings.Join(actives, ", "))
+	}
+
+	return keys, nil
+}
+
+func sameKeys(a, b map[string]hmacKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for kid, key := range a {
+		other, ok := b[kid]
+		if !ok || other.active != key.active || !bytes.Equal(other.secret, key.secret) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// describeKeys lists key ids, the active key is marked by asterisk
+func describeKeys(keys map[string]hmacKey) string {
+	names := make([]string, 0)
+	for kid, key := range keys {
+		if key.active {
+			kid += "*"
+		}
+		names = append(names, kid)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
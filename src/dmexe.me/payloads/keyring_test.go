@@ -0,0 +1,147 @@
+package payloads
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestKeyringDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "keyring")
+	require.NoError(t, err)
+
+	writeTestKeyringFiles(t, dir, files)
+
+	return dir
+}
+
+func writeTestKeyringFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600))
+	}
+}
+
+func Test_Keyring(t *testing.T) {
+	t.Run("should load keys from directory", func(t *testing.T) {
+		dir := newTestKeyringDir(t, map[string]string{
+			"2017-02.key":    "new-secret\n",
+			"2017-01.verify": "old-secret",
+			"README":         "ignored",
+			".hidden.key":    "ignored",
+		})
+		defer os.RemoveAll(dir)
+
+		keyring, err := NewKeyring(context.Background(), KeyringOptions{Path: dir})
+		require.NoError(t, err)
+
+		secret, ok := keyring.lookup("2017-02")
+		require.True(t, ok)
+		require.Equal(t, []byte("new-secret"), secret)
+
+		secret, ok = keyring.lookup("2017-01")
+		require.True(t, ok)
+		require.Equal(t, []byte("old-secret"), secret)
+
+		_, ok = keyring.lookup("")
+		require.False(t, ok)
+
+		_, ok = keyring.lookup(".hidden")
+		require.False(t, ok)
+	})
+
+	t.Run("should sign tokens by the active key", func(t *testing.T) {
+		dir := newTestKeyringDir(t, map[string]string{
+			"new.key":    "new-secret",
+			"old.verify": "old-secret",
+		})
+		defer os.RemoveAll(dir)
+
+		keyring, err := NewKeyring(context.Background(), KeyringOptions{Path: dir})
+		require.NoError(t, err)
+
+		token, err := keyring.Sign(jwt.MapClaims{"cid": "cid"})
+		require.NoError(t, err)
+
+		parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+			require.Equal(t, "new", token.Header["kid"])
+			return []byte("new-secret"), nil
+		})
+		require.NoError(t, err)
+		require.True(t, parsed.Valid)
+	})
+
+	t.Run("should reload keys and keep them on failure", func(t *testing.T) {
+		dir := newTestKeyringDir(t, map[string]string{"old.key": "old-secret"})
+		defer os.RemoveAll(dir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		keyring, err := NewKeyring(ctx, KeyringOptions{Path: dir, Interval: 10 * time.Millisecond})
+		require.NoError(t, err)
+		require.NoError(t, keyring.Run(&wg))
+
+		require.NoError(t, os.Rename(path.Join(dir, "old.key"), path.Join(dir, "old.verify")))
+		writeTestKeyringFiles(t, dir, map[string]string{"new.key": "new-secret"})
+
+		var ok bool
+		for i := 0; i < 100; i++ {
+			if _, ok = keyring.lookup("new"); ok {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.True(t, ok, "keyring is reloaded")
+
+		writeTestKeyringFiles(t, dir, map[string]string{"other.key": "other-secret"})
+
+		time.Sleep(50 * time.Millisecond)
+
+		_, ok = keyring.lookup("new")
+		require.True(t, ok, "previous keys are kept")
+
+		_, ok = keyring.lookup("other")
+		require.False(t, ok)
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on several active keys", func(t *testing.T) {
+		dir := newTestKeyringDir(t, map[string]string{"a.key": "a", "b.key": "b"})
+		defer os.RemoveAll(dir)
+
+		_, err := loadKeyring(dir)
+		require.EqualError(t, err, "Only one key can be active, got a, b")
+	})
+
+	t.Run("fail on empty key", func(t *testing.T) {
+		dir := newTestKeyringDir(t, map[string]string{"a.key": "\n"})
+		defer os.RemoveAll(dir)
+
+		_, err := loadKeyring(dir)
+		require.EqualError(t, err, "Key 'a' is empty")
+	})
+
+	t.Run("fail on duplicated key id", func(t *testing.T) {
+		dir := newTestKeyringDir(t, map[string]string{"a.key": "a", "a.verify": "b"})
+		defer os.RemoveAll(dir)
+
+		_, err := loadKeyring(dir)
+		require.EqualError(t, err, "Key id 'a' is used more than once")
+	})
+
+	t.Run("fail on empty directory", func(t *testing.T) {
+		dir := newTestKeyringDir(t, nil)
+		defer os.RemoveAll(dir)
+
+		_, err := NewKeyring(context.Background(), KeyringOptions{Path: dir})
+		require.EqualError(t, err, "Could not load keyring (No keys found)")
+	})
+}
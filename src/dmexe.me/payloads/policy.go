@@ -0,0 +1,119 @@
+package payloads
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// session modes restricted by the policy
+const (
+	ModeShell      = "shell"
+	ModeExec       = "exec"
+	ModeForwarding = "forwarding"
+	ModeAttach     = "attach"
+	ModeLogs       = "logs"
+)
+
+// Modes are all known session modes
+var Modes = []string{ModeShell, ModeExec, ModeForwarding, ModeAttach, ModeLogs}
+
+// explicitModes are never allowed by the empty list, the token must list them,
+// logs mode selects the logs session of docker handler instead of exec
+var explicitModes = []string{ModeAttach, ModeLogs}
+
+// Policy restricts the session, zero values don't restrict anything
+type Policy struct {
+	// Modes allowed for the session. The empty list allows all modes except attach and logs.
+	// Commands limit the empty list to exec mode, a non-empty list is used as is
+	Modes []string `json:"modes,omitempty"`
+
+	// Commands is a whitelist of exec commands, * matches a part of the single argument
+	// without whitespaces, quotes, shell operators, globs and .. (eg. "tail -f /var/log/*")
+	Commands []string `json:"commands,omitempty"`
+
+	// User is the only user allowed for the session
+	User string `json:"user,omitempty"`
+
+	// MaxDuration limits the session duration
+	MaxDuration time.Duration `json:"maxDuration,omitempty"`
+
+	// ReadOnly discards the client input and forbids privileged sessions, shells are not allowed
+	// and exec requires the commands whitelist, since a command could change anything without input
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// Identity is a human behind the token, it's used only for logging
+type Identity struct {
+	Subject string   `json:"subject,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+// commandWildcard matches a part of the single argument, it cannot add arguments,
+// chain commands or expand to other files, parent directories are checked separately
+const commandWildcard = "([^\\s;&|`$()<>'\"\\\\*?\\[\\]{}~]*)"
+
+// AllowsMode checks the session mode
+func (p Policy) AllowsMode(mode string) bool {
+	if p.ReadOnly && (mode == ModeShell || (mode == ModeExec && len(p.Commands) == 0)) {
+		return false
+	}
+
+	if len(p.Modes) > 0 {
+		for _, it := range p.Modes {
+			if it == mode {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, it := range explicitModes {
+		if it == mode {
+			return false
+		}
+	}
+
+	return len(p.Commands) == 0 || mode == ModeExec
+}
+
+// AllowsCommand checks the exec command against the whitelist
+func (p Policy) AllowsCommand(command string) bool {
+	if len(p.Commands) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Commands {
+		if matchCommand(pattern, command) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchCommand(pattern, command string) bool {
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	re, err := regexp.Compile("^" + strings.Join(parts, commandWildcard) + "$")
+	if err != nil {
+		return false
+	}
+
+	matches := re.FindStringSubmatch(command)
+	if matches == nil {
+		return false
+	}
+
+	for _, it := range matches[1:] {
+		if strings.Contains(it, "..") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,84 @@
+package payloads
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_Policy(t *testing.T) {
+
+	t.Run("should allow everything by default", func(t *testing.T) {
+		policy := Policy{}
+
+		for _, mode := range []string{ModeShell, ModeExec, ModeForwarding} {
+			require.True(t, policy.AllowsMode(mode), mode)
+		}
+		require.True(t, policy.AllowsCommand("rm -rf /"))
+	})
+
+	t.Run("should allow attach and logs only when listed", func(t *testing.T) {
+		for _, mode := range []string{ModeAttach, ModeLogs} {
+			require.False(t, Policy{}.AllowsMode(mode), mode)
+			require.False(t, Policy{Modes: []string{ModeShell}}.AllowsMode(mode), mode)
+			require.True(t, Policy{Modes: []string{ModeShell, mode}}.AllowsMode(mode), mode)
+		}
+	})
+
+	t.Run("should allow only exec when commands are restricted", func(t *testing.T) {
+		policy := Policy{Commands: []string{"uptime"}}
+
+		require.True(t, policy.AllowsMode(ModeExec))
+		require.False(t, policy.AllowsMode(ModeShell))
+		require.False(t, policy.AllowsMode(ModeForwarding))
+
+		policy.Modes = []string{ModeShell, ModeExec}
+		require.True(t, policy.AllowsMode(ModeShell))
+	})
+
+	t.Run("should allow read-only exec only with commands", func(t *testing.T) {
+		policy := Policy{ReadOnly: true}
+		require.False(t, policy.AllowsMode(ModeShell))
+		require.False(t, policy.AllowsMode(ModeExec))
+
+		policy.Commands = []string{"uptime"}
+		require.True(t, policy.AllowsMode(ModeExec))
+
+		policy.Modes = []string{ModeShell, ModeExec}
+		require.False(t, policy.AllowsMode(ModeShell))
+		require.True(t, policy.AllowsMode(ModeExec))
+	})
+
+	t.Run("should match commands", func(t *testing.T) {
+		policy := Policy{Commands: []string{"uptime", "tail -f /var/log/*", "echo a.b"}}
+
+		allowed := []string{"uptime", "tail -f /var/log/app/web.log", "tail -f /var/log/", "echo a.b"}
+		for _, command := range allowed {
+			require.True(t, policy.AllowsCommand(command), command)
+		}
+
+		denied := []string{
+			"uptime -p",
+			" uptime",
+			"echo aXb",
+			"tail -f /etc/passwd",
+			"tail -f /var/log/x; rm -rf /",
+			"tail -f /var/log/x && sh",
+			"tail -f /var/log/$(id)",
+			"tail -f /var/log/`id`",
+			"tail -f /var/log/x\nsh",
+			"tail -f /var/log/x | sh",
+			"tail -f /var/log/x > /etc/passwd",
+			"tail -f /var/log/x /etc/shadow",
+			"tail -f /var/log/x\t/etc/shadow",
+			"tail -f /var/log/../../etc/shadow",
+			"tail -f /var/log/app/../../../etc/shadow",
+			"tail -f /var/log/x\\ /etc/shadow",
+			"tail -f /var/log/'x /etc/shadow'",
+			"tail -f /var/log/*",
+			"tail -f /var/log/{x,../../etc/shadow}",
+		}
+		for _, command := range denied {
+			require.False(t, policy.AllowsCommand(command), command)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+package payloads
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRevocationsInterval is a period of revocation list reloads
+const DefaultRevocationsInterval = 10 * time.Second
+
+// RevocationsOptions keeps parameters for revocation list instance
+type RevocationsOptions struct {
+	// Path is a file with revoked token ids, one "<jti> [<expires unix time>]" entry per line,
+	// the list is kept in memory when it's empty
+	Path string
+
+	Interval time.Duration
+}
+
+// Revocation is an entry of revocation list, zero ExpiresAt means the entry never expires
+type Revocation struct {
+	ID        string    `json:"jti"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Validate checks the token id, it's stored in the line-based file
+func (e Revocation) Validate() error {
+	if e.ID == "" {
+		return errors.New("Token id cannot be empty")
+	}
+
+	if strings.ContainsAny(e.ID, " \t\r\n#") {
+		return errors.New("Token id cannot contain spaces or #")
+	}
+
+	return nil
+}
+
+// Revocations keeps revoked token ids, the file is reloaded periodically and new entries
+// are appended to it, so processes sharing the file see revocations of each other.
+// Entries are dropped when they're expired, a token cannot be used after its exp anyway
+type Revocations struct {
+	sync.RWMutex
+	path     string
+	interval time.Duration
+	entries  map[string]time.Time
+	log      *logrus.Entry
+	ctx      context.Context
+}
+
+// NewRevocations creates a new revocation list and loads the file, a missing file is an empty list
+func NewRevocations(ctx context.Context, opts RevocationsOptions) (*Revocations, error) {
+	interval := opts.Interval
+	if interval == 0 {
+		interval = DefaultRevocationsInterval
+	}
+
+	revocations := &Revocations{
+		path:     opts.Path,
+		interval: interval,
+		entries:  make(map[string]time.Time),
+		log:      utils.NewLogEntry("payloads.revocations").WithField("path", opts.Path),
+		ctx:      ctx,
+	}
+
+	if err := revocations.reload(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// Run reloads the revocation list until the context done
+func (r *Revocations) Run(wg *sync.WaitGroup) error {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-r.ctx.Done():
+				r.log.Debug("Context done")
+				return
+			case <-time.After(r.interval):
+				if err := r.reload(time.Now()); err != nil {
+					r.log.Errorf("Could not reload revocations, previous entries are kept (%s)", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *Revocations) reload(now time.Time) error {
+	r.Lock()
+	defer r.Unlock()
+
+	entries := r.entries
+	if r.path != "" {
+		data, err := ioutil.ReadFile(r.path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not load revocations (%s)", err)
+		}
+
+		if entries, err = parseRevocations(data); err != nil {
+			return fmt.Errorf("Could not parse revocations (%s)", err)
+		}
+	}
+
+	for id, expiresAt := range entries {
+		if !expiresAt.IsZero() && now.After(expiresAt) {
+			delete(entries, id)
+		}
+	}
+
+	if len(entries) != len(r.entries) {
+		r.log.Infof("Revocations loaded (%d entries)", len(entries))
+	}
+	r.entries = entries
+
+	return nil
+}
+
+// Revoke adds the token id to the list and appends it to the file
+func (r *Revocations) Revoke(entry Revocation) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.path != "" {
+		file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("Could not open revocations (%s)", err)
+		}
+		defer file.Close()
+
+		if _, err := file.WriteString(formatRevocation(entry)); err != nil {
+			return fmt.Errorf("Could not write revocations (%s)", err)
+		}
+	}
+
+	r.entries[entry.ID] = entry.ExpiresAt
+	r.log.Infof("Token '%s' revoked", entry.ID)
+
+	return nil
+}
+
+// IsRevoked checks the token id
+func (r *Revocations) IsRevoked(id string) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	_, ok := r.entries[id]
+	return ok
+}
+
+// List returns entries sorted by token id
+func (r *Revocations) List() []Revocation {
+	r.RLock()
+	defer r.RUnlock()
+
+	entries := make([]Revocation, 0, len(r.entries))
+	for id, expiresAt := range r.entries {
+		entries = append(entries, Revocation{ID: id, ExpiresAt: expiresAt})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries
+}
+
+// parseRevocations reads "<jti> [<expires unix time>]" lines, empty lines and # comments are skipped
+func parseRevocations(data []byte) (map[string]time.Time, error) {
+	entries := make(map[string]time.Time)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("Invalid entry at line %d", line)
+		}
+
+		var expiresAt time.Time
+		if len(fields) == 2 {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid expiration time at line %d (%s)", line, err)
+			}
+			expiresAt = time.Unix(seconds, 0)
+		}
+
+		entries[fields[0]] = expiresAt
+	}
+
+	return entries, scanner.Err()
+}
+
+func formatRevocation(entry Revocation) string {
+	if entry.ExpiresAt.IsZero() {
+		return entry.ID + "\n"
+	}
+	return fmt.Sprintf("%s %d\n", entry.ID, entry.ExpiresAt.Unix())
+}
+
+// consumedTokens remembers ids of single-use tokens until they're expired
+type consumedTokens struct {
+	sync.Mutex
+	entries   map[string]time.Time
+	nextSweep time.Time
+}
+
+func newConsumedTokens() *consumedTokens {
+	return &consumedTokens{entries: make(map[string]time.Time)}
+}
+
+// used checks that the token id is consumed and not expired yet
+func (c *consumedTokens) used(id string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	exp, ok := c.entries[id]
+	return ok && !now.After(exp)
+}
+
+// consume marks the token id as used, returns false when it's already used
+func (c *consumedTokens) consume(id string, expiresAt time.Time, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if now.After(c.nextSweep) {
+		for it, exp := range c.entries {
+			if now.After(exp) {
+				delete(c.entries, it)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+
+	if exp, ok := c.entries[id]; ok && !now.After(exp) {
+		return false
+	}
+
+	c.entries[id] = expiresAt
+	return true
+}
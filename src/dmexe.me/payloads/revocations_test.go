@@ -0,0 +1,131 @@
+package payloads
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Revocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("should load revocations from file", func(t *testing.T) {
+		filename := path.Join(dir, "load")
+		now := time.Now()
+
+		content := "# leaked tokens\n" +
+			"forever\n" +
+			"\n" +
+			"until-tomorrow " + formatUnix(now.Add(24*time.Hour)) + "\n" +
+			"expired " + formatUnix(now.Add(-time.Hour)) + "\n"
+		require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+
+		revocations, err := NewRevocations(context.Background(), RevocationsOptions{Path: filename})
+		require.NoError(t, err)
+
+		require.True(t, revocations.IsRevoked("forever"))
+		require.True(t, revocations.IsRevoked("until-tomorrow"))
+		require.False(t, revocations.IsRevoked("expired"))
+		require.False(t, revocations.IsRevoked("unknown"))
+
+		list := revocations.List()
+		require.Len(t, list, 2)
+		require.Equal(t, "forever", list[0].ID)
+		require.True(t, list[0].ExpiresAt.IsZero())
+	})
+
+	t.Run("should append revocations to file", func(t *testing.T) {
+		filename := path.Join(dir, "append")
+		expiresAt := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+
+		revocations, err := NewRevocations(context.Background(), RevocationsOptions{Path: filename})
+		require.NoError(t, err)
+		require.Empty(t, revocations.List())
+
+		require.NoError(t, revocations.Revoke(Revocation{ID: "a"}))
+		require.NoError(t, revocations.Revoke(Revocation{ID: "b", ExpiresAt: expiresAt}))
+		require.True(t, revocations.IsRevoked("a"))
+
+		other, err := NewRevocations(context.Background(), RevocationsOptions{Path: filename})
+		require.NoError(t, err)
+		require.Equal(t, []Revocation{{ID: "a"}, {ID: "b", ExpiresAt: expiresAt}}, other.List())
+	})
+
+	t.Run("should reload revocations from file", func(t *testing.T) {
+		filename := path.Join(dir, "reload")
+		require.NoError(t, ioutil.WriteFile(filename, []byte("a\n"), 0600))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		revocations, err := NewRevocations(ctx, RevocationsOptions{Path: filename, Interval: 10 * time.Millisecond})
+		require.NoError(t, err)
+		require.NoError(t, revocations.Run(&wg))
+
+		require.NoError(t, ioutil.WriteFile(filename, []byte("a\nb\n"), 0600))
+
+		var ok bool
+		for i := 0; i < 100; i++ {
+			if ok = revocations.IsRevoked("b"); ok {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.True(t, ok, "revocations are reloaded")
+
+		require.NoError(t, ioutil.WriteFile(filename, []byte("a b c\n"), 0600))
+
+		time.Sleep(50 * time.Millisecond)
+		require.True(t, revocations.IsRevoked("b"), "previous entries are kept")
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("should keep revocations in memory without file", func(t *testing.T) {
+		revocations, err := NewRevocations(context.Background(), RevocationsOptions{})
+		require.NoError(t, err)
+
+		require.NoError(t, revocations.Revoke(Revocation{ID: "a"}))
+		require.NoError(t, revocations.reload(time.Now()))
+		require.True(t, revocations.IsRevoked("a"))
+	})
+
+	t.Run("fail on invalid token id", func(t *testing.T) {
+		revocations, err := NewRevocations(context.Background(), RevocationsOptions{})
+		require.NoError(t, err)
+
+		require.EqualError(t, revocations.Revoke(Revocation{}), "Token id cannot be empty")
+		require.EqualError(t, revocations.Revoke(Revocation{ID: "a b"}), "Token id cannot contain spaces or #")
+	})
+
+	t.Run("fail on invalid file", func(t *testing.T) {
+		_, err := parseRevocations([]byte("a\nb tomorrow\n"))
+		require.EqualError(t, err, "Invalid expiration time at line 2 (strconv.ParseInt: parsing \"tomorrow\": invalid syntax)")
+	})
+}
+
+func Test_ConsumedTokens(t *testing.T) {
+	consumed := newConsumedTokens()
+	now := time.Now()
+
+	require.True(t, consumed.consume("a", now.Add(time.Minute), now))
+	require.False(t, consumed.consume("a", now.Add(time.Minute), now.Add(time.Second)))
+	require.True(t, consumed.consume("b", now.Add(time.Minute), now))
+
+	later := now.Add(2 * time.Minute)
+	require.True(t, consumed.consume("a", later.Add(time.Minute), later), "expired entries are forgotten")
+	require.Len(t, consumed.entries, 1)
+}
+
+func formatUnix(value time.Time) string {
+	return strconv.FormatInt(value.Unix(), 10)
+}
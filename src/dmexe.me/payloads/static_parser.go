@@ -0,0 +1,258 @@
+package payloads
+
+import (
+	"context"
+	"crypto/sha256"
+	"dmexe.me/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStaticParserInterval is a period of tokens file checks
+const DefaultStaticParserInterval = 10 * time.Second
+
+// StaticParserOptions keeps parameters for static parser instance
+type StaticParserOptions struct {
+	// Path is a JSON file with tokens
+	Path string
+
+	Interval time.Duration
+}
+
+// StaticParser is a parser implementation for opaque tokens listed in the file,
+// tokens are stored as sha256 hex digests (eg. printf %s "$TOKEN" | sha256sum),
+// the file is reloaded on change and previous tokens are kept when reload fails
+//
+//	{"tokens": [{
+//	  "name": "ci-deploy",
+//	  "sha256": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+//	  "expiresAt": "2017-12-31T00:00:00Z",
+//	  "payload": {"containerId": "web", "user": "app"},
+//	  "policy": {"modes": ["exec"], "commands": ["deploy *"], "maxDuration": "10m"},
+//	  "identity": {"groups": ["ci"]}
+//	}]}
+type StaticParser struct {
+	sync.RWMutex
+	path     string
+	interval time.Duration
+	modTime  time.Time
+	size     int64
+	tokens   map[string]staticToken
+	log      *logrus.Entry
+	ctx      context.Context
+}
+
+type staticTokensFile struct {
+	Tokens []staticToken `json:"tokens"`
+}
+
+// staticToken keeps policy and identity as top level members, they override the payload ones
+type staticToken struct {
+	Name      string       `json:"name"`
+	SHA256    string       `json:"sha256"`
+	ExpiresAt *time.Time   `json:"expiresAt"`
+	Payload   Payload      `json:"payload"`
+	Policy    staticPolicy `json:"policy"`
+	Identity  Identity     `json:"identity"`
+}
+
+// staticPolicy is a policy with human readable duration (eg. 1h30m)
+type staticPolicy struct {
+	Modes       []string `json:"modes"`
+	Commands    []string `json:"commands"`
+	User        string   `json:"user"`
+	MaxDuration string   `json:"maxDuration"`
+	ReadOnly    bool     `json:"readOnly"`
+}
+
+// NewStaticParser creates a new parser and loads the file, fails when it cannot be loaded
+func NewStaticParser(ctx context.Context, opts StaticParserOptions) (*StaticParser, error) {
+	if opts.Path == "" {
+		return nil, errors.New("Static tokens path cannot be empty")
+	}
+
+	interval := opts.Interval
+	if interval == 0 {
+		interval = DefaultStaticParserInterval
+	}
+
+	parser := &StaticParser{
+		path:     opts.Path,
+		interval: interval,
+		log:      utils.NewLogEntry("payloads.static").WithField("path", opts.Path),
+		ctx:      ctx,
+	}
+
+	if err := parser.reload(); err != nil {
+		return nil, err
+	}
+
+	return parser, nil
+}
+
+// Run reloads the file on change until the context done
+func (p *StaticParser) Run(wg *sync.WaitGroup) error {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-p.ctx.Done():
+				p.log.Debug("Context done")
+				return
+			case <-time.After(p.interval):
+				if err := p.reload(); err != nil {
+					p.log.Errorf("Could not reload static tokens, previous tokens are kept (%s)", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reload reads the file when its modification time or size is changed
+func (p *StaticParser) reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("Could not load static tokens (%s)", err)
+	}
+
+	p.RLock()
+	unchanged := p.tokens != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size
+	p.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("Could not load static tokens (%s)", err)
+	}
+
+	tokens, err := parseStaticTokens(data)
+	if err != nil {
+		return fmt.Errorf("Could not parse static tokens (%s)", err)
+	}
+
+	p.Lock()
+	p.tokens = tokens
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	p.Unlock()
+
+	p.log.Infof("Static tokens loaded (%d tokens)", len(tokens))
+
+	return nil
+}
+
+// Parse looks up the token by its digest
+func (p *StaticParser) Parse(token string) (Payload, error) {
+	digest := sha256.Sum256([]byte(token))
+
+	p.RLock()
+	entry, ok := p.tokens[hex.EncodeToString(digest[:])]
+	p.RUnlock()
+
+	if !ok {
+		return Payload{}, errors.New("Unknown token")
+	}
+
+	if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
+		return Payload{}, fmt.Errorf("Token '%s' is expired", entry.Name)
+	}
+
+	return entry.Payload, nil
+}
+
+// parseStaticTokens returns tokens by their digests
+func parseStaticTokens(data []byte) (map[string]staticToken, error) {
+	file := staticTokensFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]staticToken)
+	names := make(map[string]bool)
+
+	for i, entry := range file.Tokens {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("Token #%d has no name", i+1)
+		}
+
+		if names[entry.Name] {
+			return nil, fmt.Errorf("Token name '%s' is used more than once", entry.Name)
+		}
+		names[entry.Name] = true
+
+		digest := strings.ToLower(entry.SHA256)
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("Token '%s' must have sha256 hex digest", entry.Name)
+		}
+
+		if _, ok := tokens[digest]; ok {
+			return nil, fmt.Errorf("Token '%s' digest is used more than once", entry.Name)
+		}
+
+		policy, err := entry.Policy.convert()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token '%s' policy (%s)", entry.Name, err)
+		}
+
+		if len(entry.Payload.SourceNetworks) > 0 {
+			if _, err := utils.ParseNetworks(entry.Payload.SourceNetworks); err != nil {
+				return nil, fmt.Errorf("Invalid token '%s' networks (%s)", entry.Name, err)
+			}
+		}
+
+		entry.Payload.Policy = policy
+		entry.Payload.Identity = entry.Identity
+		if entry.Payload.Identity.Subject == "" {
+			entry.Payload.Identity.Subject = entry.Name
+		}
+
+		tokens[digest] = entry
+	}
+
+	return tokens, nil
+}
+
+func (p staticPolicy) convert() (Policy, error) {
+	policy := Policy{
+		Modes:    p.Modes,
+		Commands: p.Commands,
+		User:     p.User,
+		ReadOnly: p.ReadOnly,
+	}
+
+	for _, mode := range policy.Modes {
+		if !containsMode(mode) {
+			return policy, fmt.Errorf("Unknown session mode '%s', expected one of [%s]", mode, strings.Join(Modes, "] ["))
+		}
+	}
+
+	if p.MaxDuration != "" {
+		duration, err := time.ParseDuration(p.MaxDuration)
+		if err != nil {
+			return policy, err
+		}
+
+		if duration <= 0 {
+			return policy, errors.New("Max duration must be positive")
+		}
+		policy.MaxDuration = duration
+	}
+
+	return policy, nil
+}
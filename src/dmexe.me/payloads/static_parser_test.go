@@ -0,0 +1,138 @@
+package payloads
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_StaticParser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("should parse tokens from file", func(t *testing.T) {
+		filename := path.Join(dir, "tokens.json")
+		content := `{"tokens": [{
+			"name": "ci-deploy",
+			"sha256": "` + staticDigest("secret") + `",
+			"payload": {"containerId": "web", "user": "app", "sourceNetworks": ["10.0.0.0/8"]},
+			"policy": {"modes": ["exec"], "commands": ["deploy *"], "maxDuration": "10m"},
+			"identity": {"groups": ["ci"]}
+		}]}`
+		require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+
+		parser, err := NewStaticParser(context.Background(), StaticParserOptions{Path: filename})
+		require.NoError(t, err)
+
+		payload, err := parser.Parse("secret")
+		require.NoError(t, err)
+
+		expected := Payload{
+			ContainerID:    "web",
+			User:           "app",
+			SourceNetworks: []string{"10.0.0.0/8"},
+			Policy: Policy{
+				Modes:       []string{ModeExec},
+				Commands:    []string{"deploy *"},
+				MaxDuration: 10 * time.Minute,
+			},
+			Identity: Identity{Subject: "ci-deploy", Groups: []string{"ci"}},
+		}
+		require.Equal(t, expected, payload)
+
+		_, err = parser.Parse("unknown")
+		require.EqualError(t, err, "Unknown token")
+	})
+
+	t.Run("fail on expired token", func(t *testing.T) {
+		filename := path.Join(dir, "expired.json")
+		content := `{"tokens": [{"name": "old", "sha256": "` + staticDigest("old") + `", "expiresAt": "2017-01-01T00:00:00Z"}]}`
+		require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+
+		parser, err := NewStaticParser(context.Background(), StaticParserOptions{Path: filename})
+		require.NoError(t, err)
+
+		_, err = parser.Parse("old")
+		require.EqualError(t, err, "Token 'old' is expired")
+	})
+
+	t.Run("should reload tokens from file", func(t *testing.T) {
+		filename := path.Join(dir, "reload.json")
+		require.NoError(t, ioutil.WriteFile(filename, []byte(staticFile("a")), 0600))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		parser, err := NewStaticParser(ctx, StaticParserOptions{Path: filename, Interval: 10 * time.Millisecond})
+		require.NoError(t, err)
+		require.NoError(t, parser.Run(&wg))
+
+		require.NoError(t, ioutil.WriteFile(filename, []byte(staticFile("bb")), 0600))
+
+		var parseErr error
+		for i := 0; i < 100; i++ {
+			if _, parseErr = parser.Parse("bb"); parseErr == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, parseErr, "tokens are reloaded")
+
+		_, err = parser.Parse("a")
+		require.EqualError(t, err, "Unknown token", "removed tokens are revoked")
+
+		require.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0600))
+
+		time.Sleep(50 * time.Millisecond)
+		_, err = parser.Parse("bb")
+		require.NoError(t, err, "previous tokens are kept")
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on missing file", func(t *testing.T) {
+		_, err := NewStaticParser(context.Background(), StaticParserOptions{Path: path.Join(dir, "missing.json")})
+		require.Error(t, err)
+	})
+
+	t.Run("fail on invalid file", func(t *testing.T) {
+		cases := map[string]string{
+			`{"tokens": [{"sha256": "` + staticDigest("a") + `"}]}`:                                                                    "Token #1 has no name",
+			`{"tokens": [{"name": "a", "sha256": "abc"}]}`:                                                                             "Token 'a' must have sha256 hex digest",
+			`{"tokens": [{"name": "a", "sha256": "` + staticDigest("a") + `"}, {"name": "a", "sha256": "` + staticDigest("b") + `"}]}`: "Token name 'a' is used more than once",
+			`{"tokens": [{"name": "a", "sha256": "` + staticDigest("a") + `"}, {"name": "b", "sha256": "` + staticDigest("a") + `"}]}`: "Token 'b' digest is used more than once",
+			`{"tokens": [{"name": "a", "sha256": "` + staticDigest("a") + `", "policy": {"modes": ["x"]}}]}`:                           "Invalid token 'a' policy (Unknown session mode 'x', expected one of [shell] [exec] [forwarding] [attach] [logs])",
+			`{"tokens": [{"name": "a", "sha256": "` + staticDigest("a") + `", "policy": {"maxDuration": "-1m"}}]}`:                     "Invalid token 'a' policy (Max duration must be positive)",
+		}
+
+		for content, expected := range cases {
+			_, err := parseStaticTokens([]byte(content))
+			require.EqualError(t, err, expected)
+		}
+	})
+}
+
+func staticDigest(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+func staticFile(tokens ...string) string {
+	content := `{"tokens": [`
+	for i, it := range tokens {
+		if i > 0 {
+			content += ", "
+		}
+		content += `{"name": "` + it + `", "sha256": "` + staticDigest(it) + `"}`
+	}
+	return content + "]}"
+}
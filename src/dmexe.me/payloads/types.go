@@ -1,13 +1,46 @@
 package payloads
 
+import (
+	"time"
+)
+
 // Payload holds queries
 type Payload struct {
-	ContainerID    string `json:"containerId"`
-	ContainerEnv   string `json:"containerEnv"`
-	ContainerLabel string `json:"containerLabel"`
+	ContainerID    string   `json:"containerId"`
+	ContainerEnv   string   `json:"containerEnv"`
+	ContainerLabel string   `json:"containerLabel"`
+	User           string   `json:"user,omitempty"`
+	WorkingDir     string   `json:"workingDir,omitempty"`
+	Privileged     bool     `json:"privileged,omitempty"`
+	Namespace      string   `json:"namespace,omitempty"`
+	PodSelector    string   `json:"podSelector,omitempty"`
+	ContainerName  string   `json:"containerName,omitempty"`
+	Daemon         string   `json:"daemon,omitempty"`
+	Host           string   `json:"host,omitempty"`
+	KeyFingerprint string   `json:"keyFingerprint,omitempty"`
+	SourceNetworks []string `json:"sourceNetworks,omitempty"`
+	Policy         Policy   `json:"policy"`
+	Identity       Identity `json:"identity"`
+	Parser         string   `json:"parser,omitempty"`
+	TokenID        string   `json:"tokenId,omitempty"`
+
+	// TokenExpiresAt is set for single-use tokens, the token id is remembered until then
+	TokenExpiresAt time.Time `json:"-"`
 }
 
 // Parser generic interface
 type Parser interface {
 	Parse(string) (Payload, error)
 }
+
+// Consumer is implemented by parsers of single-use tokens, Parse only checks that the token
+// is not used yet and the token is consumed after all session checks passed
+type Consumer interface {
+	Consume(Payload) error
+}
+
+// KeyBinder is implemented by parsers of tokens bound to client public keys,
+// the fingerprint is read before the token verification and only helps to select the key
+type KeyBinder interface {
+	BoundKey(string) string
+}
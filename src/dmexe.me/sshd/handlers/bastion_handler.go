@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"context"
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultBastionPort is used when payload host doesn't specify a port
+const DefaultBastionPort = "22"
+
+// signalNumbers converts ssh signal names to linux numbers for shell-like exit codes
+var signalNumbers = map[string]int{
+	string(ssh.SIGHUP):  1,
+	string(ssh.SIGINT):  2,
+	string(ssh.SIGQUIT): 3,
+	string(ssh.SIGILL):  4,
+	string(ssh.SIGABRT): 6,
+	string(ssh.SIGFPE):  8,
+	string(ssh.SIGKILL): 9,
+	string(ssh.SIGUSR1): 10,
+	string(ssh.SIGSEGV): 11,
+	string(ssh.SIGUSR2): 12,
+	string(ssh.SIGPIPE): 13,
+	string(ssh.SIGALRM): 14,
+	string(ssh.SIGTERM): 15,
+}
+
+// BastionHandler bridges sessions to an upstream ssh host taken from the payload,
+// the upstream user is resolved by the policy
+type BastionHandler struct {
+	sync.Mutex
+	signer       ssh.Signer
+	knownHosts   []KnownHost
+	allowedHosts []string
+	policy       ExecPolicy
+	session      *ssh.Session
+	log          *logrus.Entry
+	cancel       context.CancelFunc
+}
+
+// BastionHandlerOptions keeps options for a new handler instance
+type BastionHandlerOptions struct {
+	// Signer is a proxy-held key, the agent forwarded by the client is tried after it
+	Signer ssh.Signer
+
+	// KnownHosts are trusted keys of upstream hosts, a key is accepted only
+	// for hosts it's listed for
+	KnownHosts []KnownHost
+
+	// AllowedHosts is a whitelist of upstream host patterns (eg. 10.0.1.*, *.vm.example.com)
+	AllowedHosts []string
+
+	Policy ExecPolicy
+}
+
+// NewBastionHandler creates handler for upstream ssh sessions
+func NewBastionHandler(opts BastionHandlerOptions) (*BastionHandler, error) {
+	if len(opts.KnownHosts) == 0 {
+		return nil, errors.New("Known hosts cannot be empty")
+	}
+
+	if len(opts.AllowedHosts) == 0 {
+		return nil, errors.New("Allowed hosts cannot be empty")
+	}
+
+	for _, pattern := range opts.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid allowed host pattern '%s' (%s)", pattern, err)
+		}
+	}
+
+	handler := &BastionHandler{
+		signer:       opts.Signer,
+		knownHosts:   opts.KnownHosts,
+		allowedHosts: opts.AllowedHosts,
+		policy:       opts.Policy,
+		log:          utils.NewLogEntry("handler.bastion"),
+	}
+
+	return handler, nil
+}
+
+// Handle given request, connecting to the upstream host and start a session on it
+func (h *BastionHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	exec, err := h.policy.resolve(req.Payload)
+	if err != nil {
+		return errResponse, err
+	}
+
+	if exec.privileged {
+		return errResponse, errors.New("Privileged session cannot be used with bastion")
+	}
+
+	addr, err := h.upstreamAddr(req.Payload.Host)
+	if err != nil {
+		return errResponse, err
+	}
+
+	var agentConn io.Closer
+	defer func() {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+	}()
+
+	auth := make([]ssh.AuthMethod, 0)
+	if h.signer != nil {
+		auth = append(auth, ssh.PublicKeys(h.signer))
+	}
+
+	if req.Agent != nil {
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := req.Agent()
+			if err != nil {
+				return nil, err
+			}
+			agentConn = conn
+
+			signers, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				return nil, fmt.Errorf("Could not list agent keys (%s)", err)
+			}
+			return signers, nil
+		}))
+	}
+
+	if len(auth) == 0 {
+		return errResponse, errors.New("Neither proxy key nor forwarded agent is available for upstream authentication")
+	}
+
+	config := &ssh.ClientConfig{
+		User:            exec.user,
+		Auth:            auth,
+		HostKeyCallback: h.checkHostKey,
+	}
+
+	tcpConn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not connect to upstream %s (%s)", addr, err)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(tcpConn, addr, config)
+	if err != nil {
+		tcpConn.Close()
+		return errResponse, fmt.Errorf("Could not handshake with upstream %s (%s)", addr, err)
+	}
+
+	// agent is required only while authenticating
+	if agentConn != nil {
+		agentConn.Close()
+		agentConn = nil
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	h.log = h.log.WithField("upstream", addr)
+	h.log.Infof("Connected to upstream as %s", exec.user)
+
+	return h.startSession(ctx, client, exec, req)
+}
+
+func (h *BastionHandler) startSession(ctx context.Context, client *ssh.Client, exec execOptions, req *Request) (Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.cancel = cancel
+
+	session, err := client.NewSession()
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not open upstream session (%s)", err)
+	}
+	defer session.Close()
+
+	if req.Tty != nil {
+		if err := session.RequestPty(req.Tty.Term, int(req.Tty.Height), int(req.Tty.Width), ssh.TerminalModes{}); err != nil {
+			return errResponse, fmt.Errorf("Could not request upstream pty (%s)", err)
+		}
+	}
+
+	// ssh stdin may never be closed, so it's copied outside of the session
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return errResponse, err
+	}
+	session.Stdout = req.Stdout
+	session.Stderr = req.Stderr
+
+	command := req.Exec
+	if exec.workingDir != "" {
+		if command == "" {
+			command = `exec "$SHELL" -l`
+		}
+		command = fmt.Sprintf("cd %s && %s", shellQuote(exec.workingDir), command)
+	}
+
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not start upstream session (%s)", err)
+	}
+
+	h.setSession(session)
+
+	go func() {
+		io.Copy(stdin, req.Stdin)
+		stdin.Close()
+	}()
+
+	h.log.Debugf("Upstream session started (%s)", command)
+
+	wait := make(chan error, 1)
+	go func() {
+		wait <- session.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		// the session is cut off (eg. by the maximum duration), reported like a hung up shell
+		h.log.Debugf("Context done")
+		return Response{Code: 128 + signalNumbers[string(ssh.SIGHUP)]}, nil
+
+	case err := <-wait:
+		code, err := upstreamExitCode(err)
+		if err != nil {
+			return errResponse, fmt.Errorf("Could not wait upstream session (%s)", err)
+		}
+
+		h.log.Debugf("Upstream session exited with code %d", code)
+
+		return Response{Code: code}, nil
+	}
+}
+
+// upstreamAddr validates the payload host against allowed patterns and adds the default port
+func (h *BastionHandler) upstreamAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("Payload must contain upstream host")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, DefaultBastionPort
+	}
+
+	for _, pattern := range h.allowedHosts {
+		if matched, _ := path.Match(pattern, host); matched {
+			return net.JoinHostPort(host, port), nil
+		}
+	}
+
+	return "", fmt.Errorf("Upstream host '%s' is not allowed by policy", host)
+}
+
+func (h *BastionHandler) checkHostKey(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	return checkKnownHost(h.knownHosts, hostname, key)
+}
+
+// upstreamExitCode converts the session exit status into a shell-like exit code
+func upstreamExitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok {
+		return 0, err
+	}
+
+	if exitErr.Signal() != "" {
+		if number, ok := signalNumbers[exitErr.Signal()]; ok {
+			return 128 + number, nil
+		}
+		return errResponse.Code, nil
+	}
+
+	return exitErr.ExitStatus(), nil
+}
+
+// Resize upstream tty, ignored if current request haven't tty
+func (h *BastionHandler) Resize(req *Resize) error {
+	session := h.getSession()
+	if req != nil && session != nil {
+		if err := session.WindowChange(int(req.Height), int(req.Width)); err != nil {
+			return fmt.Errorf("Could not resize upstream tty (%s)", err)
+		}
+		h.log.Debugf("Tty resized to %dx%d", req.Width, req.Height)
+	}
+	return nil
+}
+
+// Signal delivers the signal to the upstream session
+func (h *BastionHandler) Signal(name string) error {
+	session := h.getSession()
+	if session == nil {
+		return errors.New("Upstream session is not started")
+	}
+
+	if err := session.Signal(ssh.Signal(name)); err != nil {
+		return fmt.Errorf("Could not send signal %s to upstream (%s)", name, err)
+	}
+
+	h.log.Debugf("Signal %s sent to upstream", name)
+
+	return nil
+}
+
+// Close current session
+func (h *BastionHandler) Close() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+func (h *BastionHandler) getSession() *ssh.Session {
+	h.Lock()
+	defer h.Unlock()
+	return h.session
+}
+
+func (h *BastionHandler) setSession(session *ssh.Session) {
+	h.Lock()
+	defer h.Unlock()
+	h.session = session
+}
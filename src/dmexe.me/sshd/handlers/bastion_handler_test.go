@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"dmexe.me/payloads"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(private)
+	require.NoError(t, err)
+
+	return signer
+}
+
+// newFakeUpstream serves ssh sessions, the session prints the user and the command,
+// reports pty and resize requests, exits with the code passed as "exit N" and
+// exits by a signal received from the client
+func newFakeUpstream(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, fmt.Errorf("Unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			tcpConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeUpstream(tcpConn, config)
+		}
+	}()
+
+	return listener
+}
+
+func serveFakeUpstream(tcpConn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		exit := func(name string, payload []byte) {
+			ch.SendRequest(name, false, payload)
+			ch.Close()
+		}
+
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, err := ch.Read(buf)
+				if err != nil {
+					return
+				}
+
+				var code uint32
+				if _, err := fmt.Sscanf(string(buf[:n]), "exit %d", &code); err == nil {
+					exit("exit-status", ssh.Marshal(struct{ Code uint32 }{code}))
+					return
+				}
+				ch.Write(buf[:n])
+			}
+		}()
+
+		for req := range requests {
+			switch req.Type {
+			case "pty-req":
+				pty := struct {
+					Term          string
+					Width, Height uint32
+					PxW, PxH      uint32
+					Modes         string
+				}{}
+				ssh.Unmarshal(req.Payload, &pty)
+				fmt.Fprintf(ch, "pty %s %dx%d\n", pty.Term, pty.Width, pty.Height)
+
+			case "window-change":
+				size := struct{ Width, Height, PxW, PxH uint32 }{}
+				ssh.Unmarshal(req.Payload, &size)
+				fmt.Fprintf(ch, "resize %dx%d\n", size.Width, size.Height)
+
+			case "exec", "shell":
+				command := struct{ Command string }{}
+				ssh.Unmarshal(req.Payload, &command)
+				fmt.Fprintf(ch, "user=%s command=%s\n", sshConn.User(), command.Command)
+
+			case "signal":
+				signal := struct{ Name string }{}
+				ssh.Unmarshal(req.Payload, &signal)
+				exit("exit-signal", ssh.Marshal(struct {
+					Name       string
+					CoreDumped bool
+					Message    string
+					Lang       string
+				}{Name: signal.Name}))
+			}
+
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+		}
+	}
+}
+
+func Test_BastionHandler(t *testing.T) {
+	hostKey := newTestSigner(t)
+	clientPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	clientKey, err := ssh.NewSignerFromKey(clientPrivate)
+	require.NoError(t, err)
+
+	// keyring of the agent forwarded by the client
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: clientPrivate}))
+
+	upstream := newFakeUpstream(t, hostKey, clientKey.PublicKey())
+	defer upstream.Close()
+
+	knownHosts := []KnownHost{{Patterns: []string{knownHostName(upstream.Addr().String())}, Key: hostKey.PublicKey()}}
+
+	newTestHandler := func(signer ssh.Signer) *BastionHandler {
+		handler, err := NewBastionHandler(BastionHandlerOptions{
+			Signer:       signer,
+			KnownHosts:   knownHosts,
+			AllowedHosts: []string{"127.0.0.*"},
+			Policy:       ExecPolicy{DefaultUser: "app"},
+		})
+		require.NoError(t, err)
+		return handler
+	}
+
+	payload := payloads.Payload{Host: upstream.Addr().String()}
+
+	t.Run("should exec using proxy key", func(t *testing.T) {
+		handler := newTestHandler(clientKey)
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+
+		req := &Request{
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  stdout,
+			Exec:    "cat",
+			Payload: payload,
+		}
+
+		go func() {
+			input.Write([]byte("exit 3"))
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 3, response.Code)
+		require.Equal(t, "user=app command=cat\n", stdout.String())
+	})
+
+	t.Run("should run shell with tty using forwarded agent", func(t *testing.T) {
+		handler := newTestHandler(nil)
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+
+		req := &Request{
+			Tty:    &Tty{Term: "xterm", Width: 80, Height: 24},
+			Stdin:  stdin,
+			Stdout: stdout,
+			Stderr: stdout,
+			Payload: payloads.Payload{
+				Host:       upstream.Addr().String(),
+				WorkingDir: "/app",
+			},
+			Agent: func() (io.ReadWriteCloser, error) {
+				client, server := net.Pipe()
+				go agent.ServeAgent(keyring, server)
+				return client, nil
+			},
+		}
+
+		go func() {
+			for handler.getSession() == nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+			require.NoError(t, handler.Resize(&Resize{Width: 100, Height: 40}))
+			time.Sleep(50 * time.Millisecond)
+			input.Write([]byte("exit 0"))
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 0, response.Code)
+		require.Equal(t, "pty xterm 80x24\nuser=app command=cd '/app' && exec \"$SHELL\" -l\nresize 100x40\n", stdout.String())
+	})
+
+	t.Run("should exit by signal", func(t *testing.T) {
+		handler := newTestHandler(clientKey)
+		defer handler.Close()
+
+		stdin, _ := io.Pipe()
+
+		req := &Request{
+			Stdin:   stdin,
+			Stdout:  new(bytes.Buffer),
+			Stderr:  new(bytes.Buffer),
+			Exec:    "sleep 10",
+			Payload: payload,
+		}
+
+		go func() {
+			for handler.getSession() == nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+			require.NoError(t, handler.Signal("TERM"))
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 143, response.Code)
+	})
+
+	t.Run("should exit as hung up when context is done", func(t *testing.T) {
+		handler := newTestHandler(clientKey)
+		defer handler.Close()
+
+		stdin, _ := io.Pipe()
+
+		req := &Request{
+			Stdin:   stdin,
+			Stdout:  new(bytes.Buffer),
+			Stderr:  new(bytes.Buffer),
+			Exec:    "sleep 10",
+			Payload: payload,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		response, err := handler.Handle(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, 129, response.Code)
+	})
+
+	t.Run("fail when host is not allowed", func(t *testing.T) {
+		handler := newTestHandler(clientKey)
+		defer handler.Close()
+
+		_, err := handler.Handle(context.Background(), &Request{Payload: payloads.Payload{Host: "10.0.0.1"}})
+		require.EqualError(t, err, "Upstream host '10.0.0.1' is not allowed by policy")
+	})
+
+	t.Run("fail when credentials not available", func(t *testing.T) {
+		handler := newTestHandler(nil)
+		defer handler.Close()
+
+		_, err := handler.Handle(context.Background(), &Request{Payload: payload})
+		require.EqualError(t, err, "Neither proxy key nor forwarded agent is available for upstream authentication")
+	})
+
+	t.Run("fail on unknown host key", func(t *testing.T) {
+		cases := [][]KnownHost{
+			{{Patterns: []string{knownHostName(upstream.Addr().String())}, Key: clientKey.PublicKey()}},
+			{{Patterns: []string{"vm-1.example.com"}, Key: hostKey.PublicKey()}},
+		}
+
+		for _, hosts := range cases {
+			handler, err := NewBastionHandler(BastionHandlerOptions{
+				Signer:       clientKey,
+				KnownHosts:   hosts,
+				AllowedHosts: []string{"127.0.0.1"},
+			})
+			require.NoError(t, err)
+			defer handler.Close()
+
+			_, err = handler.Handle(context.Background(), &Request{Payload: payload})
+			require.Error(t, err)
+			require.True(t, strings.Contains(err.Error(), "Unknown host key of upstream"))
+		}
+	})
+}
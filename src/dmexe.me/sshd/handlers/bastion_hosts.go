@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// KnownHost is a trusted key of upstream hosts matching the patterns,
+// revoked keys are rejected for all hosts
+type KnownHost struct {
+	Patterns []string
+	Key      ssh.PublicKey
+	Revoked  bool
+}
+
+// ParseKnownHosts reads upstream host keys in known_hosts format, plain and hashed
+// host names, [host]:port and wildcards are supported, negated patterns and
+// certificate authorities are rejected since they cannot be verified
+func ParseKnownHosts(filename string) ([]KnownHost, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]KnownHost, 0)
+	for {
+		marker, patterns, key, _, rest, err := ssh.ParseKnownHosts(raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw = rest
+
+		if marker != "" && marker != "revoked" {
+			return nil, fmt.Errorf("Unsupported known hosts marker @%s", marker)
+		}
+
+		for _, pattern := range patterns {
+			if strings.HasPrefix(pattern, "!") {
+				return nil, fmt.Errorf("Unsupported negated known hosts pattern '%s'", pattern)
+			}
+		}
+
+		hosts = append(hosts, KnownHost{Patterns: patterns, Key: key, Revoked: marker == "revoked"})
+	}
+
+	if len(hosts) == 0 {
+		return nil, errors.New("No host keys found")
+	}
+
+	return hosts, nil
+}
+
+// knownHostName converts the dial address to known_hosts notation, the default port is omitted
+func knownHostName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// matches checks the host name against the entry patterns
+func (k KnownHost) matches(hostname string) bool {
+	for _, pattern := range k.Patterns {
+		if strings.HasPrefix(pattern, "|1|") {
+			if matchHashedHost(pattern, hostname) {
+				return true
+			}
+			continue
+		}
+
+		if matchHostPattern(pattern, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostPattern supports * and ? wildcards, brackets of [host]:port are literal
+func matchHostPattern(pattern string, hostname string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, "\\*", ".*", -1)
+	expr = strings.Replace(expr, "\\?", ".", -1)
+
+	matched, _ := regexp.MatchString("^"+expr+"$", hostname)
+	return matched
+}
+
+// matchHashedHost checks |1|salt|hash entries written by ssh-keygen -H
+func matchHashedHost(pattern string, hostname string) bool {
+	fields := strings.Split(pattern, "|")
+	if len(fields) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(hostname))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// checkKnownHost accepts the key only when it's trusted for this host
+func checkKnownHost(hosts []KnownHost, addr string, key ssh.PublicKey) error {
+	hostname := knownHostName(addr)
+	marshaled := key.Marshal()
+
+	for _, known := range hosts {
+		if known.Revoked && bytes.Equal(known.Key.Marshal(), marshaled) {
+			return fmt.Errorf("Host key of upstream %s is revoked", addr)
+		}
+	}
+
+	for _, known := range hosts {
+		if !known.Revoked && known.matches(hostname) && bytes.Equal(known.Key.Marshal(), marshaled) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown host key of upstream %s", addr)
+}
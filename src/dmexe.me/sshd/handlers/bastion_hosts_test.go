@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_KnownHosts(t *testing.T) {
+	first := newTestSigner(t).PublicKey()
+	second := newTestSigner(t).PublicKey()
+	revoked := newTestSigner(t).PublicKey()
+
+	line := func(prefix string, key ssh.PublicKey) string {
+		return prefix + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + "\n"
+	}
+
+	hashed := func(hostname string) string {
+		salt := []byte("0123456789abcdef0123")
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(hostname))
+		return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	parse := func(content string) ([]KnownHost, error) {
+		file, err := ioutil.TempFile("", "known_hosts")
+		require.NoError(t, err)
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(content)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		return ParseKnownHosts(file.Name())
+	}
+
+	t.Run("should check keys by host names", func(t *testing.T) {
+		hosts, err := parse("# upstream hosts\n" +
+			line("vm-1.example.com,10.0.0.1", first) +
+			line("[vm-2.example.com]:2222", second) +
+			line("*.db.example.com", second) +
+			line(hashed("vm-3.example.com"), first) +
+			line("@revoked *", revoked))
+		require.NoError(t, err)
+		require.Len(t, hosts, 5)
+
+		require.NoError(t, checkKnownHost(hosts, "vm-1.example.com:22", first))
+		require.NoError(t, checkKnownHost(hosts, "10.0.0.1:22", first))
+		require.NoError(t, checkKnownHost(hosts, "vm-2.example.com:2222", second))
+		require.NoError(t, checkKnownHost(hosts, "a.db.example.com:22", second))
+		require.NoError(t, checkKnownHost(hosts, "vm-3.example.com:22", first))
+
+		require.EqualError(t, checkKnownHost(hosts, "vm-1.example.com:22", second), "Unknown host key of upstream vm-1.example.com:22")
+		require.EqualError(t, checkKnownHost(hosts, "vm-2.example.com:22", second), "Unknown host key of upstream vm-2.example.com:22")
+		require.EqualError(t, checkKnownHost(hosts, "vm-3.example.com:2222", first), "Unknown host key of upstream vm-3.example.com:2222")
+		require.EqualError(t, checkKnownHost(hosts, "vm-1.example.com:22", revoked), "Host key of upstream vm-1.example.com:22 is revoked")
+	})
+
+	t.Run("fail on unsupported entries", func(t *testing.T) {
+		_, err := parse(line("@cert-authority *.example.com", first))
+		require.EqualError(t, err, "Unsupported known hosts marker @cert-authority")
+
+		_, err = parse(line("!vm-1.example.com,*.example.com", first))
+		require.EqualError(t, err, "Unsupported negated known hosts pattern '!vm-1.example.com'")
+
+		_, err = parse("# empty\n")
+		require.EqualError(t, err, "No host keys found")
+	})
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"dmexe.me/payloads"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// agentHostPlaceholder is replaced by the agent host in the endpoint template
+const agentHostPlaceholder = "{host}"
+
+// AgentLocator finds the agent host running the task referenced by the payload
+type AgentLocator interface {
+	LocateAgent(payload payloads.Payload) (string, bool)
+}
+
+// AgentEndpointsOptions keeps options for a new agent endpoints instance
+type AgentEndpointsOptions struct {
+	// Endpoint is a docker url template of agents (eg. tcp://{host}:2376)
+	Endpoint string
+
+	// CertPath is a directory with cert.pem, key.pem and ca.pem, used for all agents
+	CertPath string
+
+	Locator AgentLocator
+}
+
+// AgentEndpoints routes sessions to docker daemons on agents running the tasks,
+// clients are created once per agent host and shared between sessions
+type AgentEndpoints struct {
+	sync.Mutex
+	endpoint string
+	certPath string
+	locator  AgentLocator
+	cached   map[string]DockerEndpoint
+}
+
+// NewAgentEndpoints creates a new agent router using given options
+func NewAgentEndpoints(opts AgentEndpointsOptions) (*AgentEndpoints, error) {
+	if opts.Locator == nil {
+		return nil, errors.New("Locator cannot be nil")
+	}
+
+	if !strings.Contains(opts.Endpoint, agentHostPlaceholder) {
+		return nil, fmt.Errorf("Agent endpoint must contain %s placeholder, got '%s'", agentHostPlaceholder, opts.Endpoint)
+	}
+
+	agents := &AgentEndpoints{
+		endpoint: opts.Endpoint,
+		certPath: opts.CertPath,
+		locator:  opts.Locator,
+		cached:   make(map[string]DockerEndpoint),
+	}
+
+	return agents, nil
+}
+
+// Route returns the endpoint of the agent running the task, returns false when the task is unknown
+func (a *AgentEndpoints) Route(payload payloads.Payload) (DockerEndpoint, bool, error) {
+	host, ok := a.locator.LocateAgent(payload)
+	if !ok {
+		return DockerEndpoint{}, false, nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if endpoint, ok := a.cached[host]; ok {
+		return endpoint, true, nil
+	}
+
+	endpoint, err := NewDockerEndpoint(DockerEndpointOptions{
+		Name:     host,
+		Endpoint: strings.Replace(a.endpoint, agentHostPlaceholder, agentURLHost(host), -1),
+		CertPath: a.certPath,
+	})
+	if err != nil {
+		return DockerEndpoint{}, false, err
+	}
+
+	a.cached[host] = endpoint
+	return endpoint, true, nil
+}
+
+// agentURLHost formats the host for the endpoint url, IPv6 addresses are bracketed
+func agentURLHost(host string) string {
+	return strings.TrimSuffix(net.JoinHostPort(strings.Trim(host, "[]"), ""), ":")
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"dmexe.me/payloads"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type testAgentLocator map[string]string
+
+func (l testAgentLocator) LocateAgent(payload payloads.Payload) (string, bool) {
+	host, ok := l[payload.ContainerEnv]
+	return host, ok
+}
+
+func Test_AgentEndpoints(t *testing.T) {
+	locator := testAgentLocator{"MESOS_TASK_ID=app.1": "10.0.0.1"}
+
+	t.Run("should route to agent", func(t *testing.T) {
+		agents, err := NewAgentEndpoints(AgentEndpointsOptions{
+			Endpoint: "tcp://{host}:2375",
+			Locator:  locator,
+		})
+		require.NoError(t, err)
+
+		endpoint, ok, err := agents.Route(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "10.0.0.1", endpoint.Name)
+
+		cached, ok, err := agents.Route(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, endpoint, cached)
+		require.Len(t, agents.cached, 1)
+	})
+
+	t.Run("return false for unknown tasks", func(t *testing.T) {
+		agents, err := NewAgentEndpoints(AgentEndpointsOptions{
+			Endpoint: "tcp://{host}:2375",
+			Locator:  locator,
+		})
+		require.NoError(t, err)
+
+		_, ok, err := agents.Route(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.2"})
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("fail without host placeholder", func(t *testing.T) {
+		_, err := NewAgentEndpoints(AgentEndpointsOptions{
+			Endpoint: "tcp://10.0.0.1:2375",
+			Locator:  locator,
+		})
+		require.EqualError(t, err, "Agent endpoint must contain {host} placeholder, got 'tcp://10.0.0.1:2375'")
+	})
+}
+
+func Test_AgentURLHost(t *testing.T) {
+	t.Run("should keep hostnames and IPv4 addresses", func(t *testing.T) {
+		require.Equal(t, "10.0.0.1", agentURLHost("10.0.0.1"))
+		require.Equal(t, "agent-1.example.com", agentURLHost("agent-1.example.com"))
+	})
+
+	t.Run("should bracket IPv6 addresses", func(t *testing.T) {
+		require.Equal(t, "[fd00::1]", agentURLHost("fd00::1"))
+		require.Equal(t, "[fd00::1]", agentURLHost("[fd00::1]"))
+	})
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultDetachKeys is a key sequence used to detach from the main process
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// AttachOptions keeps options for the attach mode
+type AttachOptions struct {
+	// DetachKeys is a key sequence in docker format (eg. ctrl-p,ctrl-q)
+	DetachKeys string
+
+	// ReadOnly doesn't forward stdin to the main process
+	ReadOnly bool
+}
+
+// startAttachSession attaches to stdin/stdout of the container main process,
+// the session ends when the detach key sequence received or the process exited,
+// the session user must be the main process user. Sessions allowed to read-only tokens
+// get the raw client input, so the detach key sequence is read before the input is dropped
+func (h *DockerHandler) startAttachSession(ctx context.Context, container *docker.Container, exec execOptions, req *Request) (Response, error) {
+	mainUser := container.Config.User
+	if mainUser == "" {
+		mainUser = "root"
+	}
+
+	if exec.user != mainUser {
+		return errResponse, fmt.Errorf("User '%s' cannot attach to the main process of user '%s'", exec.user, mainUser)
+	}
+
+	readOnly := h.attach.ReadOnly || req.Payload.Policy.ReadOnly
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	h.cancel = cancel
+	h.container = container
+	h.attached = container
+
+	detachKeys := h.attach.DetachKeys
+	if detachKeys == "" {
+		detachKeys = DefaultDetachKeys
+	}
+
+	keys, err := parseDetachKeys(detachKeys)
+	if err != nil {
+		return errResponse, err
+	}
+
+	detach := newDetachReader(req.Stdin, keys)
+	success := make(chan struct{})
+
+	attachOptions := docker.AttachToContainerOptions{
+		Container:    container.ID,
+		OutputStream: req.Stdout,
+		ErrorStream:  req.Stderr,
+		Stream:       true,
+		Stdout:       true,
+		Stderr:       true,
+		RawTerminal:  container.Config.Tty,
+		Success:      success,
+	}
+
+	if readOnly {
+		go discardUntilDone(ctx, detach)
+	} else {
+		attachOptions.Stdin = true
+		attachOptions.InputStream = detach
+	}
+
+	go func() {
+		select {
+		case <-success:
+			success <- struct{}{}
+
+			if req.Tty != nil && container.Config.Tty {
+				if err := h.Resize(req.Tty.Resize()); err != nil {
+					h.log.Errorf("Could not resize tty (%s)", err)
+				}
+			}
+		}
+	}()
+
+	closer, err := h.cli.AttachToContainerNonBlocking(attachOptions)
+	if err != nil {
+		return errResponse, err
+	}
+
+	h.log.Infof("Attached to container (%s) read only=%t", container.ID[:10], readOnly)
+
+	complete := make(chan error)
+
+	go func() {
+		complete <- closer.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		h.log.Debugf("Context done")
+		if err := closer.Close(); err != nil {
+			return errResponse, fmt.Errorf("Could not close attached container=%s (%s)", container.ID[:10], err)
+		}
+		return Response{Code: 0}, nil
+
+	case <-detach.Detached():
+		h.log.Debugf("Detached from container (%s)", container.ID[:10])
+		if err := closer.Close(); err != nil {
+			return errResponse, fmt.Errorf("Could not close attached container=%s (%s)", container.ID[:10], err)
+		}
+		return Response{Code: 0}, nil
+
+	case err := <-complete:
+		if err != nil {
+			return errResponse, fmt.Errorf("Could not wait attached container=%s (%s)", container.ID[:10], err)
+		}
+	}
+
+	inspect, err := h.cli.InspectContainer(container.ID)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not inspect container=%s (%s)", container.ID[:10], err)
+	}
+
+	if inspect.State.Running {
+		return Response{Code: 0}, nil
+	}
+
+	h.log.Debugf("Main process exited with code %d", inspect.State.ExitCode)
+
+	return Response{Code: inspect.State.ExitCode}, nil
+}
+
+func (h *DockerHandler) resizeAttached(req *Resize) error {
+	if !h.attached.Config.Tty {
+		return nil
+	}
+
+	if err := h.cli.ResizeContainerTTY(h.attached.ID, int(req.Height), int(req.Width)); err != nil {
+		return fmt.Errorf("Could not resize tty (%s)", err)
+	}
+
+	h.log.Debugf("Container tty resized to %dx%d", req.Width, req.Height)
+	return nil
+}
+
+// discardUntilDone reads the client input to catch the detach key sequence,
+// it stops after the session ends and the pending read returns
+func discardUntilDone(ctx context.Context, reader io.Reader) {
+	buf := make([]byte, 1024)
+	for ctx.Err() == nil {
+		if _, err := reader.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// parseDetachKeys converts a key sequence in docker format into bytes
+func parseDetachKeys(keys string) ([]byte, error) {
+	sequence := make([]byte, 0)
+
+	for _, key := range strings.Split(keys, ",") {
+		switch {
+		case len(key) == 1:
+			sequence = append(sequence, key[0])
+
+		case len(key) == 6 && strings.HasPrefix(key, "ctrl-"):
+			code := key[5]
+			switch {
+			case code >= 'a' && code <= 'z':
+				sequence = append(sequence, code-'a'+1)
+			case code == '@' || code == '[' || code == '\\' || code == ']' || code == '^' || code == '_':
+				sequence = append(sequence, code-'@')
+			default:
+				return nil, fmt.Errorf("Unknown detach key '%s'", key)
+			}
+
+		default:
+			return nil, fmt.Errorf("Unknown detach key '%s'", key)
+		}
+	}
+
+	return sequence, nil
+}
+
+// detachReader proxies reads and stops with io.EOF on the detach key sequence,
+// keys of the sequence are never passed through
+type detachReader struct {
+	sync.Mutex
+	reader   io.Reader
+	keys     []byte
+	matched  int
+	pending  []byte
+	detached chan struct{}
+	closed   bool
+	err      error
+}
+
+func newDetachReader(reader io.Reader, keys []byte) *detachReader {
+	return &detachReader{
+		reader:   reader,
+		keys:     keys,
+		detached: make(chan struct{}),
+	}
+}
+
+// Detached is closed when the detach key sequence received
+func (r *detachReader) Detached() <-chan struct{} {
+	return r.detached
+}
+
+func (r *detachReader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+
+	if r.closed {
+		return 0, io.EOF
+	}
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	buf := make([]byte, len(p))
+	n, err := r.reader.Read(buf)
+
+	out := make([]byte, 0, n)
+	for _, b := range buf[:n] {
+		if b == r.keys[r.matched] {
+			r.matched++
+			if r.matched == len(r.keys) {
+				r.closed = true
+				close(r.detached)
+				break
+			}
+			continue
+		}
+
+		// partially matched sequence isn't a detach, pass it through
+		out = append(out, r.keys[:r.matched]...)
+		r.matched = 0
+
+		if b == r.keys[0] {
+			r.matched = 1
+			continue
+		}
+		out = append(out, b)
+	}
+
+	if err != nil && !r.closed {
+		out = append(out, r.keys[:r.matched]...)
+		r.matched = 0
+	}
+
+	copied := copy(p, out)
+	r.pending = append(r.pending, out[copied:]...)
+
+	if copied == 0 && r.closed {
+		return 0, io.EOF
+	}
+
+	// keep the error until pending bytes are read
+	if len(r.pending) > 0 && err != nil {
+		r.err = err
+		return copied, nil
+	}
+
+	return copied, err
+}
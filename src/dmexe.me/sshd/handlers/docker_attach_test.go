@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_DetachReader(t *testing.T) {
+	keys, err := parseDetachKeys(DefaultDetachKeys)
+	require.NoError(t, err)
+	require.Equal(t, []byte{16, 17}, keys)
+
+	t.Run("should stop on detach keys", func(t *testing.T) {
+		reader := newDetachReader(bytes.NewReader([]byte("echo\x10\x11ignored")), keys)
+
+		bb, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "echo", string(bb))
+
+		select {
+		case <-reader.Detached():
+		default:
+			require.FailNow(t, "Reader is not detached")
+		}
+	})
+
+	t.Run("should pass partially matched keys", func(t *testing.T) {
+		input := []byte("a\x10b\x10\x10c\x10")
+		reader := newDetachReader(iotest.OneByteReader(bytes.NewReader(input)), keys)
+
+		bb, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, input, bb)
+	})
+
+	t.Run("fail on unknown keys", func(t *testing.T) {
+		_, err := parseDetachKeys("ctrl-1")
+		require.EqualError(t, err, "Unknown detach key 'ctrl-1'")
+
+		_, err = parseDetachKeys("ctrl")
+		require.EqualError(t, err, "Unknown detach key 'ctrl'")
+	})
+}
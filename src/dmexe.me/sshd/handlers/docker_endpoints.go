@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"dmexe.me/payloads"
+	"errors"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"path"
+)
+
+// DefaultDockerEndpoint is a name of the endpoint created from the environment
+const DefaultDockerEndpoint = "default"
+
+// DockerEndpoint is a named docker daemon
+type DockerEndpoint struct {
+	Name   string
+	Client *docker.Client
+}
+
+// DockerEndpointOptions keeps options for a new endpoint
+type DockerEndpointOptions struct {
+	Name string
+
+	// Endpoint is a docker daemon url (eg. unix:///var/run/docker.sock, tcp://10.0.0.1:2376)
+	Endpoint string
+
+	// CertPath is a directory with cert.pem, key.pem and ca.pem, used for tcp+tls endpoints
+	CertPath string
+}
+
+// NewDockerEndpoint creates a client for the named docker daemon
+func NewDockerEndpoint(opts DockerEndpointOptions) (DockerEndpoint, error) {
+	if opts.Name == "" {
+		return DockerEndpoint{}, errors.New("Docker endpoint name cannot be empty")
+	}
+
+	if opts.Endpoint == "" {
+		return DockerEndpoint{}, fmt.Errorf("Docker endpoint '%s' url cannot be empty", opts.Name)
+	}
+
+	var (
+		cli *docker.Client
+		err error
+	)
+
+	if opts.CertPath != "" {
+		cli, err = docker.NewTLSClient(
+			opts.Endpoint,
+			path.Join(opts.CertPath, "cert.pem"),
+			path.Join(opts.CertPath, "key.pem"),
+			path.Join(opts.CertPath, "ca.pem"),
+		)
+	} else {
+		cli, err = docker.NewClient(opts.Endpoint)
+	}
+
+	if err != nil {
+		return DockerEndpoint{}, fmt.Errorf("Could not create docker endpoint '%s' (%s)", opts.Name, err)
+	}
+
+	return DockerEndpoint{Name: opts.Name, Client: cli}, nil
+}
+
+// DockerRouter finds the endpoint of the container referenced by the payload at runtime,
+// returns false when the container is unknown
+type DockerRouter interface {
+	Route(payload payloads.Payload) (DockerEndpoint, bool, error)
+}
+
+// routeEndpoints returns endpoints where the container is looked for,
+// it's the daemon from payload, the routed endpoint or all known daemons
+func (h *DockerHandler) routeEndpoints(payload payloads.Payload) ([]DockerEndpoint, error) {
+	for _, router := range h.routers {
+		endpoint, ok, err := router.Route(payload)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			h.log.Debugf("Container routed to daemon (%s)", endpoint.Name)
+			return []DockerEndpoint{endpoint}, nil
+		}
+	}
+
+	if payload.Daemon != "" {
+		for _, endpoint := range h.endpoints {
+			if endpoint.Name == payload.Daemon {
+				return []DockerEndpoint{endpoint}, nil
+			}
+		}
+		return nil, fmt.Errorf("Unknown docker daemon '%s'", payload.Daemon)
+	}
+
+	return h.endpoints, nil
+}
+
+// matchEndpoints looks for the container in given endpoints, the client of the matched endpoint
+// is used for the rest of the session. Unavailable daemons are skipped while searching
+func (h *DockerHandler) matchEndpoints(endpoints []DockerEndpoint, opts docker.ListContainersOptions, payload payloads.Payload) (*docker.Container, error) {
+	for _, endpoint := range endpoints {
+		matched, err := h.matchContainer(endpoint.Client, opts, payload)
+		if err != nil && len(endpoints) == 1 {
+			return nil, err
+		}
+
+		if err != nil {
+			h.log.Warnf("Could not list containers on daemon=%s (%s)", endpoint.Name, err)
+			continue
+		}
+
+		if matched != nil {
+			h.cli = endpoint.Client
+			h.log = h.log.WithField("daemon", endpoint.Name)
+			return matched, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	docker "github.com/fsouza/go-dockerclient"
-	"github.com/google/shlex"
 	"strings"
 )
 
@@ -17,18 +16,63 @@ import (
 // TODO: implement proper exit code handler
 // TODO: implement proper signal status handler
 type DockerHandler struct {
-	cli       *docker.Client
-	container *docker.Container
-	session   *docker.Exec
-	log       *logrus.Entry
-	cancel    context.CancelFunc
+	cli          *docker.Client
+	endpoints    []DockerEndpoint
+	routers      []DockerRouter
+	container    *docker.Container
+	attached     *docker.Container
+	session      *docker.Exec
+	mode         string
+	sidecarImage string
+	toolbox      *Toolbox
+	shells       []string
+	policy       ExecPolicy
+	attach       AttachOptions
+	postMortem   bool
+	log          *logrus.Entry
+	cancel       context.CancelFunc
 }
 
+const (
+	// DockerModeExec runs docker exec in the matched container
+	DockerModeExec = "exec"
+
+	// DockerModeSidecar runs a throwaway debug container next to the matched container
+	DockerModeSidecar = "sidecar"
+
+	// DockerModeAttach attaches to the main process of the matched container
+	DockerModeAttach = "attach"
+
+	// DockerModeLogs streams logs of the matched container, no shell is available
+	DockerModeLogs = "logs"
+
+	// DefaultSidecarImage is a toolbox image used when no image given
+	DefaultSidecarImage = "alpine"
+)
+
 // DockerHandlerOptions keeps options for a new handler instance
 type DockerHandlerOptions struct {
+	// Client is used as the only endpoint when no endpoints given
 	Client *docker.Client
+
+	// Endpoints are searched in order for the container, unless payload specifies the daemon
+	Endpoints []DockerEndpoint
+
+	// Routers find endpoints of the container at runtime, endpoints are used when nothing routed
+	Routers []DockerRouter
+
+	Mode         string
+	SidecarImage string
+	Toolbox      *Toolbox
+	Shells       []string
+	Policy       ExecPolicy
+	Attach       AttachOptions
+	PostMortem   bool
 }
 
+// DockerModes keeps all known handler modes
+var DockerModes = []string{DockerModeExec, DockerModeSidecar, DockerModeAttach, DockerModeLogs}
+
 // NewDockerClientFromEnv is an alias for docker.NewClientFromEnv()
 func NewDockerClientFromEnv() (*docker.Client, error) {
 	return docker.NewClientFromEnv()
@@ -37,13 +81,50 @@ func NewDockerClientFromEnv() (*docker.Client, error) {
 // NewDockerHandler creates handler for docker requests
 func NewDockerHandler(opts DockerHandlerOptions) (*DockerHandler, error) {
 
-	if opts.Client == nil {
+	endpoints := opts.Endpoints
+	if len(endpoints) == 0 && opts.Client != nil {
+		endpoints = []DockerEndpoint{{Name: DefaultDockerEndpoint, Client: opts.Client}}
+	}
+
+	if len(endpoints) == 0 {
 		return nil, errors.New("Client cannot be nil")
 	}
 
+	mode := opts.Mode
+	if mode == "" {
+		mode = DockerModeExec
+	}
+
+	if !containsString(DockerModes, mode) {
+		return nil, fmt.Errorf("Unknown docker handler mode '%s'", mode)
+	}
+
+	if opts.PostMortem && mode != DockerModeExec {
+		return nil, fmt.Errorf("Post-mortem sessions require exec mode, got '%s'", mode)
+	}
+
+	sidecarImage := opts.SidecarImage
+	if sidecarImage == "" {
+		sidecarImage = DefaultSidecarImage
+	}
+
+	shells := opts.Shells
+	if len(shells) == 0 {
+		shells = DefaultShells
+	}
+
 	handler := &DockerHandler{
-		cli: opts.Client,
-		log: utils.NewLogEntry("handler.docker"),
+		cli:          endpoints[0].Client,
+		endpoints:    endpoints,
+		routers:      opts.Routers,
+		mode:         mode,
+		sidecarImage: sidecarImage,
+		toolbox:      opts.Toolbox,
+		shells:       shells,
+		policy:       opts.Policy,
+		attach:       opts.Attach,
+		postMortem:   opts.PostMortem,
+		log:          utils.NewLogEntry("handler.docker"),
 	}
 
 	return handler, nil
@@ -51,73 +132,153 @@ func NewDockerHandler(opts DockerHandlerOptions) (*DockerHandler, error) {
 
 // Handle given request, looking for container and start docker exec
 func (h *DockerHandler) Handle(ctx context.Context, req *Request) (Response, error) {
-	containers, err := h.cli.ListContainers(docker.ListContainersOptions{})
+	exec, err := h.policy.resolve(req.Payload)
 	if err != nil {
 		return errResponse, err
 	}
 
-	var matched *docker.Container
+	mode := h.sessionMode(req)
 
-	for _, container := range containers {
-		inspect, err := h.cli.InspectContainer(container.ID)
+	matched, err := h.findContainer(mode, req.Payload)
+	if err != nil {
+		return errResponse, err
+	}
+
+	if matched == nil {
+		return errResponse, fmt.Errorf("Could not found container for %v", req.Payload)
+	}
+
+	if !matched.State.Running && mode != DockerModeLogs {
+		if mode != DockerModeExec {
+			return errResponse, fmt.Errorf("Container %s is not running", matched.ID[:10])
+		}
+		return h.startPostMortemSession(ctx, matched, exec, req)
+	}
+
+	if mode == DockerModeSidecar {
+		return h.startSidecarSession(ctx, matched, exec, req)
+	}
+
+	if mode == DockerModeAttach {
+		return h.startAttachSession(ctx, matched, exec, req)
+	}
+
+	if mode == DockerModeLogs {
+		return h.startLogsSession(ctx, matched, req)
+	}
+
+	if err := h.checkUser(matched, exec.user); err != nil {
+		return errResponse, err
+	}
+
+	shell, found := h.discoverShell(matched, exec.user)
+
+	if h.toolbox != nil && !found {
+		injected, err := h.injectToolbox(matched)
 		if err != nil {
 			return errResponse, err
 		}
+		if h.toolbox.remove {
+			defer h.removeToolbox(matched)
+		}
+		shell = injected
+	}
+
+	return h.startSession(ctx, matched, shell, exec, req)
+}
+
+// sessionMode returns the handler mode, logs requests are served in any mode
+func (h *DockerHandler) sessionMode(req *Request) string {
+	if req.Mode == payloads.ModeLogs {
+		return DockerModeLogs
+	}
+	return h.mode
+}
+
+// DockerModeFunc maps requests to session modes, all requests of attach and logs handlers are
+// attach and logs sessions, other handlers serve the logs command as logs session when the token allows logs mode
+func DockerModeFunc(mode string) ModeFunc {
+	return func(policy payloads.Policy, exec string) string {
+		if mode == DockerModeAttach {
+			return payloads.ModeAttach
+		}
 
-		if h.isMatched(inspect, req.Payload) {
-			matched = inspect
-			break
+		if mode == DockerModeLogs {
+			return payloads.ModeLogs
 		}
+
+		fields := strings.Fields(exec)
+		if len(fields) > 0 && fields[0] == logsCommand && policy.AllowsMode(payloads.ModeLogs) {
+			return payloads.ModeLogs
+		}
+
+		return ShellMode(policy, exec)
 	}
+}
 
-	if matched == nil {
-		return errResponse, fmt.Errorf("Could not found container for %v", req.Payload)
+// findContainer looks for a running container on all routed daemons,
+// then for stopped ones when it's allowed
+func (h *DockerHandler) findContainer(mode string, payload payloads.Payload) (*docker.Container, error) {
+	endpoints, err := h.routeEndpoints(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := h.matchEndpoints(endpoints, docker.ListContainersOptions{}, payload)
+	if err != nil || matched != nil {
+		return matched, err
+	}
+
+	if !h.postMortem && mode != DockerModeLogs {
+		return nil, nil
+	}
+
+	return h.matchEndpoints(endpoints, docker.ListContainersOptions{All: true}, payload)
+}
+
+func (h *DockerHandler) matchContainer(cli *docker.Client, opts docker.ListContainersOptions, payload payloads.Payload) (*docker.Container, error) {
+	containers, err := cli.ListContainers(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range containers {
+		inspect, err := cli.InspectContainer(container.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if h.isMatched(inspect, payload) {
+			return inspect, nil
+		}
 	}
 
-	return h.startSession(ctx, matched, req)
+	return nil, nil
 }
 
-func (h *DockerHandler) startSession(ctx context.Context, container *docker.Container, req *Request) (Response, error) {
+func (h *DockerHandler) startSession(ctx context.Context, container *docker.Container, shell containerShell, exec execOptions, req *Request) (Response, error) {
 
 	ctx, cancel := context.WithCancel(ctx)
 
 	h.cancel = cancel
 	h.container = container
 
+	cmdline := shell.cmdline(req)
+
 	createExecOptions := docker.CreateExecOptions{
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
-		Tty:          false,
-		Cmd:          []string{"/bin/sh"},
+		Tty:          req.Tty != nil,
+		Cmd:          cmdline,
+		User:         exec.user,
+		WorkingDir:   exec.workingDir,
+		Privileged:   exec.privileged,
 		Container:    container.ID,
 		Context:      ctx,
 	}
 
-	if req.Tty != nil {
-		createExecOptions.Tty = true
-	}
-
-	if req.Tty != nil && req.Exec == "" {
-		createExecOptions.Cmd = []string{"/usr/bin/env", fmt.Sprintf("TERM=%s", req.Tty.Term), "sh"}
-	}
-
-	if req.Exec != "" {
-		cmdline := []string{"/usr/bin/env"}
-		if req.Tty != nil {
-			cmdline = append(cmdline, fmt.Sprintf("TERM=%s", req.Tty.Term))
-		}
-
-		args, err := shlex.Split(req.Exec)
-		if err != nil {
-			return errResponse, err
-		}
-
-		cmdline = append(cmdline, args...)
-		createExecOptions.Cmd = cmdline
-	}
-
-	h.log.Debugf("Container session with cmdline (%s)", strings.Join(createExecOptions.Cmd, " "))
+	h.log.Debugf("Container session with cmdline (%s) as user %s", strings.Join(createExecOptions.Cmd, " "), exec.user)
 
 	session, err := h.cli.CreateExec(createExecOptions)
 	if err != nil {
@@ -194,21 +355,28 @@ func (h *DockerHandler) startSession(ctx context.Context, container *docker.Cont
 }
 
 func (h *DockerHandler) isMatched(container *docker.Container, payload payloads.Payload) bool {
-	if len(payload.ContainerID) > 8 && strings.HasPrefix(container.ID, payload.ContainerID) {
+	if MatchContainer(container, payload) {
 		h.log.Debugf("Container found (id=%s)", container.ID[:10])
 		return true
 	}
+	return false
+}
+
+// MatchContainer checks that the container is referenced by the payload id, env or label
+func MatchContainer(container *docker.Container, payload payloads.Payload) bool {
+	if len(payload.ContainerID) > 8 && strings.HasPrefix(container.ID, payload.ContainerID) {
+		return true
+	}
 
-	if payload.ContainerEnv != "" {
+	if payload.ContainerEnv != "" && container.Config != nil {
 		for _, env := range container.Config.Env {
 			if env == payload.ContainerEnv {
-				h.log.Debugf("Countainer found (id=%s env=%s)", container.ID[:10], env)
 				return true
 			}
 		}
 	}
 
-	if payload.ContainerLabel != "" {
+	if payload.ContainerLabel != "" && container.Config != nil {
 		fields := strings.FieldsFunc(payload.ContainerLabel, func(r rune) bool {
 			return r == '='
 		})
@@ -219,7 +387,6 @@ func (h *DockerHandler) isMatched(container *docker.Container, payload payloads.
 
 			for name, value := range container.Config.Labels {
 				if name == fieldName && value == fieldValue {
-					h.log.Debugf("Container found (id=%s %s=%s)", container.ID[:10], name, value)
 					return true
 				}
 			}
@@ -231,6 +398,10 @@ func (h *DockerHandler) isMatched(container *docker.Container, payload payloads.
 
 // Resize tty, ignored if current request haven't tty
 func (h *DockerHandler) Resize(req *Resize) error {
+	if req != nil && h.attached != nil {
+		return h.resizeAttached(req)
+	}
+
 	if req != nil && h.session != nil {
 		err := h.cli.ResizeExecTTY(h.session.ID, int(req.Height), int(req.Width))
 		if err != nil {
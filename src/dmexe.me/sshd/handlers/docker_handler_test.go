@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"dmexe.me/payloads"
 	"dmexe.me/utils"
@@ -8,6 +9,7 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"path"
 	"runtime"
 	"testing"
@@ -123,6 +125,446 @@ func Test_DockerHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("should pass exec to shell", func(t *testing.T) {
+		payload := payloads.Payload{
+			ContainerID: container.ID,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler := newTestDockerHandler(t, cli)
+		defer closeTestDockerHandler(t, handler)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:   iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout:  iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr:  iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Exec:    "echo $ENV_NAME | tr a-z A-Z && echo compl\\ete.",
+			Payload: payload,
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		require.NoError(t, pipe.WaitString("complete."))
+		require.Contains(t, pipe.String(), "ENVVALUE\n")
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "Could not wait response within 1s")
+		}
+	})
+
+	t.Run("should run sidecar session", func(t *testing.T) {
+		payload := payloads.Payload{
+			ContainerID: container.ID,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := NewDockerHandler(DockerHandlerOptions{
+			Client: cli,
+			Mode:   DockerModeSidecar,
+			Policy: ExecPolicy{DefaultUser: "root", AllowRoot: true},
+		})
+		require.NoError(t, err)
+		defer closeTestDockerHandler(t, handler)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:   iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout:  iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr:  iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Exec:    "sh -c \"ls -a /target/ ; echo compl\\ete.\"",
+			Payload: payload,
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		require.NoError(t, pipe.WaitString("complete."))
+		require.Contains(t, pipe.String(), ".dockerenv\n")
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(3 * time.Second):
+			require.FailNow(t, "Could not wait response within 3s")
+		}
+
+		sidecars, err := cli.ListContainers(docker.ListContainersOptions{
+			All:     true,
+			Filters: map[string][]string{"label": {sidecarTargetLabel + "=" + container.ID}},
+		})
+		require.NoError(t, err)
+		require.Empty(t, sidecars)
+	})
+
+	t.Run("should run session as user in working directory", func(t *testing.T) {
+		payload := payloads.Payload{
+			ContainerID: container.ID,
+			User:        "nobody",
+			WorkingDir:  "/tmp",
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler := newTestDockerHandler(t, cli)
+		defer closeTestDockerHandler(t, handler)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:   iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout:  iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr:  iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Exec:    "echo $(whoami):$(pwd) compl\\ete.",
+			Payload: payload,
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		require.NoError(t, pipe.WaitString("complete."))
+		require.Contains(t, pipe.String(), "nobody:/tmp complete.\n")
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "Could not wait response within 1s")
+		}
+	})
+
+	t.Run("fail when payload exceeds policy", func(t *testing.T) {
+		handler := newTestDockerHandler(t, cli)
+		defer closeTestDockerHandler(t, handler)
+
+		handleReq := &Request{
+			Exec:    "true",
+			Payload: payloads.Payload{ContainerID: container.ID, User: "root"},
+		}
+
+		resp, err := handler.Handle(context.Background(), handleReq)
+		require.EqualError(t, err, "User 'root' is not allowed by policy")
+		require.Equal(t, 255, resp.Code)
+	})
+
+	t.Run("should attach to main process", func(t *testing.T) {
+		createOptions := docker.CreateContainerOptions{
+			Config: &docker.Config{
+				Image:     "alpine",
+				Cmd:       []string{"cat"},
+				User:      "nobody",
+				OpenStdin: true,
+			},
+		}
+		attached, err := cli.CreateContainer(createOptions)
+		require.NoError(t, err)
+		defer removeTestDockerContainer(t, cli, attached)
+		require.NoError(t, cli.StartContainer(attached.ID, nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := NewDockerHandler(DockerHandlerOptions{
+			Client: cli,
+			Mode:   DockerModeAttach,
+		})
+		require.NoError(t, err)
+		defer closeTestDockerHandler(t, handler)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:  iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout: iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr: iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Payload: payloads.Payload{
+				ContainerID: attached.ID,
+				Policy:      payloads.Policy{Modes: []string{payloads.ModeAttach}},
+			},
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		pipe.SendString("complete.\n")
+		require.NoError(t, pipe.WaitString("complete."))
+		pipe.SendString("\x10\x11")
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "Could not wait response within 1s")
+		}
+
+		inspect, err := cli.InspectContainer(attached.ID)
+		require.NoError(t, err)
+		require.True(t, inspect.State.Running)
+	})
+
+	t.Run("fail to attach as other user", func(t *testing.T) {
+		createOptions := docker.CreateContainerOptions{
+			Config: &docker.Config{
+				Image:     "alpine",
+				Cmd:       []string{"cat"},
+				OpenStdin: true,
+			},
+		}
+		attached, err := cli.CreateContainer(createOptions)
+		require.NoError(t, err)
+		defer removeTestDockerContainer(t, cli, attached)
+		require.NoError(t, cli.StartContainer(attached.ID, nil))
+
+		handler, err := NewDockerHandler(DockerHandlerOptions{
+			Client: cli,
+			Mode:   DockerModeAttach,
+		})
+		require.NoError(t, err)
+		defer closeTestDockerHandler(t, handler)
+
+		handleReq := &Request{
+			Stdin:   bytes.NewReader(nil),
+			Stdout:  ioutil.Discard,
+			Stderr:  ioutil.Discard,
+			Payload: payloads.Payload{ContainerID: attached.ID},
+		}
+
+		resp, err := handler.Handle(context.Background(), handleReq)
+		require.EqualError(t, err, "User 'nobody' cannot attach to the main process of user 'root'")
+		require.Equal(t, 255, resp.Code)
+	})
+
+	t.Run("should stream logs", func(t *testing.T) {
+		createOptions := docker.CreateContainerOptions{
+			Config: &docker.Config{
+				Image: "alpine",
+				Cmd:   []string{"/bin/sh", "-c", "echo compl\\ete. ; exec sleep 60"},
+			},
+		}
+		logged, err := cli.CreateContainer(createOptions)
+		require.NoError(t, err)
+		defer removeTestDockerContainer(t, cli, logged)
+		require.NoError(t, cli.StartContainer(logged.ID, nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := NewDockerHandler(DockerHandlerOptions{
+			Client: cli,
+			Mode:   DockerModeLogs,
+		})
+		require.NoError(t, err)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:   iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout:  iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr:  iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Exec:    "logs --tail 10",
+			Payload: payloads.Payload{ContainerID: logged.ID},
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		require.NoError(t, pipe.WaitString("complete."))
+		require.NoError(t, handler.Close())
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "Could not wait response within 1s")
+		}
+	})
+
+	t.Run("should stream logs of logs requests in exec mode", func(t *testing.T) {
+		createOptions := docker.CreateContainerOptions{
+			Config: &docker.Config{
+				Image: "alpine",
+				Cmd:   []string{"/bin/sh", "-c", "echo compl\\ete. ; exec sleep 60"},
+			},
+		}
+		logged, err := cli.CreateContainer(createOptions)
+		require.NoError(t, err)
+		defer removeTestDockerContainer(t, cli, logged)
+		require.NoError(t, cli.StartContainer(logged.ID, nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler := newTestDockerHandler(t, cli)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:  iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout: iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr: iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Exec:   "logs --tail 10",
+			Mode:   payloads.ModeLogs,
+			Payload: payloads.Payload{
+				ContainerID: logged.ID,
+				Policy:      payloads.Policy{Modes: []string{payloads.ModeLogs}},
+			},
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		require.NoError(t, pipe.WaitString("complete."))
+		require.NoError(t, handler.Close())
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "Could not wait response within 1s")
+		}
+	})
+
+	t.Run("should run post-mortem session", func(t *testing.T) {
+		createOptions := docker.CreateContainerOptions{
+			Config: &docker.Config{
+				Image: "alpine",
+				Cmd:   []string{"/bin/sh", "-c", "echo crashed > /tmp/state ; exit 3"},
+				Env:   []string{"POST_MORTEM=true"},
+			},
+		}
+		crashed, err := cli.CreateContainer(createOptions)
+		require.NoError(t, err)
+		defer removeTestDockerContainer(t, cli, crashed)
+		require.NoError(t, cli.StartContainer(crashed.ID, nil))
+
+		code, err := cli.WaitContainer(crashed.ID)
+		require.NoError(t, err)
+		require.Equal(t, 3, code)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := NewDockerHandler(DockerHandlerOptions{
+			Client:     cli,
+			PostMortem: true,
+		})
+		require.NoError(t, err)
+		defer closeTestDockerHandler(t, handler)
+
+		pipe := utils.NewBufferedPipe()
+
+		handleReq := &Request{
+			Stdin:   iotest.NewReadLogger("[r]: ", pipe.IoReader()),
+			Stdout:  iotest.NewWriteLogger("[w]: ", pipe.IoWriter()),
+			Stderr:  iotest.NewWriteLogger("[e]: ", pipe.IoWriter()),
+			Exec:    "cat /tmp/state ; echo compl\\ete.",
+			Payload: payloads.Payload{ContainerEnv: "POST_MORTEM=true"},
+		}
+
+		response := make(chan testResponse)
+
+		go func() {
+			resp, err := handler.Handle(ctx, handleReq)
+			response <- testResponse{resp, err}
+		}()
+
+		require.NoError(t, pipe.WaitString("complete."))
+		require.Contains(t, pipe.String(), "crashed\n")
+
+		select {
+		case resp := <-response:
+			require.NoError(t, resp.err)
+			require.Equal(t, 0, resp.Response.Code)
+		case <-time.After(3 * time.Second):
+			require.FailNow(t, "Could not wait response within 3s")
+		}
+	})
+
+	t.Run("fail when container is not running", func(t *testing.T) {
+		createOptions := docker.CreateContainerOptions{
+			Config: &docker.Config{
+				Image: "alpine",
+				Cmd:   []string{"true"},
+			},
+		}
+		stopped, err := cli.CreateContainer(createOptions)
+		require.NoError(t, err)
+		defer removeTestDockerContainer(t, cli, stopped)
+
+		handler := newTestDockerHandler(t, cli)
+		defer closeTestDockerHandler(t, handler)
+
+		handleReq := &Request{
+			Exec:    "true",
+			Payload: payloads.Payload{ContainerID: stopped.ID},
+		}
+
+		_, err = handler.Handle(context.Background(), handleReq)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Could not found container for")
+	})
+
+	t.Run("fail on unknown mode", func(t *testing.T) {
+		_, err := NewDockerHandler(DockerHandlerOptions{
+			Client: cli,
+			Mode:   "unknown",
+		})
+		require.EqualError(t, err, "Unknown docker handler mode 'unknown'")
+	})
+
+	t.Run("fail to allow post-mortem sessions in other modes", func(t *testing.T) {
+		for _, mode := range []string{DockerModeSidecar, DockerModeAttach, DockerModeLogs} {
+			_, err := NewDockerHandler(DockerHandlerOptions{
+				Client:     cli,
+				Mode:       mode,
+				PostMortem: true,
+			})
+			require.EqualError(t, err, fmt.Sprintf("Post-mortem sessions require exec mode, got '%s'", mode))
+		}
+	})
+
 	t.Run("should find containers", func(t *testing.T) {
 
 		simpleHandler := func(t *testing.T, payload payloads.Payload) {
@@ -179,6 +621,31 @@ func Test_DockerHandler(t *testing.T) {
 		})
 	})
 
+	t.Run("should route sessions to daemons", func(t *testing.T) {
+		unavailable, err := NewDockerEndpoint(DockerEndpointOptions{
+			Name:     "unavailable",
+			Endpoint: "unix:///var/run/unavailable.sock",
+		})
+		require.NoError(t, err)
+
+		handler, err := NewDockerHandler(DockerHandlerOptions{
+			Endpoints: []DockerEndpoint{unavailable, {Name: "local", Client: cli}},
+		})
+		require.NoError(t, err)
+		defer closeTestDockerHandler(t, handler)
+
+		matched, err := handler.findContainer(DockerModeExec, payloads.Payload{ContainerID: container.ID})
+		require.NoError(t, err)
+		require.Equal(t, container.ID, matched.ID)
+		require.Equal(t, cli, handler.cli)
+
+		_, err = handler.findContainer(DockerModeExec, payloads.Payload{ContainerID: container.ID, Daemon: "unavailable"})
+		require.Error(t, err)
+
+		_, err = handler.findContainer(DockerModeExec, payloads.Payload{ContainerID: container.ID, Daemon: "unknown"})
+		require.EqualError(t, err, "Unknown docker daemon 'unknown'")
+	})
+
 	t.Run("fail when container not found", func(t *testing.T) {
 		handler := newTestDockerHandler(t, cli)
 
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/google/shlex"
+	"io"
+	"strconv"
+	"time"
+)
+
+const logsCommand = "logs"
+
+// logsRequest keeps parsed arguments of the logs command,
+// eg. logs --tail 200 --since 10m --timestamps --stderr
+type logsRequest struct {
+	since      int64
+	tail       string
+	timestamps bool
+	stdout     bool
+	stderr     bool
+	follow     bool
+}
+
+// parseLogsRequest parses the exec string, an empty string means all logs with follow
+func parseLogsRequest(exec string, output io.Writer, now time.Time) (logsRequest, error) {
+	req := logsRequest{}
+
+	args, err := shlex.Split(exec)
+	if err != nil {
+		return req, err
+	}
+
+	if len(args) > 0 && args[0] != logsCommand {
+		return req, fmt.Errorf("Only '%s' command is allowed, got '%s'", logsCommand, args[0])
+	}
+
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	var since string
+	var noFollow bool
+
+	flags := flag.NewFlagSet(logsCommand, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&since, "since", "", "Show logs since timestamp (eg. 2017-01-02T13:23:37Z) or relative (eg. 42m)")
+	flags.StringVar(&req.tail, "tail", "all", "Number of lines to show from the end of the logs")
+	flags.BoolVar(&req.timestamps, "timestamps", false, "Show timestamps")
+	flags.BoolVar(&req.timestamps, "t", false, "Show timestamps (shorthand)")
+	flags.BoolVar(&req.stdout, "stdout", false, "Show stdout only")
+	flags.BoolVar(&req.stderr, "stderr", false, "Show stderr only")
+	flags.BoolVar(&noFollow, "no-follow", false, "Don't follow log output")
+
+	if err := flags.Parse(args); err != nil {
+		return req, err
+	}
+
+	if flags.NArg() > 0 {
+		return req, fmt.Errorf("Unexpected arguments %v", flags.Args())
+	}
+
+	if !req.stdout && !req.stderr {
+		req.stdout = true
+		req.stderr = true
+	}
+
+	if req.tail != "all" {
+		if _, err := strconv.ParseUint(req.tail, 10, 32); err != nil {
+			return req, fmt.Errorf("Invalid tail value '%s'", req.tail)
+		}
+	}
+
+	if since != "" {
+		req.since, err = parseLogsSince(since, now)
+		if err != nil {
+			return req, err
+		}
+	}
+
+	req.follow = !noFollow
+
+	return req, nil
+}
+
+// parseLogsSince accepts a relative duration, RFC3339 timestamp or unix time
+func parseLogsSince(since string, now time.Time) (int64, error) {
+	if duration, err := time.ParseDuration(since); err == nil {
+		return now.Add(-duration).Unix(), nil
+	}
+
+	if ts, err := time.Parse(time.RFC3339, since); err == nil {
+		return ts.Unix(), nil
+	}
+
+	if ts, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return ts, nil
+	}
+
+	return 0, fmt.Errorf("Invalid since value '%s'", since)
+}
+
+// startLogsSession streams container logs into the session, stdin is ignored
+func (h *DockerHandler) startLogsSession(ctx context.Context, container *docker.Container, req *Request) (Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.cancel = cancel
+	h.container = container
+
+	logsReq, err := parseLogsRequest(req.Exec, req.Stderr, time.Now())
+	if err == flag.ErrHelp {
+		return Response{Code: 0}, nil
+	}
+
+	if err != nil {
+		fmt.Fprintf(req.Stderr, "%s\n", err)
+		return Response{Code: 2}, nil
+	}
+
+	logsOptions := docker.LogsOptions{
+		Context:      ctx,
+		Container:    container.ID,
+		OutputStream: req.Stdout,
+		ErrorStream:  req.Stderr,
+		Follow:       logsReq.follow,
+		Stdout:       logsReq.stdout,
+		Stderr:       logsReq.stderr,
+		Since:        logsReq.since,
+		Timestamps:   logsReq.timestamps,
+		Tail:         logsReq.tail,
+		RawTerminal:  container.Config.Tty,
+	}
+
+	h.log.Infof("Container logs streaming (%s) tail=%s follow=%t", container.ID[:10], logsReq.tail, logsReq.follow)
+
+	complete := make(chan error)
+
+	go func() {
+		complete <- h.cli.Logs(logsOptions)
+	}()
+
+	select {
+	case <-ctx.Done():
+		h.log.Debugf("Context done")
+	case err := <-complete:
+		if err != nil && ctx.Err() == nil {
+			return errResponse, fmt.Errorf("Could not stream logs container=%s (%s)", container.ID[:10], err)
+		}
+	}
+
+	return Response{Code: 0}, nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"dmexe.me/payloads"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func Test_LogsRequest(t *testing.T) {
+	now := time.Unix(1487000000, 0)
+
+	t.Run("should use defaults", func(t *testing.T) {
+		req, err := parseLogsRequest("", ioutil.Discard, now)
+		require.NoError(t, err)
+		require.Equal(t, logsRequest{tail: "all", stdout: true, stderr: true, follow: true}, req)
+	})
+
+	t.Run("should parse arguments", func(t *testing.T) {
+		req, err := parseLogsRequest("logs --tail 200 --since 10m -t --stderr --no-follow", ioutil.Discard, now)
+		require.NoError(t, err)
+		require.Equal(t, logsRequest{since: 1486999400, tail: "200", timestamps: true, stderr: true}, req)
+
+		req, err = parseLogsRequest("logs --since 2017-02-13T15:33:20Z", ioutil.Discard, now)
+		require.NoError(t, err)
+		require.Equal(t, int64(1487000000), req.since)
+
+		req, err = parseLogsRequest("logs --since 1486999999", ioutil.Discard, now)
+		require.NoError(t, err)
+		require.Equal(t, int64(1486999999), req.since)
+	})
+
+	t.Run("fail on invalid arguments", func(t *testing.T) {
+		_, err := parseLogsRequest("sh", ioutil.Discard, now)
+		require.EqualError(t, err, "Only 'logs' command is allowed, got 'sh'")
+
+		_, err = parseLogsRequest("logs --tail x", ioutil.Discard, now)
+		require.EqualError(t, err, "Invalid tail value 'x'")
+
+		_, err = parseLogsRequest("logs --since yesterday", ioutil.Discard, now)
+		require.EqualError(t, err, "Invalid since value 'yesterday'")
+
+		_, err = parseLogsRequest("logs extra", ioutil.Discard, now)
+		require.EqualError(t, err, "Unexpected arguments [extra]")
+
+		_, err = parseLogsRequest("logs --unknown", ioutil.Discard, now)
+		require.Error(t, err)
+	})
+}
+
+func Test_DockerModeFunc(t *testing.T) {
+	logs := payloads.Policy{Modes: []string{payloads.ModeLogs}}
+
+	t.Run("should map logs command when token allows logs", func(t *testing.T) {
+		modeFunc := DockerModeFunc(DockerModeExec)
+
+		require.Equal(t, payloads.ModeLogs, modeFunc(logs, "logs --tail 10"))
+		require.Equal(t, payloads.ModeExec, modeFunc(logs, "ls"))
+		require.Equal(t, payloads.ModeShell, modeFunc(logs, ""))
+		require.Equal(t, payloads.ModeExec, modeFunc(payloads.Policy{}, "logs --tail 10"))
+	})
+
+	t.Run("should map all requests in logs and attach modes", func(t *testing.T) {
+		modeFunc := DockerModeFunc(DockerModeLogs)
+
+		require.Equal(t, payloads.ModeLogs, modeFunc(payloads.Policy{}, ""))
+		require.Equal(t, payloads.ModeLogs, modeFunc(logs, "logs"))
+
+		modeFunc = DockerModeFunc(DockerModeAttach)
+
+		require.Equal(t, payloads.ModeAttach, modeFunc(payloads.Policy{}, ""))
+		require.Equal(t, payloads.ModeAttach, modeFunc(logs, "logs"))
+	})
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+const postMortemRepository = "dmexe-postmortem"
+
+// startPostMortemSession commits the filesystem of a stopped container into a temporary image,
+// and runs the session as a throwaway container with a shell entrypoint, both are removed afterward.
+// The throwaway container has no network.
+func (h *DockerHandler) startPostMortemSession(ctx context.Context, target *docker.Container, exec execOptions, req *Request) (Response, error) {
+	if !h.postMortem {
+		return errResponse, fmt.Errorf("Container %s is not running", target.ID[:10])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.cancel = cancel
+
+	if err := h.checkUser(target, exec.user); err != nil {
+		return errResponse, err
+	}
+
+	shell, found := h.discoverShell(target, exec.user)
+	if !found && h.toolbox != nil {
+		shell = h.toolbox.shell()
+	}
+
+	image, err := h.cli.CommitContainer(docker.CommitContainerOptions{
+		Container:  target.ID,
+		Repository: postMortemRepository,
+		Tag:        fmt.Sprintf("%s-%d", target.ID[:10], time.Now().Unix()),
+		Message:    "post-mortem session",
+	})
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not commit container=%s (%s)", target.ID[:10], err)
+	}
+	defer h.removePostMortemImage(image)
+
+	h.log.Debugf("Container committed (%s -> %s)", target.ID[:10], image.ID)
+
+	created, err := h.cli.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:        image.ID,
+			Entrypoint:   shell.cmdline(req),
+			Cmd:          []string{},
+			User:         exec.user,
+			WorkingDir:   exec.workingDir,
+			Tty:          req.Tty != nil,
+			OpenStdin:    true,
+			StdinOnce:    true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+		},
+		HostConfig: &docker.HostConfig{
+			NetworkMode: "none",
+			Privileged:  exec.privileged,
+		},
+	})
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not create post-mortem container from %s (%s)", image.ID, err)
+	}
+	defer h.removeContainer(created)
+
+	container, err := h.cli.InspectContainer(created.ID)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not inspect container=%s (%s)", created.ID[:10], err)
+	}
+
+	h.container = container
+	h.attached = container
+
+	if !found && h.toolbox != nil {
+		if _, err := h.injectToolbox(container); err != nil {
+			return errResponse, err
+		}
+	}
+
+	success := make(chan struct{})
+
+	attachOptions := docker.AttachToContainerOptions{
+		Container:    container.ID,
+		InputStream:  req.Stdin,
+		OutputStream: req.Stdout,
+		ErrorStream:  req.Stderr,
+		Stream:       true,
+		Stdin:        true,
+		Stdout:       true,
+		Stderr:       true,
+		RawTerminal:  req.Tty != nil,
+		Success:      success,
+	}
+
+	go func() {
+		<-success
+		success <- struct{}{}
+	}()
+
+	// attach returns when the stream established, so no output is lost after start
+	closer, err := h.cli.AttachToContainerNonBlocking(attachOptions)
+	if err != nil {
+		return errResponse, err
+	}
+
+	if err := h.cli.StartContainer(container.ID, nil); err != nil {
+		closer.Close()
+		return errResponse, fmt.Errorf("Could not start post-mortem container=%s (%s)", container.ID[:10], err)
+	}
+
+	if req.Tty != nil {
+		if err := h.Resize(req.Tty.Resize()); err != nil {
+			h.log.Errorf("Could not resize tty (%s)", err)
+		}
+	}
+
+	h.log.Infof("Post-mortem session started (%s -> %s)", target.ID[:10], container.ID[:10])
+
+	complete := make(chan error)
+
+	go func() {
+		complete <- closer.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		h.log.Debugf("Context done")
+		if err := closer.Close(); err != nil {
+			return errResponse, fmt.Errorf("Could not close post-mortem container=%s (%s)", container.ID[:10], err)
+		}
+		return Response{Code: 0}, nil
+
+	case err := <-complete:
+		if err != nil {
+			return errResponse, fmt.Errorf("Could not wait post-mortem container=%s (%s)", container.ID[:10], err)
+		}
+	}
+
+	code, err := h.cli.WaitContainer(container.ID)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not wait post-mortem container=%s (%s)", container.ID[:10], err)
+	}
+
+	h.log.Debugf("Process exited with code %d", code)
+
+	return Response{Code: code}, nil
+}
+
+func (h *DockerHandler) removePostMortemImage(image *docker.Image) {
+	if err := h.cli.RemoveImageExtended(image.ID, docker.RemoveImageOptions{Force: true}); err != nil {
+		h.log.Errorf("Could not remove post-mortem image=%s (%s)", image.ID, err)
+		return
+	}
+
+	h.log.Debugf("Post-mortem image removed (%s)", image.ID)
+}
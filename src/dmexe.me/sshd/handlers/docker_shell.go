@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// dockerFS reads files from a container using the archive api
+type dockerFS struct {
+	cli       *docker.Client
+	container *docker.Container
+}
+
+// discoverShell looks for the user shell in /etc/passwd, then falls back to configured shells,
+// returns false when no shell found in the container
+func (h *DockerHandler) discoverShell(container *docker.Container, user string) (containerShell, bool) {
+	fs := &dockerFS{cli: h.cli, container: container}
+
+	found, ok := findShell(fs, h.shells, user)
+	if !ok {
+		return defaultShell, false
+	}
+
+	h.log.Debugf("Shell found (%s)", strings.Join(found, " "))
+
+	shell := defaultShell
+	shell.shell = found
+	return shell, true
+}
+
+// checkUser applies the policy to the user resolved by the container files
+func (h *DockerHandler) checkUser(container *docker.Container, user string) error {
+	return h.policy.checkUser(&dockerFS{cli: h.cli, container: container}, user)
+}
+
+// readFile returns content of the file from the container
+func (fs *dockerFS) readFile(filename string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	opts := docker.DownloadFromContainerOptions{
+		OutputStream: &buf,
+		Path:         filename,
+	}
+
+	if err := fs.cli.DownloadFromContainer(fs.container.ID, opts); err != nil {
+		return nil, err
+	}
+
+	reader := tar.NewReader(&buf)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Could not found %s in archive", filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeReg && header.Name == path.Base(filename) {
+			return ioutil.ReadAll(reader)
+		}
+	}
+}
+
+// fileExists checks that the file exists in the container
+func (fs *dockerFS) fileExists(filename string) bool {
+	opts := docker.DownloadFromContainerOptions{
+		OutputStream: ioutil.Discard,
+		Path:         filename,
+	}
+
+	return fs.cli.DownloadFromContainer(fs.container.ID, opts) == nil
+}
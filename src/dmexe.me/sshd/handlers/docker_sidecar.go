@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+const (
+	sidecarTargetPath  = "/target"
+	sidecarTargetLabel = "dmexe.me.sidecar.target"
+
+	// sidecarStartTimeout limits waiting for the target link after the sidecar is started
+	sidecarStartTimeout = 10 * time.Second
+)
+
+// startSidecarSession creates a throwaway container from the toolbox image, which shares
+// pid, network and ipc namespaces with the target, and runs the session inside it.
+// The target root filesystem is available at /target, a symlink into /proc/1/root created by
+// the sidecar entrypoint (so use /target/ with tools not following links), the sidecar is removed when session ends.
+func (h *DockerHandler) startSidecarSession(ctx context.Context, target *docker.Container, exec execOptions, req *Request) (Response, error) {
+	sidecar, err := h.createSidecar(target)
+	if err != nil {
+		return errResponse, err
+	}
+	defer h.removeContainer(sidecar)
+
+	if err := h.cli.StartContainer(sidecar.ID, nil); err != nil {
+		return errResponse, fmt.Errorf("Could not start sidecar container=%s (%s)", sidecar.ID[:10], err)
+	}
+
+	h.log.Infof("Sidecar container started (%s -> %s)", sidecar.ID[:10], target.ID[:10])
+
+	if err := h.waitSidecarTarget(sidecar); err != nil {
+		return errResponse, err
+	}
+
+	if err := h.checkUser(sidecar, exec.user); err != nil {
+		return errResponse, err
+	}
+
+	shell, _ := h.discoverShell(sidecar, exec.user)
+
+	return h.startSession(ctx, sidecar, shell, exec, req)
+}
+
+// waitSidecarTarget waits until the entrypoint links the target root filesystem,
+// sessions started earlier would miss /target
+func (h *DockerHandler) waitSidecarTarget(sidecar *docker.Container) error {
+	fs := &dockerFS{cli: h.cli, container: sidecar}
+	deadline := time.Now().Add(sidecarStartTimeout)
+
+	for !fs.fileExists(sidecarTargetPath) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Could not wait for %s in sidecar container=%s", sidecarTargetPath, sidecar.ID[:10])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return nil
+}
+
+func (h *DockerHandler) createSidecar(target *docker.Container) (*docker.Container, error) {
+	namespace := fmt.Sprintf("container:%s", target.ID)
+
+	// the target root filesystem is reachable through pid 1 of the shared pid namespace
+	keepalive := fmt.Sprintf("ln -sfn /proc/1/root %s && exec tail -f /dev/null", sidecarTargetPath)
+
+	createOptions := docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:      h.sidecarImage,
+			Entrypoint: []string{"/bin/sh", "-c"},
+			Cmd:        []string{keepalive},
+			Labels: map[string]string{
+				sidecarTargetLabel: target.ID,
+			},
+		},
+		HostConfig: &docker.HostConfig{
+			PidMode:     namespace,
+			NetworkMode: namespace,
+			IpcMode:     namespace,
+			CapAdd:      []string{"SYS_PTRACE"},
+		},
+	}
+
+	sidecar, err := h.cli.CreateContainer(createOptions)
+	if err == docker.ErrNoSuchImage {
+		if err := h.pullImage(h.sidecarImage); err != nil {
+			return nil, err
+		}
+		sidecar, err = h.cli.CreateContainer(createOptions)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not create sidecar container from %s (%s)", h.sidecarImage, err)
+	}
+
+	h.log.Debugf("Sidecar container created (%s)", sidecar.ID[:10])
+
+	return sidecar, nil
+}
+
+// removeContainer removes a throwaway container created by the handler
+func (h *DockerHandler) removeContainer(container *docker.Container) {
+	opts := docker.RemoveContainerOptions{
+		ID:            container.ID,
+		RemoveVolumes: true,
+		Force:         true,
+	}
+
+	if err := h.cli.RemoveContainer(opts); err != nil {
+		h.log.Errorf("Could not remove container=%s (%s)", container.ID[:10], err)
+		return
+	}
+
+	h.log.Debugf("Container removed (%s)", container.ID[:10])
+}
+
+func (h *DockerHandler) pullImage(image string) error {
+	repository, tag := docker.ParseRepositoryTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+
+	h.log.Infof("Pulling image %s:%s", repository, tag)
+
+	opts := docker.PullImageOptions{
+		Repository: repository,
+		Tag:        tag,
+	}
+
+	if err := h.cli.PullImage(opts, docker.AuthConfiguration{}); err != nil {
+		return fmt.Errorf("Could not pull image %s (%s)", image, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultToolboxPath is a private path inside container where the toolbox is extracted
+const DefaultToolboxPath = "/.dmexe-toolbox"
+
+// toolboxBinaries are required to spawn sessions and to remove the toolbox afterward
+var toolboxBinaries = []string{"/bin/sh", "/bin/env", "/bin/rm"}
+
+// ToolboxOptions keeps options for a new toolbox instance
+type ToolboxOptions struct {
+	// Archive is a local file or http(s) url of a tar archive with static binaries,
+	// it must contain at least bin/sh, bin/env and bin/rm (eg. busybox with installed applets)
+	Archive string
+
+	// Checksum is a sha256 hex digest of the archive
+	Checksum string
+
+	// Path inside container where the archive is extracted
+	Path string
+
+	// Remove the toolbox after the session ends
+	Remove bool
+}
+
+// Toolbox keeps a verified archive which can be injected into containers without a shell
+type Toolbox struct {
+	sync.Mutex
+	archive  string
+	checksum string
+	path     string
+	remove   bool
+	cached   []byte
+}
+
+// NewToolbox creates a new toolbox using given options, the archive is loaded lazily
+func NewToolbox(opts ToolboxOptions) (*Toolbox, error) {
+	if opts.Archive == "" {
+		return nil, errors.New("Toolbox archive cannot be empty")
+	}
+
+	if opts.Checksum == "" {
+		return nil, errors.New("Toolbox checksum cannot be empty")
+	}
+
+	toolboxPath := opts.Path
+	if toolboxPath == "" {
+		toolboxPath = DefaultToolboxPath
+	}
+
+	if !path.IsAbs(toolboxPath) || path.Clean(toolboxPath) == "/" {
+		return nil, fmt.Errorf("Toolbox path must be an absolute non root path, got '%s'", toolboxPath)
+	}
+
+	toolbox := &Toolbox{
+		archive:  opts.Archive,
+		checksum: strings.ToLower(opts.Checksum),
+		path:     path.Clean(toolboxPath),
+		remove:   opts.Remove,
+	}
+
+	return toolbox, nil
+}
+
+// Load verifies and caches the archive, it's useful to fail early on startup
+func (t *Toolbox) Load() error {
+	_, err := t.load()
+	return err
+}
+
+// shell returns binaries used to spawn processes using the extracted toolbox
+func (t *Toolbox) shell() containerShell {
+	bin := path.Join(t.path, "bin")
+	return containerShell{
+		env:   path.Join(bin, "env"),
+		shell: []string{path.Join(bin, "sh")},
+		vars:  []string{fmt.Sprintf("PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:%s", bin)},
+	}
+}
+
+// load returns the archive rewritten under the toolbox path, the result is cached
+func (t *Toolbox) load() ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.cached != nil {
+		return t.cached, nil
+	}
+
+	raw, err := t.read()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read toolbox archive %s (%s)", t.archive, err)
+	}
+
+	sum := sha256.Sum256(raw)
+	if actual := hex.EncodeToString(sum[:]); actual != t.checksum {
+		return nil, fmt.Errorf("Toolbox archive checksum mismatch, expected=%s, actual=%s", t.checksum, actual)
+	}
+
+	rewritten, err := t.rewrite(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not rewrite toolbox archive %s (%s)", t.archive, err)
+	}
+
+	t.cached = rewritten
+	return t.cached, nil
+}
+
+func (t *Toolbox) read() ([]byte, error) {
+	if !strings.HasPrefix(t.archive, "http://") && !strings.HasPrefix(t.archive, "https://") {
+		return ioutil.ReadFile(t.archive)
+	}
+
+	cli := &http.Client{
+		Timeout: time.Duration(30 * time.Second),
+	}
+
+	response, err := cli.Get(t.archive)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response code, expected=200, actual=%d", response.StatusCode)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// rewrite moves all archive entries and link targets under the toolbox path,
+// so it can be uploaded to the container root, relative symlinks are kept as is
+func (t *Toolbox) rewrite(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	reader := tar.NewReader(bytes.NewReader(raw))
+	writer := tar.NewWriter(&buf)
+
+	prefix := strings.TrimPrefix(t.path, "/")
+	found := make(map[string]bool)
+
+	dir := &tar.Header{
+		Name:     prefix + "/",
+		Mode:     0755,
+		Typeflag: tar.TypeDir,
+		ModTime:  time.Now(),
+	}
+	if err := writer.WriteHeader(dir); err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		header.Name = prefix + name
+		found[name] = true
+
+		switch {
+		case header.Typeflag == tar.TypeDir:
+			header.Name = header.Name + "/"
+		case header.Typeflag == tar.TypeLink:
+			header.Linkname = prefix + path.Clean("/"+header.Linkname)
+		case header.Typeflag == tar.TypeSymlink && path.IsAbs(header.Linkname):
+			header.Linkname = t.path + path.Clean(header.Linkname)
+		}
+
+		if err := writer.WriteHeader(header); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.Copy(writer, reader); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, binary := range toolboxBinaries {
+		if !found[binary] {
+			return nil, fmt.Errorf("Archive must contain %s", strings.TrimPrefix(binary, "/"))
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (h *DockerHandler) injectToolbox(container *docker.Container) (containerShell, error) {
+	archive, err := h.toolbox.load()
+	if err != nil {
+		return defaultShell, err
+	}
+
+	opts := docker.UploadToContainerOptions{
+		InputStream: bytes.NewReader(archive),
+		Path:        "/",
+	}
+
+	if err := h.cli.UploadToContainer(container.ID, opts); err != nil {
+		return defaultShell, fmt.Errorf("Could not upload toolbox to container=%s (%s)", container.ID[:10], err)
+	}
+
+	h.log.Infof("Toolbox injected into %s (%s)", h.toolbox.path, container.ID[:10])
+
+	return h.toolbox.shell(), nil
+}
+
+func (h *DockerHandler) removeToolbox(container *docker.Container) {
+	createExecOptions := docker.CreateExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{path.Join(h.toolbox.path, "bin", "rm"), "-rf", h.toolbox.path},
+		Container:    container.ID,
+	}
+
+	exec, err := h.cli.CreateExec(createExecOptions)
+	if err != nil {
+		h.log.Errorf("Could not remove toolbox from container=%s (%s)", container.ID[:10], err)
+		return
+	}
+
+	startExecOptions := docker.StartExecOptions{
+		OutputStream: ioutil.Discard,
+		ErrorStream:  ioutil.Discard,
+	}
+
+	if err := h.cli.StartExec(exec.ID, startExecOptions); err != nil {
+		h.log.Errorf("Could not remove toolbox from container=%s (%s)", container.ID[:10], err)
+		return
+	}
+
+	inspect, err := h.cli.InspectExec(exec.ID)
+	if err != nil {
+		h.log.Errorf("Could not remove toolbox from container=%s (%s)", container.ID[:10], err)
+		return
+	}
+
+	if inspect.ExitCode != 0 {
+		h.log.Errorf("Could not remove toolbox from container=%s (rm exited with code %d)", container.ID[:10], inspect.ExitCode)
+		return
+	}
+
+	h.log.Debugf("Toolbox removed (%s)", container.ID[:10])
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_Toolbox(t *testing.T) {
+
+	t.Run("should load and rewrite archive", func(t *testing.T) {
+		archive, checksum := newTestToolboxArchive(t)
+		defer os.Remove(archive)
+
+		toolbox, err := NewToolbox(ToolboxOptions{
+			Archive:  archive,
+			Checksum: checksum,
+		})
+		require.NoError(t, err)
+		require.NoError(t, toolbox.Load())
+
+		loaded, err := toolbox.load()
+		require.NoError(t, err)
+
+		names := make([]string, 0)
+		links := make(map[string]string)
+		reader := tar.NewReader(bytes.NewReader(loaded))
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, header.Name)
+			if header.Linkname != "" {
+				links[header.Name] = header.Linkname
+			}
+		}
+
+		expected := []string{
+			".dmexe-toolbox/",
+			".dmexe-toolbox/bin/",
+			".dmexe-toolbox/bin/busybox",
+			".dmexe-toolbox/bin/sh",
+			".dmexe-toolbox/bin/env",
+			".dmexe-toolbox/bin/rm",
+		}
+		require.Equal(t, expected, names)
+
+		expectedLinks := map[string]string{
+			".dmexe-toolbox/bin/sh":  ".dmexe-toolbox/bin/busybox",
+			".dmexe-toolbox/bin/env": "/.dmexe-toolbox/bin/busybox",
+			".dmexe-toolbox/bin/rm":  "busybox",
+		}
+		require.Equal(t, expectedLinks, links)
+
+		shell := toolbox.shell()
+		require.Equal(t, "/.dmexe-toolbox/bin/env", shell.env)
+		require.Equal(t, []string{"/.dmexe-toolbox/bin/sh"}, shell.shell)
+	})
+
+	t.Run("fail on checksum mismatch", func(t *testing.T) {
+		archive, _ := newTestToolboxArchive(t)
+		defer os.Remove(archive)
+
+		toolbox, err := NewToolbox(ToolboxOptions{
+			Archive:  archive,
+			Checksum: "deadbeef",
+		})
+		require.NoError(t, err)
+		require.Contains(t, toolbox.Load().Error(), "Toolbox archive checksum mismatch")
+	})
+
+	t.Run("fail on missing binaries", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := tar.NewWriter(&buf)
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"}))
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/env", Typeflag: tar.TypeSymlink, Linkname: "busybox"}))
+		require.NoError(t, writer.Close())
+
+		toolbox, err := NewToolbox(ToolboxOptions{Archive: "toolbox.tar", Checksum: "deadbeef"})
+		require.NoError(t, err)
+
+		_, err = toolbox.rewrite(buf.Bytes())
+		require.EqualError(t, err, "Archive must contain bin/rm")
+	})
+
+	t.Run("fail on invalid path", func(t *testing.T) {
+		_, err := NewToolbox(ToolboxOptions{
+			Archive:  "toolbox.tar",
+			Checksum: "deadbeef",
+			Path:     "/",
+		})
+		require.EqualError(t, err, "Toolbox path must be an absolute non root path, got '/'")
+	})
+}
+
+func newTestToolboxArchive(t *testing.T) (string, string) {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/", Mode: 0755, Typeflag: tar.TypeDir}))
+
+	content := []byte("#!/bin/true\n")
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/busybox", Mode: 0755, Size: int64(len(content))}))
+	_, err := writer.Write(content)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}))
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/env", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox"}))
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "bin/rm", Typeflag: tar.TypeSymlink, Linkname: "busybox"}))
+	require.NoError(t, writer.Close())
+
+	file, err := ioutil.TempFile("", "toolbox")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(buf.Bytes())
+	return file.Name(), hex.EncodeToString(sum[:])
+}
@@ -31,6 +31,13 @@ type Request struct {
 	Stderr  io.Writer
 	Exec    string
 	Payload payloads.Payload
+
+	// Mode is the session mode allowed by the token policy (eg. shell, exec, logs)
+	Mode string
+
+	// Agent opens a channel to the ssh agent forwarded by the client,
+	// it's nil when the client didn't request agent forwarding
+	Agent func() (io.ReadWriteCloser, error)
 }
 
 // Response from handler
@@ -41,6 +48,17 @@ type Response struct {
 // HandlerFunc is a factory method
 type HandlerFunc func() (Handler, error)
 
+// ModeFunc maps a shell (empty exec) or exec request to the session mode checked against the token policy
+type ModeFunc func(policy payloads.Policy, exec string) string
+
+// ShellMode maps requests to shell and exec modes, it's used by handlers serving only them
+func ShellMode(_ payloads.Policy, exec string) string {
+	if exec == "" {
+		return payloads.ModeShell
+	}
+	return payloads.ModeExec
+}
+
 // Handler generic interface
 type Handler interface {
 	io.Closer
@@ -48,6 +66,12 @@ type Handler interface {
 	Resize(tty *Resize) error
 }
 
+// Signaler is implemented by handlers able to deliver signals to the session process,
+// the signal name is given without SIG prefix (eg. TERM, INT)
+type Signaler interface {
+	Signal(name string) error
+}
+
 // Resize request from Tty
 func (req *Tty) Resize() *Resize {
 	return &Resize{
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubeServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeStreamProtocol     = "v4.channel.k8s.io"
+)
+
+// KubernetesClientOptions keeps options for a new kubernetes api client
+type KubernetesClientOptions struct {
+	// Endpoint of the api server (eg. https://10.0.0.1:6443)
+	Endpoint string
+
+	// Token is a bearer token used for authentication
+	Token string
+
+	// TLSConfig is used for https endpoints
+	TLSConfig *tls.Config
+}
+
+// KubernetesClient is a minimal client for pods api
+type KubernetesClient struct {
+	endpoint  *url.URL
+	token     string
+	tlsConfig *tls.Config
+	http      *http.Client
+}
+
+type kubePod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+type kubePodList struct {
+	Items []kubePod `json:"items"`
+}
+
+// kubeExecOptions keeps query parameters of the pods/exec subresource
+type kubeExecOptions struct {
+	container string
+	command   []string
+	tty       bool
+}
+
+// NewKubernetesClient creates a new client using given options
+func NewKubernetesClient(opts KubernetesClientOptions) (*KubernetesClient, error) {
+	if opts.Endpoint == "" {
+		return nil, errors.New("Endpoint cannot be empty")
+	}
+
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse endpoint %s (%s)", opts.Endpoint, err)
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("Endpoint must be http(s) url, got '%s'", opts.Endpoint)
+	}
+
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	client := &KubernetesClient{
+		endpoint:  endpoint,
+		token:     opts.Token,
+		tlsConfig: tlsConfig,
+		http: &http.Client{
+			Timeout: time.Duration(30 * time.Second),
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+
+	return client, nil
+}
+
+// NewKubernetesClientInCluster creates a new client using the pod service account
+func NewKubernetesClientInCluster() (*KubernetesClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not in cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+
+	token, err := ioutil.ReadFile(kubeServiceAccountPath + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("Could not read service account token (%s)", err)
+	}
+
+	tlsConfig, err := NewKubernetesTLSConfig(kubeServiceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKubernetesClient(KubernetesClientOptions{
+		Endpoint:  "https://" + net.JoinHostPort(host, port),
+		Token:     strings.TrimSpace(string(token)),
+		TLSConfig: tlsConfig,
+	})
+}
+
+// NewKubernetesTLSConfig creates tls config trusting given CA bundle
+func NewKubernetesTLSConfig(caFile string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read CA file %s (%s)", caFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Could not parse CA file %s", caFile)
+	}
+
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// listPods returns pods in the namespace matched by the label selector
+func (c *KubernetesClient) listPods(namespace string, selector string) ([]kubePod, error) {
+	query := url.Values{}
+	query.Set("labelSelector", selector)
+
+	req, err := c.newRequest(fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(namespace)), query)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response code, expected=200, actual=%d", response.StatusCode)
+	}
+
+	var pods kubePodList
+	if err := json.NewDecoder(response.Body).Decode(&pods); err != nil {
+		return nil, err
+	}
+
+	return pods.Items, nil
+}
+
+// exec opens a streaming session to the pods/exec subresource
+func (c *KubernetesClient) exec(namespace string, pod string, opts kubeExecOptions) (*wsConn, error) {
+	query := url.Values{}
+	query.Set("container", opts.container)
+	query.Set("stdin", "true")
+	query.Set("stdout", "true")
+	query.Set("stderr", fmt.Sprintf("%t", !opts.tty))
+	query.Set("tty", fmt.Sprintf("%t", opts.tty))
+	for _, arg := range opts.command {
+		query.Add("command", arg)
+	}
+
+	req, err := c.newRequest(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/exec", url.PathEscape(namespace), url.PathEscape(pod)), query)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := wsHandshake(conn, req, kubeStreamProtocol)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (c *KubernetesClient) newRequest(path string, query url.Values) (*http.Request, error) {
+	target := *c.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	return req, nil
+}
+
+func (c *KubernetesClient) dial() (net.Conn, error) {
+	host := c.endpoint.Host
+	if c.endpoint.Port() == "" {
+		port := "80"
+		if c.endpoint.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(c.endpoint.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(30 * time.Second)}
+
+	if c.endpoint.Scheme != "https" {
+		return dialer.Dial("tcp", host)
+	}
+
+	tlsConfig := c.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = c.endpoint.Hostname()
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"dmexe.me/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// channels of the kubernetes streaming protocol
+const (
+	kubeChannelStdin  = 0
+	kubeChannelStdout = 1
+	kubeChannelStderr = 2
+	kubeChannelError  = 3
+	kubeChannelResize = 4
+
+	// DefaultKubernetesNamespace is used when payload doesn't specify one
+	DefaultKubernetesNamespace = "default"
+)
+
+// KubernetesHandler runs sessions in kubernetes pods using the pods/exec subresource,
+// the pod is found by the payload label selector
+type KubernetesHandler struct {
+	cli       *KubernetesClient
+	namespace string
+	policy    ExecPolicy
+	session   *wsConn
+	log       *logrus.Entry
+	cancel    context.CancelFunc
+}
+
+// KubernetesHandlerOptions keeps options for a new handler instance
+type KubernetesHandlerOptions struct {
+	Client    *KubernetesClient
+	Namespace string
+	Policy    ExecPolicy
+}
+
+type kubeStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Details struct {
+		Causes []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+type kubeResize struct {
+	Width  uint32
+	Height uint32
+}
+
+// NewKubernetesHandler creates handler for kubernetes requests
+func NewKubernetesHandler(opts KubernetesHandlerOptions) (*KubernetesHandler, error) {
+	if opts.Client == nil {
+		return nil, errors.New("Client cannot be nil")
+	}
+
+	// pods/exec runs as the container user, which could be root
+	if !opts.Policy.AllowRoot {
+		return nil, errors.New("Kubernetes handler requires root sessions to be allowed by policy")
+	}
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = DefaultKubernetesNamespace
+	}
+
+	handler := &KubernetesHandler{
+		cli:       opts.Client,
+		namespace: namespace,
+		policy:    opts.Policy,
+		log:       utils.NewLogEntry("handler.kubernetes"),
+	}
+
+	return handler, nil
+}
+
+// Handle given request, looking for a running pod and start exec session
+func (h *KubernetesHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	exec, err := h.policy.resolve(req.Payload)
+	if err != nil {
+		return errResponse, err
+	}
+
+	// pods/exec always runs as the container user
+	if req.Payload.User != "" {
+		return errResponse, fmt.Errorf("User '%s' cannot be used with kubernetes exec", req.Payload.User)
+	}
+
+	if exec.privileged {
+		return errResponse, errors.New("Privileged session cannot be used with kubernetes exec")
+	}
+
+	pod, err := h.findPod(req.Payload.Namespace, req.Payload.PodSelector)
+	if err != nil {
+		return errResponse, err
+	}
+
+	container, err := h.findContainer(pod, req.Payload.ContainerName)
+	if err != nil {
+		return errResponse, err
+	}
+
+	shell := defaultShell
+	shell.workingDir = exec.workingDir
+
+	return h.startSession(ctx, pod, container, shell, req)
+}
+
+// findPod returns the first running pod by name matched by the selector
+func (h *KubernetesHandler) findPod(namespace string, selector string) (*kubePod, error) {
+	if namespace == "" {
+		namespace = h.namespace
+	}
+
+	if selector == "" {
+		return nil, errors.New("Payload must contain pod selector (eg. app=web)")
+	}
+
+	pods, err := h.cli.listPods(namespace, selector)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list pods namespace=%s selector=%s (%s)", namespace, selector, err)
+	}
+
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Metadata.Name < pods[j].Metadata.Name
+	})
+
+	for i := range pods {
+		if pods[i].Status.Phase == "Running" {
+			h.log.Debugf("Pod found (namespace=%s name=%s)", namespace, pods[i].Metadata.Name)
+			pods[i].Metadata.Namespace = namespace
+			return &pods[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not found running pod namespace=%s selector=%s", namespace, selector)
+}
+
+// findContainer returns the container name, the first container is used by default
+func (h *KubernetesHandler) findContainer(pod *kubePod, name string) (string, error) {
+	if len(pod.Spec.Containers) == 0 {
+		return "", fmt.Errorf("Pod %s has no containers", pod.Metadata.Name)
+	}
+
+	if name == "" {
+		return pod.Spec.Containers[0].Name, nil
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name == name {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("Could not found container %s in pod %s", name, pod.Metadata.Name)
+}
+
+func (h *KubernetesHandler) startSession(ctx context.Context, pod *kubePod, container string, shell containerShell, req *Request) (Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.cancel = cancel
+
+	execOptions := kubeExecOptions{
+		container: container,
+		command:   shell.cmdline(req),
+		tty:       req.Tty != nil,
+	}
+
+	h.log.Debugf("Pod session with cmdline (%s)", strings.Join(execOptions.command, " "))
+
+	session, err := h.cli.exec(pod.Metadata.Namespace, pod.Metadata.Name, execOptions)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not exec in pod=%s container=%s (%s)", pod.Metadata.Name, container, err)
+	}
+	defer session.Close()
+
+	h.session = session
+
+	h.log.Infof("Pod session started (%s/%s)", pod.Metadata.Name, container)
+
+	if req.Tty != nil {
+		if err := h.Resize(req.Tty.Resize()); err != nil {
+			h.log.Errorf("Could not resize tty (%s)", err)
+		}
+	}
+
+	go h.copyStdin(session, req.Stdin)
+
+	complete := make(chan error, 1)
+	status := make(chan *kubeStatus, 1)
+
+	go func() {
+		result, err := h.copyOutput(session, req)
+		status <- result
+		complete <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		h.log.Debugf("Context done")
+		return Response{Code: 0}, nil
+
+	case err := <-complete:
+		if err != nil {
+			return errResponse, fmt.Errorf("Could not wait pod session=%s (%s)", pod.Metadata.Name, err)
+		}
+	}
+
+	code, err := kubeExitCode(<-status)
+	if err != nil {
+		return errResponse, err
+	}
+
+	h.log.Debugf("Process exited with code %d", code)
+
+	return Response{Code: code}, nil
+}
+
+func (h *KubernetesHandler) copyStdin(session *wsConn, stdin io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			if err := session.WriteMessage(append([]byte{kubeChannelStdin}, buf[:n]...)); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// copyOutput demultiplexes session channels until the status received
+func (h *KubernetesHandler) copyOutput(session *wsConn, req *Request) (*kubeStatus, error) {
+	for {
+		message, err := session.ReadMessage()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(message) == 0 {
+			continue
+		}
+
+		switch message[0] {
+		case kubeChannelStdout:
+			if _, err := req.Stdout.Write(message[1:]); err != nil {
+				return nil, err
+			}
+
+		case kubeChannelStderr:
+			if _, err := req.Stderr.Write(message[1:]); err != nil {
+				return nil, err
+			}
+
+		case kubeChannelError:
+			status := &kubeStatus{}
+			if err := json.Unmarshal(message[1:], status); err != nil {
+				return nil, fmt.Errorf("Could not parse session status (%s)", err)
+			}
+			return status, nil
+		}
+	}
+}
+
+// kubeExitCode converts the session status into exit code, the session is failed
+// when it's closed without the status
+func kubeExitCode(status *kubeStatus) (int, error) {
+	if status == nil {
+		return 0, errors.New("Pod session closed without exit status")
+	}
+
+	if status.Status == "Success" {
+		return 0, nil
+	}
+
+	if status.Reason == "NonZeroExitCode" {
+		for _, cause := range status.Details.Causes {
+			if cause.Reason == "ExitCode" {
+				return strconv.Atoi(cause.Message)
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("Pod session failed (%s)", status.Message)
+}
+
+// Resize tty, ignored if current request haven't tty
+func (h *KubernetesHandler) Resize(req *Resize) error {
+	if req != nil && h.session != nil {
+		size, err := json.Marshal(kubeResize{Width: req.Width, Height: req.Height})
+		if err != nil {
+			return err
+		}
+
+		if err := h.session.WriteMessage(append([]byte{kubeChannelResize}, size...)); err != nil {
+			return fmt.Errorf("Could not resize tty (%s)", err)
+		}
+		h.log.Debugf("Tty resized to %dx%d", req.Width, req.Height)
+	}
+	return nil
+}
+
+// Close current session
+func (h *KubernetesHandler) Close() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
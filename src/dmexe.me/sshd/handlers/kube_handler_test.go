@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"dmexe.me/payloads"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeKubernetesServer serves pods list and exec, the exec session echoes stdin,
+// reports resize messages and exits with the code passed as "exit N" line
+func newFakeKubernetesServer(t *testing.T, pods string) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/namespaces/web/pods", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		require.Equal(t, "app=web", r.URL.Query().Get("labelSelector"))
+		w.Write([]byte(pods))
+	})
+
+	mux.HandleFunc("/api/v1/namespaces/web/pods/web-2/exec", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, kubeStreamProtocol, r.Header.Get("Sec-WebSocket-Protocol"))
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: %s\r\n\r\n",
+			wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")), kubeStreamProtocol)
+
+		session := newWsConn(conn, buf.Reader, false)
+
+		query := r.URL.Query()
+		session.WriteMessage([]byte(fmt.Sprintf("\x01container=%s tty=%s command=%s\n",
+			query.Get("container"), query.Get("tty"), strings.Join(query["command"], " "))))
+
+		for {
+			message, err := session.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			switch message[0] {
+			case kubeChannelResize:
+				size := kubeResize{}
+				require.NoError(t, json.Unmarshal(message[1:], &size))
+				session.WriteMessage([]byte(fmt.Sprintf("\x01resize %dx%d\n", size.Width, size.Height)))
+
+			case kubeChannelStdin:
+				if string(message[1:]) == "drop" {
+					session.Close()
+					return
+				}
+
+				var code int
+				if _, err := fmt.Sscanf(string(message[1:]), "exit %d", &code); err == nil {
+					status := `{"status":"Success"}`
+					if code != 0 {
+						status = fmt.Sprintf(`{"status":"Failure","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"%d"}]}}`, code)
+					}
+					session.WriteMessage(append([]byte{kubeChannelError}, status...))
+					session.Close()
+					return
+				}
+				session.WriteMessage(append([]byte{kubeChannelStderr}, message[1:]...))
+			}
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func newTestKubernetesHandler(t *testing.T, endpoint string) *KubernetesHandler {
+	cli, err := NewKubernetesClient(KubernetesClientOptions{
+		Endpoint: endpoint,
+		Token:    "token",
+	})
+	require.NoError(t, err)
+
+	handler, err := NewKubernetesHandler(KubernetesHandlerOptions{
+		Client:    cli,
+		Namespace: "web",
+		Policy:    ExecPolicy{DefaultWorkingDir: "/app", AllowRoot: true},
+	})
+	require.NoError(t, err)
+
+	return handler
+}
+
+func Test_KubernetesHandler(t *testing.T) {
+	pods := `{"items":[
+		{"metadata":{"name":"web-3"},"spec":{"containers":[{"name":"nginx"}]},"status":{"phase":"Running"}},
+		{"metadata":{"name":"web-1"},"spec":{"containers":[{"name":"nginx"}]},"status":{"phase":"Pending"}},
+		{"metadata":{"name":"web-2"},"spec":{"containers":[{"name":"nginx"},{"name":"app"}]},"status":{"phase":"Running"}}
+	]}`
+
+	server := newFakeKubernetesServer(t, pods)
+	defer server.Close()
+
+	payload := payloads.Payload{PodSelector: "app=web", ContainerName: "app"}
+
+	t.Run("should exec in running pod", func(t *testing.T) {
+		handler := newTestKubernetesHandler(t, server.URL)
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+
+		req := &Request{
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  stderr,
+			Exec:    "cat",
+			Payload: payload,
+		}
+
+		go func() {
+			input.Write([]byte("hello\n"))
+			input.Write([]byte("exit 3"))
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 3, response.Code)
+		require.Equal(t, "container=app tty=false command=/bin/sh -c cd '/app' && cat\n", stdout.String())
+		require.Equal(t, "hello\n", stderr.String())
+	})
+
+	t.Run("should exec with tty", func(t *testing.T) {
+		handler := newTestKubernetesHandler(t, server.URL)
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+
+		req := &Request{
+			Tty:     &Tty{Term: "xterm", Width: 80, Height: 24},
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  stdout,
+			Payload: payloads.Payload{PodSelector: "app=web"},
+		}
+
+		go func() {
+			input.Write([]byte("exit 0"))
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 0, response.Code)
+		require.Equal(t, "container=nginx tty=true command=/usr/bin/env TERM=xterm /bin/sh -c cd '/app' && exec /bin/sh -l\nresize 80x24\n", stdout.String())
+	})
+
+	t.Run("fail when pod not found", func(t *testing.T) {
+		handler := newTestKubernetesHandler(t, server.URL)
+		defer handler.Close()
+
+		req := &Request{
+			Payload: payloads.Payload{Namespace: "db", PodSelector: "app=web"},
+		}
+
+		_, err := handler.Handle(context.Background(), req)
+		require.EqualError(t, err, "Could not list pods namespace=db selector=app=web (Unexpected response code, expected=200, actual=404)")
+	})
+
+	t.Run("fail when container not found", func(t *testing.T) {
+		handler := newTestKubernetesHandler(t, server.URL)
+		defer handler.Close()
+
+		req := &Request{
+			Payload: payloads.Payload{PodSelector: "app=web", ContainerName: "db"},
+		}
+
+		_, err := handler.Handle(context.Background(), req)
+		require.EqualError(t, err, "Could not found container db in pod web-2")
+	})
+
+	t.Run("fail when session closed without status", func(t *testing.T) {
+		handler := newTestKubernetesHandler(t, server.URL)
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+
+		req := &Request{
+			Stdin:   stdin,
+			Stdout:  new(bytes.Buffer),
+			Stderr:  new(bytes.Buffer),
+			Exec:    "cat",
+			Payload: payload,
+		}
+
+		go input.Write([]byte("drop"))
+
+		response, err := handler.Handle(context.Background(), req)
+		require.EqualError(t, err, "Pod session closed without exit status")
+		require.Equal(t, errResponse, response)
+	})
+
+	t.Run("fail without root policy", func(t *testing.T) {
+		cli, err := NewKubernetesClient(KubernetesClientOptions{Endpoint: server.URL})
+		require.NoError(t, err)
+
+		_, err = NewKubernetesHandler(KubernetesHandlerOptions{Client: cli})
+		require.EqualError(t, err, "Kubernetes handler requires root sessions to be allowed by policy")
+	})
+
+	t.Run("fail when user given", func(t *testing.T) {
+		handler := newTestKubernetesHandler(t, server.URL)
+		defer handler.Close()
+
+		req := &Request{
+			Payload: payloads.Payload{PodSelector: "app=web", User: "app"},
+		}
+
+		_, err := handler.Handle(context.Background(), req)
+		require.EqualError(t, err, "User 'app' cannot be used with kubernetes exec")
+	})
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// websocket opcodes used by the kubernetes streaming protocol
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// wsMaxMessageSize limits frames and reassembled messages, kubernetes sends small chunks
+	wsMaxMessageSize = 1 << 20
+)
+
+// wsConn is a minimal websocket connection (RFC 6455), only binary messages are supported,
+// clients mask outgoing frames, servers don't
+type wsConn struct {
+	sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	masked bool
+}
+
+func newWsConn(conn net.Conn, reader *bufio.Reader, masked bool) *wsConn {
+	return &wsConn{
+		conn:   conn,
+		reader: reader,
+		masked: masked,
+	}
+}
+
+// wsHandshake performs the client handshake on the connection, the request must be a GET request
+func wsHandshake(conn net.Conn, req *http.Request, protocol string) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", protocol)
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		body := make([]byte, 512)
+		n, _ := io.ReadFull(response.Body, body)
+		response.Body.Close()
+		return nil, fmt.Errorf("Unexpected response code, expected=101, actual=%d %s", response.StatusCode, body[:n])
+	}
+
+	if response.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("Invalid websocket accept key")
+	}
+
+	if actual := response.Header.Get("Sec-WebSocket-Protocol"); actual != protocol {
+		return nil, fmt.Errorf("Unexpected websocket protocol, expected=%s, actual=%s", protocol, actual)
+	}
+
+	return newWsConn(conn, reader, true), nil
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ReadMessage returns the next data message, control frames are handled internally
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	message := make([]byte, 0)
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+
+		case wsOpPong:
+			continue
+
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return nil, io.EOF
+
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			if len(message)+len(payload) > wsMaxMessageSize {
+				return nil, fmt.Errorf("Websocket message exceeds %d bytes", wsMaxMessageSize)
+			}
+			message = append(message, payload...)
+		}
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// WriteMessage sends a binary message
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.writeFrame(wsOpBinary, data)
+}
+
+// Close sends the close frame and closes the connection
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.conn.Close()
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > wsMaxMessageSize {
+		return false, 0, nil, fmt.Errorf("Websocket frame exceeds %d bytes, got %d", wsMaxMessageSize, length)
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	frame := []byte{0x80 | opcode}
+
+	var maskBit byte
+	if c.masked {
+		maskBit = 0x80
+	}
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	data := payload
+	if c.masked {
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+
+		data = make([]byte, length)
+		for i := range payload {
+			data[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	_, err := c.conn.Write(append(frame, data...))
+	return err
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func Test_WsConn(t *testing.T) {
+	newConn := func(frames ...[]byte) *wsConn {
+		client, server := net.Pipe()
+		go func() {
+			for _, frame := range frames {
+				server.Write(frame)
+			}
+			server.Close()
+		}()
+		return newWsConn(client, bufio.NewReader(client), true)
+	}
+
+	t.Run("should read fragmented message", func(t *testing.T) {
+		conn := newConn([]byte{wsOpBinary, 2, 'a', 'b'}, []byte{0x80 | wsOpContinuation, 1, 'c'})
+		defer conn.conn.Close()
+
+		message, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), message)
+	})
+
+	t.Run("fail on frame above the limit before reading it", func(t *testing.T) {
+		conn := newConn([]byte{0x80 | wsOpBinary, 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		defer conn.conn.Close()
+
+		_, err := conn.ReadMessage()
+		require.EqualError(t, err, "Websocket frame exceeds 1048576 bytes, got 9223372036854775807")
+	})
+
+	t.Run("fail on fragmented message above the limit", func(t *testing.T) {
+		chunk := append([]byte{wsOpBinary, 127, 0, 0, 0, 0, 0, 0x10, 0, 0}, bytes.Repeat([]byte{'a'}, wsMaxMessageSize)...)
+		conn := newConn(chunk, []byte{0x80 | wsOpContinuation, 1, 'b'})
+		defer conn.conn.Close()
+
+		_, err := conn.ReadMessage()
+		require.EqualError(t, err, "Websocket message exceeds 1048576 bytes")
+	})
+}
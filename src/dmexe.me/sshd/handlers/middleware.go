@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a session handler adding cross-cutting behavior to any backend
+type Middleware func(next Handler) Handler
+
+// Chain wraps handlers created by the factory, the first middleware is the outermost one
+func Chain(handlerFunc HandlerFunc, middlewares ...Middleware) HandlerFunc {
+	return func() (Handler, error) {
+		handler, err := handlerFunc()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+
+		return handler, nil
+	}
+}
+
+// WrappedHandler delegates all calls to the next handler, it's embedded by middlewares
+// which override only the calls they need
+type WrappedHandler struct {
+	Next Handler
+}
+
+// Handle delegates the request to the next handler
+func (w *WrappedHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	return w.Next.Handle(ctx, req)
+}
+
+// Resize delegates the resize to the next handler
+func (w *WrappedHandler) Resize(req *Resize) error {
+	return w.Next.Resize(req)
+}
+
+// Signal delegates the signal to the next handler, fails when it doesn't support signals
+func (w *WrappedHandler) Signal(name string) error {
+	signaler, ok := w.Next.(Signaler)
+	if !ok {
+		return errors.New("Signals are not supported by handler")
+	}
+	return signaler.Signal(name)
+}
+
+// Close delegates the close to the next handler
+func (w *WrappedHandler) Close() error {
+	return w.Next.Close()
+}
+
+// BannerMiddleware writes the banner before interactive sessions
+func BannerMiddleware(banner string) Middleware {
+	return func(next Handler) Handler {
+		return &bannerHandler{
+			WrappedHandler: WrappedHandler{Next: next},
+			banner:         banner,
+		}
+	}
+}
+
+type bannerHandler struct {
+	WrappedHandler
+	banner string
+}
+
+func (h *bannerHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	// exec sessions are often used by scripts, the banner would break their output
+	if req.Exec == "" && h.banner != "" {
+		banner := h.banner
+		if req.Tty != nil {
+			banner = strings.Replace(banner, "\n", "\r\n", -1)
+		}
+
+		if _, err := io.WriteString(req.Stdout, banner); err != nil {
+			return errResponse, fmt.Errorf("Could not write banner (%s)", err)
+		}
+	}
+
+	return h.Next.Handle(ctx, req)
+}
+
+// AccountingMiddleware logs bytes transferred by sessions, their duration and exit codes
+func AccountingMiddleware() Middleware {
+	log := utils.NewLogEntry("handler.accounting")
+
+	return func(next Handler) Handler {
+		return &accountingHandler{
+			WrappedHandler: WrappedHandler{Next: next},
+			log:            log,
+		}
+	}
+}
+
+type accountingHandler struct {
+	WrappedHandler
+	log *logrus.Entry
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.count, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(&w.count, int64(n))
+	return n, err
+}
+
+func (h *accountingHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	stdin := &countingReader{Reader: req.Stdin}
+	stdout := &countingWriter{Writer: req.Stdout}
+	stderr := &countingWriter{Writer: req.Stderr}
+
+	counted := *req
+	counted.Stdin = stdin
+	counted.Stdout = stdout
+	counted.Stderr = stderr
+
+	started := time.Now()
+
+	resp, err := h.Next.Handle(ctx, &counted)
+
+	log := h.log
+	if sub := req.Payload.Identity.Subject; sub != "" {
+		log = log.WithField("sub", sub)
+	}
+
+	log.Infof("Session completed (code=%d duration=%s stdin=%d stdout=%d stderr=%d)",
+		resp.Code,
+		time.Since(started),
+		atomic.LoadInt64(&stdin.count),
+		atomic.LoadInt64(&stdout.count),
+		atomic.LoadInt64(&stderr.count),
+	)
+
+	return resp, err
+}
+
+// LimitMiddleware rejects sessions when the number of running sessions reaches the limit
+func LimitMiddleware(limit int) Middleware {
+	counter := &sessionCounter{limit: limit}
+
+	return func(next Handler) Handler {
+		return &limitHandler{
+			WrappedHandler: WrappedHandler{Next: next},
+			counter:        counter,
+		}
+	}
+}
+
+type sessionCounter struct {
+	sync.Mutex
+	limit  int
+	active int
+}
+
+func (c *sessionCounter) acquire() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.active >= c.limit {
+		return false
+	}
+	c.active++
+	return true
+}
+
+func (c *sessionCounter) release() {
+	c.Lock()
+	defer c.Unlock()
+	c.active--
+}
+
+type limitHandler struct {
+	WrappedHandler
+	counter *sessionCounter
+}
+
+func (h *limitHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	if !h.counter.acquire() {
+		return errResponse, fmt.Errorf("Too many sessions (limit=%d)", h.counter.limit)
+	}
+	defer h.counter.release()
+
+	return h.Next.Handle(ctx, req)
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+type recordHandler struct {
+	WrappedHandler
+	name    string
+	records *[]string
+}
+
+func (h *recordHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	*h.records = append(*h.records, h.name)
+	return h.Next.Handle(ctx, req)
+}
+
+func recordMiddleware(name string, records *[]string) Middleware {
+	return func(next Handler) Handler {
+		return &recordHandler{WrappedHandler: WrappedHandler{Next: next}, name: name, records: records}
+	}
+}
+
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) Handle(_ context.Context, _ *Request) (Response, error) {
+	h.started <- struct{}{}
+	<-h.release
+	return Response{Code: 0}, nil
+}
+
+func (h *blockingHandler) Resize(_ *Resize) error { return nil }
+func (h *blockingHandler) Close() error           { return nil }
+
+func Test_Middleware(t *testing.T) {
+	echoFunc := func() (Handler, error) {
+		return NewEchoHandler(EchoHandlerErrors{}), nil
+	}
+
+	t.Run("should apply middlewares in order", func(t *testing.T) {
+		records := make([]string, 0)
+
+		handlerFunc := Chain(echoFunc, recordMiddleware("first", &records), recordMiddleware("second", &records))
+		handler, err := handlerFunc()
+		require.NoError(t, err)
+
+		stdout := new(bytes.Buffer)
+		_, err = handler.Handle(context.Background(), &Request{Stdin: strings.NewReader("hello"), Stdout: stdout})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"first", "second"}, records)
+		require.Equal(t, "hello", stdout.String())
+	})
+
+	t.Run("should write banner to interactive sessions", func(t *testing.T) {
+		handler, err := Chain(echoFunc, BannerMiddleware("Welcome\n"))()
+		require.NoError(t, err)
+
+		stdout := new(bytes.Buffer)
+		_, err = handler.Handle(context.Background(), &Request{
+			Tty:    &Tty{Term: "xterm"},
+			Stdin:  strings.NewReader("hello"),
+			Stdout: stdout,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Welcome\r\nhello", stdout.String())
+
+		stdout.Reset()
+		_, err = handler.Handle(context.Background(), &Request{Stdin: strings.NewReader(""), Stdout: stdout, Exec: "ls"})
+		require.NoError(t, err)
+		require.Equal(t, "ls", stdout.String())
+	})
+
+	t.Run("should count session bytes", func(t *testing.T) {
+		stdin := &countingReader{Reader: strings.NewReader("hello")}
+		stdout := &countingWriter{Writer: new(bytes.Buffer)}
+
+		_, err := io.Copy(stdout, stdin)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), stdin.count)
+		require.Equal(t, int64(5), stdout.count)
+
+		handler, err := Chain(echoFunc, AccountingMiddleware())()
+		require.NoError(t, err)
+
+		_, err = handler.Handle(context.Background(), &Request{Stdin: strings.NewReader("hello"), Stdout: new(bytes.Buffer)})
+		require.NoError(t, err)
+	})
+
+	t.Run("should limit running sessions", func(t *testing.T) {
+		blocking := &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+
+		handlerFunc := Chain(func() (Handler, error) { return blocking, nil }, LimitMiddleware(1))
+
+		first, err := handlerFunc()
+		require.NoError(t, err)
+
+		complete := make(chan error)
+		go func() {
+			_, err := first.Handle(context.Background(), &Request{})
+			complete <- err
+		}()
+		<-blocking.started
+
+		second, err := handlerFunc()
+		require.NoError(t, err)
+
+		_, err = second.Handle(context.Background(), &Request{})
+		require.EqualError(t, err, "Too many sessions (limit=1)")
+
+		close(blocking.release)
+		require.NoError(t, <-complete)
+
+		go func() { <-blocking.started }()
+		_, err = second.Handle(context.Background(), &Request{})
+		require.NoError(t, err)
+	})
+
+	t.Run("fail to signal handler without signals support", func(t *testing.T) {
+		handler, err := Chain(echoFunc, AccountingMiddleware())()
+		require.NoError(t, err)
+
+		require.EqualError(t, handler.(Signaler).Signal("TERM"), "Signals are not supported by handler")
+	})
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultProcPath is a mount point of the host procfs
+	DefaultProcPath = "/proc"
+
+	// DefaultNsenterPath is a nsenter binary from util-linux
+	DefaultNsenterPath = "nsenter"
+
+	// DefaultMesosWorkDir is a work directory of the mesos agent
+	DefaultMesosWorkDir = "/var/lib/mesos"
+
+	// nsenterPath is the only variable of nsenter itself, the task environment is
+	// passed to the session inside namespaces, so the host loader never sees it
+	nsenterPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// mesosTaskIDEnv is the payload env selecting the task
+	mesosTaskIDEnv = "MESOS_TASK_ID="
+)
+
+// envName matches variables which can be passed to env binary as arguments
+var envName = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*=")
+
+// NsenterHandlerOptions keeps options for a new handler instance
+type NsenterHandlerOptions struct {
+	// ProcPath is a mount point of the host procfs
+	ProcPath string
+
+	// Nsenter is a path to the nsenter binary
+	Nsenter string
+
+	// MesosWorkDir is a work directory of the mesos agent, it maps tasks to containers
+	MesosWorkDir string
+
+	Shells []string
+	Policy ExecPolicy
+}
+
+// findTaskProcess looks for the task container in the agent metadata, the task id is
+// an executor id of the mesos command executor, <work dir>/meta/slaves/*/frameworks/*/executors/<task id>/runs/latest
+// links to the container id. Processes are matched by the container cgroup, which tasks cannot change,
+// and only processes in a mount namespace other than ours are accepted, so neither the executor
+// nor any other process running on the host can be entered
+func findTaskProcess(procPath string, workDir string, env string) (int, error) {
+	taskID := strings.TrimPrefix(env, mesosTaskIDEnv)
+	if !strings.HasPrefix(env, mesosTaskIDEnv) || taskID == "" {
+		return 0, fmt.Errorf("Container env must be %s<task id>, got '%s'", mesosTaskIDEnv, env)
+	}
+
+	if strings.ContainsAny(taskID, "/\\*?[") || taskID == "." || taskID == ".." {
+		return 0, fmt.Errorf("Invalid task id '%s'", taskID)
+	}
+
+	containerID, err := findTaskContainer(workDir, taskID)
+	if err != nil || containerID == "" {
+		return 0, err
+	}
+
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return 0, fmt.Errorf("Could not read %s (%s)", procPath, err)
+	}
+
+	pids := make([]int, 0)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		if inContainerCgroup(procPath, pid, containerID) {
+			pids = append(pids, pid)
+		}
+	}
+
+	if len(pids) == 0 {
+		return 0, nil
+	}
+
+	sort.Ints(pids)
+
+	hostNamespace, err := os.Readlink(path.Join(procPath, "self", "ns", "mnt"))
+	if err != nil {
+		return 0, fmt.Errorf("Could not read mount namespace of the proxy (%s)", err)
+	}
+
+	for _, pid := range pids {
+		namespace, err := os.Readlink(path.Join(procPath, strconv.Itoa(pid), "ns", "mnt"))
+		if err == nil && namespace != hostNamespace {
+			return pid, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// findTaskContainer returns the container id of the latest executor run, it's empty when not found
+func findTaskContainer(workDir string, taskID string) (string, error) {
+	pattern := path.Join(workDir, "meta", "slaves", "*", "frameworks", "*", "executors", taskID, "runs", "latest")
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) > 1 {
+		return "", fmt.Errorf("Task '%s' is run by several frameworks", taskID)
+	}
+
+	if len(matches) == 0 {
+		return "", nil
+	}
+
+	latest, err := os.Readlink(matches[0])
+	if err != nil {
+		return "", fmt.Errorf("Could not read container of task '%s' (%s)", taskID, err)
+	}
+
+	return path.Base(latest), nil
+}
+
+// inContainerCgroup checks /proc/PID/cgroup, mesos creates the cgroup <cgroups root>/<container id>
+// in every hierarchy, nested containers are placed below it
+func inContainerCgroup(procPath string, pid int, containerID string) bool {
+	raw, err := ioutil.ReadFile(path.Join(procPath, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) == 3 && containsString(strings.Split(fields[2], "/"), containerID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// taskEnviron keeps variables which are safe to pass as env arguments
+func taskEnviron(environ []string) []string {
+	vars := make([]string, 0, len(environ))
+	for _, env := range environ {
+		if envName.MatchString(env) {
+			vars = append(vars, env)
+		}
+	}
+	return vars
+}
+
+// readEnviron returns environment variables of the process
+func readEnviron(procPath string, pid int) ([]string, error) {
+	raw, err := ioutil.ReadFile(path.Join(procPath, strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return nil, err
+	}
+
+	environ := make([]string, 0)
+	for _, env := range bytes.Split(raw, []byte{0}) {
+		if len(env) > 0 {
+			environ = append(environ, string(env))
+		}
+	}
+
+	return environ, nil
+}
+
+// procFS reads files from a process root filesystem using /proc/PID/root
+type procFS struct {
+	root string
+}
+
+func newProcFS(procPath string, pid int) *procFS {
+	return &procFS{root: path.Join(procPath, strconv.Itoa(pid), "root")}
+}
+
+func (fs *procFS) readFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(fs.root, filename))
+}
+
+// fileExists doesn't follow symlinks, absolute links would be resolved against the host root
+func (fs *procFS) fileExists(filename string) bool {
+	_, err := os.Lstat(path.Join(fs.root, filename))
+	return err == nil
+}
+
+// resolveCredentials converts the user in docker format (name, uid, name:group or uid:gid)
+// into numeric uid and gid using /etc/passwd and /etc/group of the container
+func resolveCredentials(fs shellFS, user string) (string, string, error) {
+	fields := strings.SplitN(user, ":", 2)
+
+	uid := fields[0]
+	gid := ""
+
+	if _, err := strconv.Atoi(uid); err != nil {
+		entry, ok := lookupPasswd(fs, uid)
+		if !ok {
+			return "", "", fmt.Errorf("Could not found user '%s' in the container", uid)
+		}
+		uid = entry.uid
+		gid = entry.gid
+	} else if entry, ok := lookupPasswd(fs, uid); ok {
+		gid = entry.gid
+	}
+
+	if len(fields) == 2 {
+		gid = fields[1]
+		if _, err := strconv.Atoi(gid); err != nil {
+			found, ok := lookupGroup(fs, gid)
+			if !ok {
+				return "", "", fmt.Errorf("Could not found group '%s' in the container", gid)
+			}
+			gid = found
+		}
+	}
+
+	if gid == "" {
+		gid = uid
+	}
+
+	return uid, gid, nil
+}
+
+// lookupGroup returns gid of the group from /etc/group
+func lookupGroup(fs shellFS, name string) (string, bool) {
+	group, err := fs.readFile("/etc/group")
+	if err != nil {
+		return "", false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(group))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 4 && fields[0] == name {
+			return fields[2], true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,268 @@
+// +build linux
+
+package handlers
+
+import (
+	"context"
+	"dmexe.me/utils"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// NsenterHandler spawns a shell inside namespaces of the mesos task selected by the payload env,
+// it's used for tasks launched by the mesos containerizer, which are invisible to docker.
+// The session process is not moved into the task cgroups.
+type NsenterHandler struct {
+	procPath string
+	nsenter  string
+	workDir  string
+	shells   []string
+	policy   ExecPolicy
+	pty      *os.File
+	log      *logrus.Entry
+	cancel   context.CancelFunc
+}
+
+// NewNsenterHandler creates handler for nsenter requests
+func NewNsenterHandler(opts NsenterHandlerOptions) (*NsenterHandler, error) {
+	procPath := opts.ProcPath
+	if procPath == "" {
+		procPath = DefaultProcPath
+	}
+
+	nsenter := opts.Nsenter
+	if nsenter == "" {
+		nsenter = DefaultNsenterPath
+	}
+
+	workDir := opts.MesosWorkDir
+	if workDir == "" {
+		workDir = DefaultMesosWorkDir
+	}
+
+	shells := opts.Shells
+	if len(shells) == 0 {
+		shells = DefaultShells
+	}
+
+	handler := &NsenterHandler{
+		procPath: procPath,
+		nsenter:  nsenter,
+		workDir:  workDir,
+		shells:   shells,
+		policy:   opts.Policy,
+		log:      utils.NewLogEntry("handler.nsenter"),
+	}
+
+	return handler, nil
+}
+
+// Handle given request, looking for the task process and start a shell in its namespaces
+func (h *NsenterHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	options, err := h.policy.resolve(req.Payload)
+	if err != nil {
+		return errResponse, err
+	}
+
+	if req.Payload.ContainerEnv == "" {
+		return errResponse, errors.New("Payload must contain container env (eg. MESOS_TASK_ID=...)")
+	}
+
+	pid, err := findTaskProcess(h.procPath, h.workDir, req.Payload.ContainerEnv)
+	if err != nil {
+		return errResponse, err
+	}
+
+	if pid == 0 {
+		return errResponse, fmt.Errorf("Could not found process for %v", req.Payload)
+	}
+
+	h.log.Debugf("Process found (pid=%d env=%s)", pid, req.Payload.ContainerEnv)
+
+	fs := newProcFS(h.procPath, pid)
+
+	if err := h.policy.checkUser(fs, options.user); err != nil {
+		return errResponse, err
+	}
+
+	uid, gid, err := resolveCredentials(fs, options.user)
+	if err != nil {
+		return errResponse, err
+	}
+
+	found, ok := findShell(fs, h.shells, options.user)
+	if !ok {
+		return errResponse, fmt.Errorf("Could not found shell for process pid=%d", pid)
+	}
+
+	h.log.Debugf("Shell found (%s)", strings.Join(found, " "))
+
+	environ, err := readEnviron(h.procPath, pid)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not read environ of process pid=%d (%s)", pid, err)
+	}
+
+	shell := defaultShell
+	shell.shell = found
+	shell.workingDir = options.workingDir
+	shell.vars = taskEnviron(environ)
+	shell.clearEnv = true
+
+	if !fs.fileExists(shell.env) {
+		return errResponse, fmt.Errorf("Could not found %s for process pid=%d", shell.env, pid)
+	}
+
+	// the task environment is set by env -i inside namespaces, nsenter runs with a fixed one
+	cmdline := shell.cmdline(&Request{Exec: req.Exec, Tty: req.Tty})
+	nsenterEnv := []string{nsenterPath}
+	if req.Tty != nil {
+		nsenterEnv = append(nsenterEnv, fmt.Sprintf("TERM=%s", req.Tty.Term))
+	}
+
+	args := []string{
+		"--target", strconv.Itoa(pid),
+		"--mount", "--uts", "--ipc", "--net", "--pid", "--root",
+		"--setuid", uid,
+		"--setgid", gid,
+		"--",
+	}
+
+	return h.startSession(ctx, append(args, cmdline...), nsenterEnv, req)
+}
+
+func (h *NsenterHandler) startSession(ctx context.Context, args []string, environ []string, req *Request) (Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.cancel = cancel
+
+	cmd := exec.CommandContext(ctx, h.nsenter, args...)
+	cmd.Env = environ
+
+	h.log.Debugf("Process session with cmdline (%s %s)", h.nsenter, strings.Join(args, " "))
+
+	var streams sync.WaitGroup
+
+	if req.Tty != nil {
+		master, slave, err := openPty()
+		if err != nil {
+			return errResponse, fmt.Errorf("Could not allocate pty (%s)", err)
+		}
+		defer master.Close()
+
+		h.pty = master
+
+		if err := h.Resize(req.Tty.Resize()); err != nil {
+			h.log.Errorf("Could not resize tty (%s)", err)
+		}
+
+		cmd.Stdin = slave
+		cmd.Stdout = slave
+		cmd.Stderr = slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+		}
+
+		if err := cmd.Start(); err != nil {
+			slave.Close()
+			return errResponse, fmt.Errorf("Could not start nsenter (%s)", err)
+		}
+		slave.Close()
+
+		go io.Copy(master, req.Stdin)
+
+		// reading master fails with EIO when the session process exited
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			io.Copy(req.Stdout, master)
+		}()
+
+	} else {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return errResponse, err
+		}
+		cmd.Stdout = req.Stdout
+		cmd.Stderr = req.Stderr
+
+		if err := cmd.Start(); err != nil {
+			return errResponse, fmt.Errorf("Could not start nsenter (%s)", err)
+		}
+
+		// ssh stdin may never be closed, so it's not waited like stdout and stderr
+		go func() {
+			io.Copy(stdin, req.Stdin)
+			stdin.Close()
+		}()
+	}
+
+	h.log.Infof("Process session started (pid=%d)", cmd.Process.Pid)
+
+	err := cmd.Wait()
+	streams.Wait()
+
+	if ctx.Err() != nil {
+		h.log.Debugf("Context done")
+		return Response{Code: 0}, nil
+	}
+
+	code, err := exitCode(err)
+	if err != nil {
+		return errResponse, fmt.Errorf("Could not wait process pid=%d (%s)", cmd.Process.Pid, err)
+	}
+
+	h.log.Debugf("Process exited with code %d", code)
+
+	return Response{Code: code}, nil
+}
+
+// exitCode converts the process state into a shell-like exit code
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, err
+	}
+
+	if status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+
+	return status.ExitStatus(), nil
+}
+
+// Resize tty, ignored if current request haven't tty
+func (h *NsenterHandler) Resize(req *Resize) error {
+	if req != nil && h.pty != nil {
+		if err := resizePty(h.pty, req); err != nil {
+			return fmt.Errorf("Could not resize tty (%s)", err)
+		}
+		h.log.Debugf("Tty resized to %dx%d", req.Width, req.Height)
+	}
+	return nil
+}
+
+// Close current session
+func (h *NsenterHandler) Close() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package handlers
+
+import (
+	"errors"
+)
+
+// NsenterHandler is available only on linux
+type NsenterHandler struct {
+	Handler
+}
+
+// NewNsenterHandler always fails, namespaces are linux specific
+func NewNsenterHandler(opts NsenterHandlerOptions) (*NsenterHandler, error) {
+	return nil, errors.New("Nsenter handler is supported only on linux")
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestProcess(t *testing.T, procPath string, pid string, environ string, cgroup string, namespace string) {
+	dir := path.Join(procPath, pid)
+	require.NoError(t, os.MkdirAll(path.Join(dir, "ns"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "environ"), []byte(environ), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "cgroup"), []byte(cgroup), 0644))
+	require.NoError(t, os.Symlink(namespace, path.Join(dir, "ns", "mnt")))
+}
+
+func newTestExecutorRun(t *testing.T, workDir string, framework string, taskID string, containerID string) {
+	runs := path.Join(workDir, "meta", "slaves", "s1", "frameworks", framework, "executors", taskID, "runs")
+	require.NoError(t, os.MkdirAll(path.Join(runs, containerID), 0755))
+	require.NoError(t, os.Symlink(path.Join(runs, containerID), path.Join(runs, "latest")))
+}
+
+func Test_FindTaskProcess(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(procPath)
+
+	workDir, err := ioutil.TempDir("", "mesos")
+	require.NoError(t, err)
+	defer os.RemoveAll(workDir)
+
+	newTestExecutorRun(t, workDir, "f1", "app.1", "c1")
+	newTestExecutorRun(t, workDir, "f1", "app.2", "c2")
+	newTestExecutorRun(t, workDir, "f1", "app.3", "c3")
+	newTestExecutorRun(t, workDir, "f2", "app.3", "c4")
+
+	newTestProcess(t, procPath, "self", "", "4:memory:/\n", "mnt:[1]")
+	newTestProcess(t, procPath, "10", "MESOS_TASK_ID=app.1\x00", "4:memory:/mesos/c1\n", "mnt:[1]")
+	newTestProcess(t, procPath, "42", "PATH=/bin\x00", "4:memory:/mesos/c1\n", "mnt:[2]")
+	newTestProcess(t, procPath, "30", "MESOS_TASK_ID=app.1\x00", "4:memory:/mesos/c1/mesos/n1\n", "mnt:[2]")
+	newTestProcess(t, procPath, "20", "MESOS_TASK_ID=app.1\x00", "4:memory:/mesos/c5\n", "mnt:[3]")
+	newTestProcess(t, procPath, "50", "MESOS_TASK_ID=app.2\x00", "4:memory:/mesos/c2\n", "mnt:[1]")
+
+	t.Run("should find process in container cgroup and other mount namespace", func(t *testing.T) {
+		pid, err := findTaskProcess(procPath, workDir, "MESOS_TASK_ID=app.1")
+		require.NoError(t, err)
+		require.Equal(t, 30, pid)
+	})
+
+	t.Run("return zero when all processes share the host mount namespace", func(t *testing.T) {
+		pid, err := findTaskProcess(procPath, workDir, "MESOS_TASK_ID=app.2")
+		require.NoError(t, err)
+		require.Equal(t, 0, pid)
+	})
+
+	t.Run("fail on variables other than task id", func(t *testing.T) {
+		_, err := findTaskProcess(procPath, workDir, "PATH=/bin")
+		require.EqualError(t, err, "Container env must be MESOS_TASK_ID=<task id>, got 'PATH=/bin'")
+
+		_, err = findTaskProcess(procPath, workDir, "MESOS_TASK_ID=")
+		require.Error(t, err)
+
+		_, err = findTaskProcess(procPath, workDir, "MESOS_TASK_ID=*")
+		require.EqualError(t, err, "Invalid task id '*'")
+	})
+
+	t.Run("fail when task id is run by several frameworks", func(t *testing.T) {
+		_, err := findTaskProcess(procPath, workDir, "MESOS_TASK_ID=app.3")
+		require.EqualError(t, err, "Task 'app.3' is run by several frameworks")
+	})
+
+	t.Run("return zero when not found", func(t *testing.T) {
+		pid, err := findTaskProcess(procPath, workDir, "MESOS_TASK_ID=app")
+		require.NoError(t, err)
+		require.Equal(t, 0, pid)
+	})
+
+	t.Run("should read environ", func(t *testing.T) {
+		environ, err := readEnviron(procPath, 30)
+		require.NoError(t, err)
+		require.Equal(t, []string{"MESOS_TASK_ID=app.1"}, environ)
+	})
+
+	t.Run("should keep only valid variables", func(t *testing.T) {
+		environ := []string{"PATH=/bin", "-i=x", "A B=c", "_X1=a=b", "EMPTY="}
+		require.Equal(t, []string{"PATH=/bin", "_X1=a=b", "EMPTY="}, taskEnviron(environ))
+	})
+}
+
+func Test_ResolveCredentials(t *testing.T) {
+	fs := testShellFS{
+		"/etc/passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001:app:/home/app:/bin/sh\n",
+		"/etc/group":  "root:x:0:\nstaff:x:50:app\n",
+	}
+
+	t.Run("should resolve users", func(t *testing.T) {
+		uid, gid, err := resolveCredentials(fs, "app")
+		require.NoError(t, err)
+		require.Equal(t, []string{"1000", "1001"}, []string{uid, gid})
+
+		uid, gid, err = resolveCredentials(fs, "1000")
+		require.NoError(t, err)
+		require.Equal(t, []string{"1000", "1001"}, []string{uid, gid})
+
+		uid, gid, err = resolveCredentials(fs, "app:staff")
+		require.NoError(t, err)
+		require.Equal(t, []string{"1000", "50"}, []string{uid, gid})
+
+		uid, gid, err = resolveCredentials(fs, "2000:2000")
+		require.NoError(t, err)
+		require.Equal(t, []string{"2000", "2000"}, []string{uid, gid})
+
+		uid, gid, err = resolveCredentials(fs, "3000")
+		require.NoError(t, err)
+		require.Equal(t, []string{"3000", "3000"}, []string{uid, gid})
+	})
+
+	t.Run("fail when user not found", func(t *testing.T) {
+		_, _, err := resolveCredentials(fs, "nobody")
+		require.EqualError(t, err, "Could not found user 'nobody' in the container")
+
+		_, _, err = resolveCredentials(fs, "app:wheel")
+		require.EqualError(t, err, "Could not found group 'wheel' in the container")
+	})
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"dmexe.me/payloads"
+	"dmexe.me/utils"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugin protocol
+//
+// The proxy starts the plugin executable for every session and exchanges frames
+// over the plugin stdin and stdout, the plugin stderr is written to the proxy log.
+// A frame is a 4 bytes big endian length of the body, a frame type byte and the body.
+//
+// proxy -> plugin
+// * request - pluginRequest json, always the first frame
+// * stdin   - raw bytes of the client stdin, an empty body means the stdin is closed
+// * resize  - pluginResize json
+// * signal  - signal name without SIG prefix (eg. TERM)
+//
+// plugin -> proxy
+// * stdout, stderr - raw bytes written to the client
+// * exit           - pluginExit json, the last frame of the session
+const (
+	pluginFrameRequest = 0
+	pluginFrameStdin   = 1
+	pluginFrameStdout  = 2
+	pluginFrameStderr  = 3
+	pluginFrameResize  = 4
+	pluginFrameSignal  = 5
+	pluginFrameExit    = 6
+
+	pluginMaxFrameLength = 1024 * 1024
+
+	// pluginDefaultPath is used when the proxy has no PATH variable
+	pluginDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// pluginExitTimeout is a grace period for the plugin to exit after the exit frame
+	pluginExitTimeout = 5 * time.Second
+)
+
+// pluginRequest describes the session, user and working directory are resolved by the policy
+type pluginRequest struct {
+	Payload    payloads.Payload `json:"payload"`
+	Tty        *Tty             `json:"tty,omitempty"`
+	Exec       string           `json:"exec,omitempty"`
+	User       string           `json:"user"`
+	WorkingDir string           `json:"workingDir,omitempty"`
+	Privileged bool             `json:"privileged,omitempty"`
+}
+
+type pluginResize struct {
+	Width  uint32 `json:"width"`
+	Height uint32 `json:"height"`
+}
+
+type pluginExit struct {
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// PluginHandler runs sessions using an external executable speaking the plugin protocol
+type PluginHandler struct {
+	sync.Mutex
+	path   string
+	args   []string
+	env    []string
+	policy ExecPolicy
+	stdin  io.WriteCloser
+	log    *logrus.Entry
+	cancel context.CancelFunc
+
+	exitTimeout time.Duration
+}
+
+// PluginHandlerOptions keeps options for a new handler instance
+type PluginHandlerOptions struct {
+	Path string
+	Args []string
+
+	// Env is the plugin environment besides PATH, the proxy environment is not
+	// inherited since it contains secrets (eg. JWT_SECRET)
+	Env []string
+
+	Policy ExecPolicy
+}
+
+// NewPluginHandler creates handler for plugin sessions
+func NewPluginHandler(opts PluginHandlerOptions) (*PluginHandler, error) {
+	if opts.Path == "" {
+		return nil, errors.New("Plugin path cannot be empty")
+	}
+
+	handler := &PluginHandler{
+		path:   opts.Path,
+		args:   opts.Args,
+		env:    opts.Env,
+		policy: opts.Policy,
+		log:    utils.NewLogEntry("handler.plugin").WithField("plugin", opts.Path),
+
+		exitTimeout: pluginExitTimeout,
+	}
+
+	return handler, nil
+}
+
+// Handle given request, starting the plugin and bridging the session to it
+func (h *PluginHandler) Handle(ctx context.Context, req *Request) (Response, error) {
+	options, err := h.policy.resolve(req.Payload)
+	if err != nil {
+		return errResponse, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.cancel = cancel
+
+	cmd := exec.CommandContext(ctx, h.path, h.args...)
+	cmd.Env = pluginEnviron(h.env)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errResponse, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errResponse, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errResponse, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errResponse, fmt.Errorf("Could not start plugin (%s)", err)
+	}
+
+	h.log.Infof("Plugin started (pid=%d)", cmd.Process.Pid)
+
+	logged := make(chan struct{})
+	go func() {
+		h.logStderr(stderr)
+		close(logged)
+	}()
+
+	pluginReq := pluginRequest{
+		Payload:    req.Payload,
+		Tty:        req.Tty,
+		Exec:       req.Exec,
+		User:       options.user,
+		WorkingDir: options.workingDir,
+		Privileged: options.privileged,
+	}
+
+	body, err := json.Marshal(pluginReq)
+	if err == nil {
+		err = writePluginFrame(stdin, pluginFrameRequest, body)
+	}
+	if err != nil {
+		cancel()
+		stdin.Close()
+		<-logged
+		cmd.Wait()
+		return errResponse, fmt.Errorf("Could not send request to plugin (%s)", err)
+	}
+
+	h.setStdin(stdin)
+
+	go h.copyStdin(req.Stdin)
+
+	exit, err := h.readOutput(stdout, req)
+	closed := ctx.Err() != nil
+
+	// the plugin is killed when it breaks the protocol
+	if err != nil {
+		cancel()
+	}
+
+	// plugins reading stdin until EOF would never exit otherwise
+	h.closeStdin()
+
+	// nothing reads stdout after the exit frame, the plugin is killed when it doesn't exit in time
+	timer := time.AfterFunc(h.exitTimeout, cancel)
+	defer timer.Stop()
+
+	<-logged
+	cmd.Wait()
+
+	if closed {
+		h.log.Debugf("Context done")
+		return Response{Code: 0}, nil
+	}
+
+	if err != nil {
+		return errResponse, err
+	}
+
+	if exit.Error != "" {
+		return Response{Code: exit.Code}, fmt.Errorf("Plugin failed (%s)", exit.Error)
+	}
+
+	h.log.Debugf("Plugin exited with code %d", exit.Code)
+
+	return Response{Code: exit.Code}, nil
+}
+
+// readOutput copies output frames to the client until the exit frame
+func (h *PluginHandler) readOutput(r io.Reader, req *Request) (pluginExit, error) {
+	exit := pluginExit{}
+
+	for {
+		kind, body, err := readPluginFrame(r)
+		if err == io.EOF {
+			return exit, errors.New("Plugin exited without exit code")
+		}
+		if err != nil {
+			return exit, fmt.Errorf("Could not read plugin frame (%s)", err)
+		}
+
+		switch kind {
+		case pluginFrameStdout:
+			_, err = req.Stdout.Write(body)
+		case pluginFrameStderr:
+			_, err = req.Stderr.Write(body)
+		case pluginFrameExit:
+			if err := json.Unmarshal(body, &exit); err != nil {
+				return exit, fmt.Errorf("Could not parse plugin exit (%s)", err)
+			}
+			return exit, nil
+		default:
+			return exit, fmt.Errorf("Unknown plugin frame type %d", kind)
+		}
+
+		if err != nil {
+			return exit, fmt.Errorf("Could not write session output (%s)", err)
+		}
+	}
+}
+
+func (h *PluginHandler) copyStdin(r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := h.send(pluginFrameStdin, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			h.send(pluginFrameStdin, nil)
+			return
+		}
+	}
+}
+
+func (h *PluginHandler) logStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		h.log.Info(strings.TrimSpace(scanner.Text()))
+	}
+}
+
+// send writes the frame to the plugin, frames are written by several goroutines
+func (h *PluginHandler) send(kind byte, body []byte) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.stdin == nil {
+		return errors.New("Plugin is not running")
+	}
+
+	return writePluginFrame(h.stdin, kind, body)
+}
+
+func (h *PluginHandler) setStdin(stdin io.WriteCloser) {
+	h.Lock()
+	defer h.Unlock()
+	h.stdin = stdin
+}
+
+func (h *PluginHandler) closeStdin() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.stdin != nil {
+		h.stdin.Close()
+		h.stdin = nil
+	}
+}
+
+// Resize sends the resize frame to the plugin
+func (h *PluginHandler) Resize(req *Resize) error {
+	if req == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(pluginResize{Width: req.Width, Height: req.Height})
+	if err != nil {
+		return err
+	}
+
+	if err := h.send(pluginFrameResize, body); err != nil {
+		return fmt.Errorf("Could not send resize to plugin (%s)", err)
+	}
+
+	return nil
+}
+
+// Signal sends the signal frame to the plugin
+func (h *PluginHandler) Signal(name string) error {
+	if err := h.send(pluginFrameSignal, []byte(name)); err != nil {
+		return fmt.Errorf("Could not send signal %s to plugin (%s)", name, err)
+	}
+	return nil
+}
+
+// Close current session, the plugin process is killed
+func (h *PluginHandler) Close() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// pluginEnviron returns PATH of the proxy and given variables
+func pluginEnviron(env []string) []string {
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = pluginDefaultPath
+	}
+	return append([]string{"PATH=" + path}, env...)
+}
+
+func writePluginFrame(w io.Writer, kind byte, body []byte) error {
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	frame[4] = kind
+	copy(frame[5:], body)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readPluginFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length > pluginMaxFrameLength {
+		return 0, nil, fmt.Errorf("Frame is too long (%d)", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header[4], body, nil
+}
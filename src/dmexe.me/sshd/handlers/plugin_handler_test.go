@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"dmexe.me/payloads"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test_PluginHelper is not a real test, it's the plugin executable started by Test_PluginHandler.
+// The plugin prints the request, echoes stdin to stderr, reports resizes, exits with the code
+// passed as "exit N", prints its environment on "env", sends the exit code on "linger" but
+// exits only when stdin is closed, keeps writing output after the exit code on "hang"
+// and exits by a signal
+func Test_PluginHelper(t *testing.T) {
+	if os.Getenv("TEST_PLUGIN_HELPER") != "1" {
+		return
+	}
+
+	exit := func(code int) {
+		body, _ := json.Marshal(pluginExit{Code: code})
+		writePluginFrame(os.Stdout, pluginFrameExit, body)
+		os.Exit(0)
+	}
+
+	_, body, err := readPluginFrame(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	req := pluginRequest{}
+	json.Unmarshal(body, &req)
+
+	fmt.Fprintf(os.Stderr, "plugin started\n")
+	writePluginFrame(os.Stdout, pluginFrameStdout, []byte(fmt.Sprintf("user=%s dir=%s exec=%s tty=%v cid=%s\n",
+		req.User, req.WorkingDir, req.Exec, req.Tty != nil, req.Payload.ContainerID)))
+
+	for {
+		kind, body, err := readPluginFrame(os.Stdin)
+		if err != nil {
+			os.Exit(1)
+		}
+
+		switch kind {
+		case pluginFrameStdin:
+			var code int
+			if _, err := fmt.Sscanf(string(body), "exit %d", &code); err == nil {
+				exit(code)
+			}
+
+			switch string(body) {
+			case "env":
+				writePluginFrame(os.Stdout, pluginFrameStdout, []byte(strings.Join(os.Environ(), "\n")))
+			case "hang":
+				reply, _ := json.Marshal(pluginExit{Code: 7})
+				writePluginFrame(os.Stdout, pluginFrameExit, reply)
+				for {
+					writePluginFrame(os.Stdout, pluginFrameStdout, make([]byte, 32*1024))
+				}
+			case "linger":
+				reply, _ := json.Marshal(pluginExit{Code: 5})
+				writePluginFrame(os.Stdout, pluginFrameExit, reply)
+				ioutil.ReadAll(os.Stdin)
+				os.Exit(0)
+			default:
+				writePluginFrame(os.Stdout, pluginFrameStderr, body)
+			}
+
+		case pluginFrameResize:
+			size := pluginResize{}
+			json.Unmarshal(body, &size)
+			writePluginFrame(os.Stdout, pluginFrameStdout, []byte(fmt.Sprintf("resize %dx%d\n", size.Width, size.Height)))
+
+		case pluginFrameSignal:
+			if string(body) == "TERM" {
+				exit(143)
+			}
+		}
+	}
+}
+
+func Test_PluginHandler(t *testing.T) {
+	newTestHandler := func() *PluginHandler {
+		handler, err := NewPluginHandler(PluginHandlerOptions{
+			Path:   os.Args[0],
+			Args:   []string{"-test.run=Test_PluginHelper"},
+			Env:    []string{"TEST_PLUGIN_HELPER=1"},
+			Policy: ExecPolicy{DefaultUser: "app", DefaultWorkingDir: "/app"},
+		})
+		require.NoError(t, err)
+		return handler
+	}
+
+	payload := payloads.Payload{ContainerID: "vm-1"}
+
+	t.Run("should exec in plugin", func(t *testing.T) {
+		handler := newTestHandler()
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+
+		req := &Request{
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  stderr,
+			Exec:    "cat",
+			Payload: payload,
+		}
+
+		go func() {
+			input.Write([]byte("hello\n"))
+			time.Sleep(50 * time.Millisecond)
+			input.Write([]byte("exit 3"))
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 3, response.Code)
+		require.Equal(t, "user=app dir=/app exec=cat tty=false cid=vm-1\n", stdout.String())
+		require.Equal(t, "hello\n", stderr.String())
+	})
+
+	t.Run("should resize and signal plugin", func(t *testing.T) {
+		handler := newTestHandler()
+		defer handler.Close()
+
+		stdin, _ := io.Pipe()
+		stdout := new(bytes.Buffer)
+
+		req := &Request{
+			Tty:     &Tty{Term: "xterm", Width: 80, Height: 24},
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  stdout,
+			Payload: payload,
+		}
+
+		go func() {
+			for handler.Resize(&Resize{Width: 100, Height: 40}) != nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			handler.Signal("TERM")
+		}()
+
+		response, err := handler.Handle(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 143, response.Code)
+		require.Equal(t, "user=app dir=/app exec= tty=true cid=vm-1\nresize 100x40\n", stdout.String())
+	})
+
+	t.Run("should not pass proxy environment to plugin", func(t *testing.T) {
+		os.Setenv("JWT_SECRET", "secret")
+		defer os.Unsetenv("JWT_SECRET")
+
+		handler := newTestHandler()
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+
+		go func() {
+			input.Write([]byte("env"))
+			time.Sleep(50 * time.Millisecond)
+			input.Write([]byte("exit 0"))
+		}()
+
+		_, err := handler.Handle(context.Background(), &Request{Stdin: stdin, Stdout: stdout, Stderr: stdout, Payload: payload})
+		require.NoError(t, err)
+		require.Contains(t, stdout.String(), "TEST_PLUGIN_HELPER=1")
+		require.Contains(t, stdout.String(), "PATH=")
+		require.NotContains(t, stdout.String(), "JWT_SECRET")
+	})
+
+	t.Run("should close plugin stdin after exit frame", func(t *testing.T) {
+		handler := newTestHandler()
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+		stdout := new(bytes.Buffer)
+
+		go input.Write([]byte("linger"))
+
+		done := make(chan Response)
+		go func() {
+			response, _ := handler.Handle(context.Background(), &Request{Stdin: stdin, Stdout: stdout, Stderr: stdout, Payload: payload})
+			done <- response
+		}()
+
+		select {
+		case response := <-done:
+			require.Equal(t, 5, response.Code)
+		case <-time.After(5 * time.Second):
+			t.Fatal("plugin waits for stdin EOF")
+		}
+	})
+
+	t.Run("should kill plugin not exited after exit frame", func(t *testing.T) {
+		handler := newTestHandler()
+		handler.exitTimeout = 100 * time.Millisecond
+		defer handler.Close()
+
+		stdin, input := io.Pipe()
+
+		go input.Write([]byte("hang"))
+
+		done := make(chan Response)
+		go func() {
+			response, _ := handler.Handle(context.Background(), &Request{Stdin: stdin, Stdout: ioutil.Discard, Stderr: ioutil.Discard, Payload: payload})
+			done <- response
+		}()
+
+		select {
+		case response := <-done:
+			require.Equal(t, 7, response.Code)
+		case <-time.After(5 * time.Second):
+			t.Fatal("plugin is not killed after exit frame")
+		}
+	})
+
+	t.Run("fail when plugin exits without code", func(t *testing.T) {
+		handler, err := NewPluginHandler(PluginHandlerOptions{Path: "true"})
+		require.NoError(t, err)
+		defer handler.Close()
+
+		stdin, _ := io.Pipe()
+
+		_, err = handler.Handle(context.Background(), &Request{Stdin: stdin, Payload: payload})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"dmexe.me/payloads"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DefaultExecUser is used when neither payload nor policy specify a user
+const DefaultExecUser = "nobody"
+
+// ExecPolicy restricts users, working directories and privileges requested by payloads
+type ExecPolicy struct {
+	// DefaultUser is used when payload doesn't specify a user
+	DefaultUser string
+
+	// AllowedUsers is a whitelist of users, empty list allows any non root user
+	AllowedUsers []string
+
+	// AllowRoot allows sessions as root
+	AllowRoot bool
+
+	// AllowPrivileged allows privileged sessions
+	AllowPrivileged bool
+
+	// DefaultWorkingDir is used when payload doesn't specify a working directory
+	DefaultWorkingDir string
+}
+
+// execOptions keeps resolved parameters of a session process
+type execOptions struct {
+	user       string
+	workingDir string
+	privileged bool
+}
+
+// resolve applies the policy to the payload, fails when payload requests more than allowed
+func (p ExecPolicy) resolve(payload payloads.Payload) (execOptions, error) {
+	opts := execOptions{
+		user:       payload.User,
+		workingDir: payload.WorkingDir,
+		privileged: payload.Privileged,
+	}
+
+	if opts.user == "" {
+		opts.user = payload.Policy.User
+	}
+
+	if opts.user == "" {
+		opts.user = p.DefaultUser
+	}
+
+	if opts.user == "" {
+		opts.user = DefaultExecUser
+	}
+
+	if opts.workingDir == "" {
+		opts.workingDir = p.DefaultWorkingDir
+	}
+
+	if isRootUser(opts.user) && !p.AllowRoot {
+		return opts, fmt.Errorf("User '%s' is not allowed by policy", opts.user)
+	}
+
+	if len(p.AllowedUsers) > 0 && !isRootUser(opts.user) && !containsString(p.AllowedUsers, opts.user) {
+		return opts, fmt.Errorf("User '%s' is not allowed by policy", opts.user)
+	}
+
+	if payload.Policy.User != "" && opts.user != payload.Policy.User {
+		return opts, fmt.Errorf("User '%s' is not allowed by token policy", opts.user)
+	}
+
+	if opts.privileged && !p.AllowPrivileged {
+		return opts, fmt.Errorf("Privileged session is not allowed by policy")
+	}
+
+	if opts.workingDir != "" && !path.IsAbs(opts.workingDir) {
+		return opts, fmt.Errorf("Working directory must be an absolute path, got '%s'", opts.workingDir)
+	}
+
+	return opts, nil
+}
+
+// checkUser resolves the user against /etc/passwd and /etc/group of the container,
+// other names could be aliases of root (eg. toor)
+func (p ExecPolicy) checkUser(fs shellFS, user string) error {
+	if p.AllowRoot {
+		return nil
+	}
+
+	uid, gid, err := resolveCredentials(fs, user)
+	if err != nil {
+		return err
+	}
+
+	if isRootUser(uid + ":" + gid) {
+		return fmt.Errorf("User '%s' is not allowed by policy", user)
+	}
+
+	return nil
+}
+
+// isRootUser checks user in docker format (name, uid, name:group or uid:gid),
+// the user is root when either the user or the group is root
+func isRootUser(user string) bool {
+	for _, name := range strings.SplitN(user, ":", 2) {
+		if name == "root" {
+			return true
+		}
+		if id, err := strconv.Atoi(name); err == nil && id == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(items []string, item string) bool {
+	for _, it := range items {
+		if it == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"dmexe.me/payloads"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ExecPolicy(t *testing.T) {
+
+	t.Run("should use defaults", func(t *testing.T) {
+		opts, err := ExecPolicy{}.resolve(payloads.Payload{})
+		require.NoError(t, err)
+		require.Equal(t, execOptions{user: DefaultExecUser}, opts)
+
+		opts, err = ExecPolicy{DefaultUser: "app", DefaultWorkingDir: "/app"}.resolve(payloads.Payload{})
+		require.NoError(t, err)
+		require.Equal(t, execOptions{user: "app", workingDir: "/app"}, opts)
+	})
+
+	t.Run("should use payload", func(t *testing.T) {
+		policy := ExecPolicy{
+			AllowedUsers:    []string{"app"},
+			AllowRoot:       true,
+			AllowPrivileged: true,
+		}
+
+		opts, err := policy.resolve(payloads.Payload{User: "root", WorkingDir: "/tmp", Privileged: true})
+		require.NoError(t, err)
+		require.Equal(t, execOptions{user: "root", workingDir: "/tmp", privileged: true}, opts)
+
+		opts, err = policy.resolve(payloads.Payload{User: "app"})
+		require.NoError(t, err)
+		require.Equal(t, execOptions{user: "app"}, opts)
+	})
+
+	t.Run("fail when payload exceeds policy", func(t *testing.T) {
+		policy := ExecPolicy{
+			AllowedUsers: []string{"app"},
+		}
+
+		_, err := policy.resolve(payloads.Payload{User: "root"})
+		require.EqualError(t, err, "User 'root' is not allowed by policy")
+
+		_, err = policy.resolve(payloads.Payload{User: "0:0"})
+		require.EqualError(t, err, "User '0:0' is not allowed by policy")
+
+		for _, user := range []string{"00", "0000", "app:0", "app:root", "+0"} {
+			_, err = policy.resolve(payloads.Payload{User: user})
+			require.EqualError(t, err, fmt.Sprintf("User '%s' is not allowed by policy", user))
+		}
+
+		_, err = policy.resolve(payloads.Payload{User: "guest"})
+		require.EqualError(t, err, "User 'guest' is not allowed by policy")
+
+		_, err = policy.resolve(payloads.Payload{User: "app", Privileged: true})
+		require.EqualError(t, err, "Privileged session is not allowed by policy")
+
+		_, err = policy.resolve(payloads.Payload{User: "app", WorkingDir: "tmp"})
+		require.EqualError(t, err, "Working directory must be an absolute path, got 'tmp'")
+	})
+
+	t.Run("should apply token policy user", func(t *testing.T) {
+		tokenPolicy := payloads.Policy{User: "app"}
+
+		opts, err := ExecPolicy{DefaultUser: "web"}.resolve(payloads.Payload{Policy: tokenPolicy})
+		require.NoError(t, err)
+		require.Equal(t, execOptions{user: "app"}, opts)
+
+		_, err = ExecPolicy{}.resolve(payloads.Payload{User: "web", Policy: tokenPolicy})
+		require.EqualError(t, err, "User 'web' is not allowed by token policy")
+	})
+}
+
+func Test_ExecPolicyCheckUser(t *testing.T) {
+	fs := testShellFS{
+		"/etc/passwd": "root:x:0:0:root:/root:/bin/sh\ntoor:x:0:0:root:/root:/bin/sh\nop:x:1000:0:op:/:/bin/sh\napp:x:1000:1000:app:/:/bin/sh\n",
+		"/etc/group":  "root:x:0:\nwheel:x:0:\n",
+	}
+
+	t.Run("should allow non root users", func(t *testing.T) {
+		require.NoError(t, ExecPolicy{}.checkUser(fs, "app"))
+		require.NoError(t, ExecPolicy{}.checkUser(fs, "2000"))
+		require.NoError(t, ExecPolicy{AllowRoot: true}.checkUser(fs, "toor"))
+	})
+
+	t.Run("fail when user resolves to root", func(t *testing.T) {
+		for _, user := range []string{"toor", "op", "app:wheel"} {
+			err := ExecPolicy{}.checkUser(fs, user)
+			require.EqualError(t, err, fmt.Sprintf("User '%s' is not allowed by policy", user))
+		}
+	})
+
+	t.Run("fail when user not found", func(t *testing.T) {
+		err := ExecPolicy{}.checkUser(fs, "nobody")
+		require.EqualError(t, err, "Could not found user 'nobody' in the container")
+	})
+}
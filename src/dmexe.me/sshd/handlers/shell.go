@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DefaultShells is a list of shells in order of preference used when
+// a user shell from /etc/passwd is not usable, each item may contain arguments (eg. busybox sh)
+var DefaultShells = []string{"/bin/bash", "/bin/ash", "/bin/sh", "/bin/busybox sh"}
+
+// containerShell keeps binaries used to spawn session processes inside a container
+type containerShell struct {
+	env        string
+	shell      []string
+	vars       []string
+	workingDir string
+
+	// clearEnv starts the shell with vars only using env -i
+	clearEnv bool
+}
+
+var defaultShell = containerShell{
+	env:   "/usr/bin/env",
+	shell: []string{"/bin/sh"},
+}
+
+// cmdline builds a command for the request, shell sessions are started as login shells,
+// exec requests are passed to the shell using -c, so pipes, globs etc. work like in real ssh
+func (s containerShell) cmdline(req *Request) []string {
+	vars := append([]string{}, s.vars...)
+	if req.Tty != nil {
+		vars = append(vars, fmt.Sprintf("TERM=%s", req.Tty.Term))
+	}
+
+	args := append([]string{}, s.shell...)
+
+	switch {
+	case s.workingDir != "" && req.Exec != "":
+		args = append(args, "-c", fmt.Sprintf("cd %s && %s", shellQuote(s.workingDir), req.Exec))
+	case s.workingDir != "":
+		args = append(args, "-c", fmt.Sprintf("cd %s && exec %s -l", shellQuote(s.workingDir), strings.Join(s.shell, " ")))
+	case req.Exec != "":
+		args = append(args, "-c", req.Exec)
+	default:
+		args = append(args, "-l")
+	}
+
+	if len(vars) == 0 && !s.clearEnv {
+		return args
+	}
+
+	cmdline := []string{s.env}
+	if s.clearEnv {
+		cmdline = append(cmdline, "-i")
+	}
+	cmdline = append(cmdline, vars...)
+	return append(cmdline, args...)
+}
+
+// shellQuote quotes the string for sh
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+// shellFS gives access to files inside a container
+type shellFS interface {
+	readFile(filename string) ([]byte, error)
+	fileExists(filename string) bool
+}
+
+// passwdEntry keeps fields of /etc/passwd line
+type passwdEntry struct {
+	name  string
+	uid   string
+	gid   string
+	home  string
+	shell string
+}
+
+// findShell looks for the user shell in /etc/passwd, then falls back to given shells,
+// returns false when no shell found
+func findShell(fs shellFS, shells []string, user string) ([]string, bool) {
+	candidates := make([]string, 0)
+
+	if entry, ok := lookupPasswd(fs, user); ok && isLoginShell(entry.shell) {
+		candidates = append(candidates, entry.shell)
+	}
+	candidates = append(candidates, shells...)
+
+	for _, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fs.fileExists(fields[0]) {
+			return fields, true
+		}
+	}
+
+	return nil, false
+}
+
+// lookupPasswd finds the user in /etc/passwd, the user could be in docker format name:group or uid:gid
+func lookupPasswd(fs shellFS, user string) (passwdEntry, bool) {
+	passwd, err := fs.readFile("/etc/passwd")
+	if err != nil {
+		return passwdEntry{}, false
+	}
+
+	name := strings.SplitN(user, ":", 2)[0]
+
+	scanner := bufio.NewScanner(bytes.NewReader(passwd))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 7 || (fields[0] != name && fields[2] != name) {
+			continue
+		}
+
+		entry := passwdEntry{
+			name:  fields[0],
+			uid:   fields[2],
+			gid:   fields[3],
+			home:  fields[5],
+			shell: fields[6],
+		}
+		return entry, true
+	}
+
+	return passwdEntry{}, false
+}
+
+func isLoginShell(shell string) bool {
+	return shell != "" && !strings.HasSuffix(shell, "/nologin") && !strings.HasSuffix(shell, "/false")
+}
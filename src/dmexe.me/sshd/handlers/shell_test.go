@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ContainerShell(t *testing.T) {
+	shell := containerShell{
+		env:   "/usr/bin/env",
+		shell: []string{"/bin/busybox", "sh"},
+	}
+
+	t.Run("should start login shell", func(t *testing.T) {
+		cmdline := shell.cmdline(&Request{})
+		require.Equal(t, []string{"/bin/busybox", "sh", "-l"}, cmdline)
+	})
+
+	t.Run("should start login shell with tty", func(t *testing.T) {
+		cmdline := shell.cmdline(&Request{Tty: &Tty{Term: "xterm"}})
+		require.Equal(t, []string{"/usr/bin/env", "TERM=xterm", "/bin/busybox", "sh", "-l"}, cmdline)
+	})
+
+	t.Run("should wrap exec into shell", func(t *testing.T) {
+		cmdline := shell.cmdline(&Request{Exec: "ls -la | grep x && echo *"})
+		require.Equal(t, []string{"/bin/busybox", "sh", "-c", "ls -la | grep x && echo *"}, cmdline)
+	})
+
+	t.Run("should change working directory", func(t *testing.T) {
+		shell := shell
+		shell.workingDir = "/it's"
+
+		cmdline := shell.cmdline(&Request{})
+		require.Equal(t, []string{"/bin/busybox", "sh", "-c", "cd '/it'\\''s' && exec /bin/busybox sh -l"}, cmdline)
+
+		cmdline = shell.cmdline(&Request{Exec: "ls"})
+		require.Equal(t, []string{"/bin/busybox", "sh", "-c", "cd '/it'\\''s' && ls"}, cmdline)
+	})
+
+	t.Run("should clear environment", func(t *testing.T) {
+		shell := shell
+		shell.vars = []string{"HOME=/app"}
+		shell.clearEnv = true
+
+		cmdline := shell.cmdline(&Request{Exec: "ls"})
+		require.Equal(t, []string{"/usr/bin/env", "-i", "HOME=/app", "/bin/busybox", "sh", "-c", "ls"}, cmdline)
+	})
+}
+
+type testShellFS map[string]string
+
+func (fs testShellFS) readFile(filename string) ([]byte, error) {
+	if content, ok := fs[filename]; ok {
+		return []byte(content), nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (fs testShellFS) fileExists(filename string) bool {
+	_, ok := fs[filename]
+	return ok
+}
+
+func Test_FindShell(t *testing.T) {
+	fs := testShellFS{
+		"/etc/passwd":  "root:x:0:0:root:/root:/bin/zsh\nnobody:x:65534:65534:nobody:/:/sbin/nologin\n",
+		"/bin/zsh":     "",
+		"/bin/busybox": "",
+	}
+
+	t.Run("should use user shell", func(t *testing.T) {
+		shell, ok := findShell(fs, DefaultShells, "root")
+		require.True(t, ok)
+		require.Equal(t, []string{"/bin/zsh"}, shell)
+
+		shell, ok = findShell(fs, DefaultShells, "0:0")
+		require.True(t, ok)
+		require.Equal(t, []string{"/bin/zsh"}, shell)
+	})
+
+	t.Run("should fall back to shells", func(t *testing.T) {
+		shell, ok := findShell(fs, DefaultShells, "nobody")
+		require.True(t, ok)
+		require.Equal(t, []string{"/bin/busybox", "sh"}, shell)
+	})
+
+	t.Run("fail when no shell found", func(t *testing.T) {
+		_, ok := findShell(testShellFS{}, DefaultShells, "root")
+		require.False(t, ok)
+	})
+
+	t.Run("should lookup passwd", func(t *testing.T) {
+		entry, ok := lookupPasswd(fs, "65534")
+		require.True(t, ok)
+		require.Equal(t, passwdEntry{name: "nobody", uid: "65534", gid: "65534", home: "/", shell: "/sbin/nologin"}, entry)
+	})
+}
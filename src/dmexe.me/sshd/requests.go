@@ -37,6 +37,14 @@ func reqParseExecPayload(b []byte) ([]byte, error) {
 	return execBytes, nil
 }
 
+func reqParseSignalPayload(b []byte) (string, error) {
+	name, err := reqParseExecPayload(b)
+	if err != nil {
+		return "", fmt.Errorf("Could not read 'signal' request (%s)", err)
+	}
+	return string(name), nil
+}
+
 func reqParseWinchPayload(b []byte) (*handlers.Resize, error) {
 	if len(b) < 8 {
 		return nil, fmt.Errorf("Could not read 'window-change' request, expected buffer len >= 8, got=%d", len(b))
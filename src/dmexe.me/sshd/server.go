@@ -5,14 +5,19 @@ import (
 	"dmexe.me/payloads"
 	"dmexe.me/sshd/handlers"
 	"dmexe.me/utils"
+	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
+// DefaultHandshakeTimeout limits the ssh handshake including the client authentication
+const DefaultHandshakeTimeout = 30 * time.Second
+
 // ServerOptions keeps parameters for server instance
 type ServerOptions struct {
 	PrivateKey  []byte
@@ -20,23 +25,46 @@ type ServerOptions struct {
 	Port        uint
 	HandlerFunc handlers.HandlerFunc
 	Parser      payloads.Parser
+
+	// ModeFunc maps requests to session modes served by the handler, shell and exec by default
+	ModeFunc handlers.ModeFunc
+
+	// KeyBinding enables public key authentication, clients without keys are authenticated
+	// by keyboard-interactive without questions. Tokens bound to a key are rejected when
+	// it's disabled or the client isn't authenticated by the key
+	KeyBinding bool
+
+	// AllowedNetworks restricts client addresses, connections from other addresses are
+	// closed before the handshake
+	AllowedNetworks []*net.IPNet
+
+	// HandshakeTimeout closes connections not finished the handshake in time
+	HandshakeTimeout time.Duration
 }
 
+// permKeyFingerprint keeps the fingerprint of the key authenticated the client
+const permKeyFingerprint = "key-fingerprint"
+
 // Server implements sshd server
 type Server struct {
 	config        *ssh.ServerConfig
 	listenAddress string
 	handlerFunc   handlers.HandlerFunc
+	modeFunc      handlers.ModeFunc
 	listener      net.Listener
 	log           *logrus.Entry
+	audit         *logrus.Entry
 	parser        payloads.Parser
+	networks      []*net.IPNet
 	ctx           context.Context
+
+	handshakeTimeout time.Duration
 }
 
 // NewServer creates a new sshd server instance using given options
 func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
 	config := &ssh.ServerConfig{
-		NoClientAuth: true,
+		NoClientAuth: !opts.KeyBinding,
 	}
 
 	private, err := ssh.ParsePrivateKey(opts.PrivateKey)
@@ -46,18 +74,114 @@ func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
 
 	config.AddHostKey(private)
 
+	handshakeTimeout := opts.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = DefaultHandshakeTimeout
+	}
+
 	server := &Server{
 		config:        config,
 		listenAddress: fmt.Sprintf("%s:%d", opts.Host, opts.Port),
 		handlerFunc:   opts.HandlerFunc,
+		modeFunc:      opts.ModeFunc,
 		parser:        opts.Parser,
 		log:           utils.NewLogEntry("ssh.server"),
+		audit:         utils.NewLogEntry("ssh.audit"),
+		networks:      opts.AllowedNetworks,
 		ctx:           ctx,
+
+		handshakeTimeout: handshakeTimeout,
+	}
+
+	if opts.KeyBinding {
+		config.PublicKeyCallback = server.authPublicKey
+		config.KeyboardInteractiveCallback = server.authKeyboardInteractive
 	}
 
 	return server, nil
 }
 
+// authPublicKey accepts any key unless the token is bound to another one
+func (s *Server) authPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	if bound := s.boundKey(conn.User()); bound != "" && bound != fingerprint {
+		return nil, errors.New("Public key doesn't match the token")
+	}
+
+	perms := &ssh.Permissions{
+		Extensions: map[string]string{permKeyFingerprint: fingerprint},
+	}
+	return perms, nil
+}
+
+// authKeyboardInteractive accepts clients without keys unless the token is bound to a key
+func (s *Server) authKeyboardInteractive(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	if s.boundKey(conn.User()) != "" {
+		return nil, errors.New("Token is bound to a public key")
+	}
+	return &ssh.Permissions{}, nil
+}
+
+// boundKey is a hint from the unverified token, the verified payload is checked by checkKeyBinding
+func (s *Server) boundKey(token string) string {
+	if binder, ok := s.parser.(payloads.KeyBinder); ok {
+		return binder.BoundKey(token)
+	}
+	return ""
+}
+
+// consumeToken is the last check, single-use tokens rejected by other checks stay usable
+func (s *Server) consumeToken(payload payloads.Payload) error {
+	if consumer, ok := s.parser.(payloads.Consumer); ok {
+		return consumer.Consume(payload)
+	}
+	return nil
+}
+
+// checkKeyBinding verifies that the client is authenticated by the key from the payload
+func checkKeyBinding(payload payloads.Payload, perms *ssh.Permissions) error {
+	if payload.KeyFingerprint == "" {
+		return nil
+	}
+
+	if perms == nil || perms.Extensions[permKeyFingerprint] != payload.KeyFingerprint {
+		return fmt.Errorf("Client is not authenticated by the key %s bound to the token", payload.KeyFingerprint)
+	}
+
+	return nil
+}
+
+// checkSourceNetworks verifies that the client address belongs to networks from the payload
+func checkSourceNetworks(payload payloads.Payload, addr net.Addr) error {
+	if len(payload.SourceNetworks) == 0 {
+		return nil
+	}
+
+	networks, err := utils.ParseNetworks(payload.SourceNetworks)
+	if err != nil {
+		return err
+	}
+
+	if !utils.NetworksContain(networks, remoteIP(addr)) {
+		return fmt.Errorf("Client address %s is not allowed by the token", addr)
+	}
+
+	return nil
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 // Addr returns listening addr
 func (s *Server) Addr() net.Addr {
 	return s.listener.Addr()
@@ -114,34 +238,74 @@ func (s *Server) loop(wg *sync.WaitGroup) {
 			break
 		}
 
-		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, s.config)
-		if err != nil {
-			s.log.Errorf("Failed to handshake (%s)", err)
+		if len(s.networks) > 0 && !utils.NetworksContain(s.networks, remoteIP(tcpConn.RemoteAddr())) {
+			s.audit.WithField("remote", tcpConn.RemoteAddr().String()).Warn("Connection rejected, client address is not allowed")
+			if err := tcpConn.Close(); err != nil {
+				s.log.Errorf("Could not close connection (%s)", err)
+			}
 			continue
 		}
 
-		s.log.Infof("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+		go s.handleConn(tcpConn)
+	}
+}
 
-		payload, err := s.parser.Parse(sshConn.User())
-		if err != nil {
-			s.log.Warnf("Could not parse payload (%s)", err)
-			s.closeSession(sshConn)
-			continue
-		}
+// handleConn runs the handshake and session checks, connections are handled concurrently,
+// so slow clients and token introspection don't block the listener
+func (s *Server) handleConn(tcpConn net.Conn) {
+	if err := tcpConn.SetDeadline(time.Now().Add(s.handshakeTimeout)); err != nil {
+		s.log.Errorf("Could not set handshake deadline (%s)", err)
+	}
 
-		session := NewSession(s.ctx, &SessionOptions{
-			Conn:        sshConn,
-			NewChannels: chans,
-			Requests:    reqs,
-			HandlerFunc: s.handlerFunc,
-			Payload:     payload,
-		})
-
-		if err := session.Handle(); err != nil {
-			s.log.Errorf("Could not handle client connection (%s)", err)
-			s.closeSession(sshConn)
-			continue
-		}
+	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, s.config)
+	if err != nil {
+		s.log.Errorf("Failed to handshake (%s)", err)
+		return
+	}
+
+	if err := tcpConn.SetDeadline(time.Time{}); err != nil {
+		s.log.Errorf("Could not reset handshake deadline (%s)", err)
+	}
+
+	s.log.Infof("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+
+	payload, err := s.parser.Parse(sshConn.User())
+	if err != nil {
+		s.log.Warnf("Could not parse payload (%s)", err)
+		s.closeSession(sshConn)
+		return
+	}
+
+	if err := checkKeyBinding(payload, sshConn.Permissions); err != nil {
+		s.log.Warn(err)
+		s.closeSession(sshConn)
+		return
+	}
+
+	if err := checkSourceNetworks(payload, sshConn.RemoteAddr()); err != nil {
+		s.audit.WithField("remote", sshConn.RemoteAddr().String()).Warnf("Session rejected (%s)", err)
+		s.closeSession(sshConn)
+		return
+	}
+
+	if err := s.consumeToken(payload); err != nil {
+		s.log.Warn(err)
+		s.closeSession(sshConn)
+		return
+	}
+
+	session := NewSession(s.ctx, &SessionOptions{
+		Conn:        sshConn,
+		NewChannels: chans,
+		Requests:    reqs,
+		HandlerFunc: s.handlerFunc,
+		ModeFunc:    s.modeFunc,
+		Payload:     payload,
+	})
+
+	if err := session.Handle(); err != nil {
+		s.log.Errorf("Could not handle client connection (%s)", err)
+		s.closeSession(sshConn)
 	}
 }
 
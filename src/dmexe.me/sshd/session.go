@@ -9,7 +9,9 @@ import (
 	"github.com/Sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"io/ioutil"
 	"sync"
+	"time"
 )
 
 // SessionOptions keeps parameters for constructor
@@ -18,6 +20,7 @@ type SessionOptions struct {
 	NewChannels <-chan ssh.NewChannel
 	Requests    <-chan *ssh.Request
 	HandlerFunc handlers.HandlerFunc
+	ModeFunc    handlers.ModeFunc
 	Payload     payloads.Payload
 }
 
@@ -28,8 +31,10 @@ type Session struct {
 	newChannels <-chan ssh.NewChannel
 	requests    <-chan *ssh.Request
 	handlerFunc handlers.HandlerFunc
+	modeFunc    handlers.ModeFunc
 	handlerTty  *handlers.Tty
 	handler     handlers.Handler
+	agent       bool
 	log         *logrus.Entry
 	payload     payloads.Payload
 	ctx         context.Context
@@ -40,13 +45,28 @@ type Session struct {
 func NewSession(ctx context.Context, options *SessionOptions) *Session {
 	ctx, cancel := context.WithCancel(ctx)
 
+	log := utils.NewLogEntry("ssh.session")
+	if sub := options.Payload.Identity.Subject; sub != "" {
+		log = log.WithField("sub", sub)
+	}
+
+	if parser := options.Payload.Parser; parser != "" {
+		log = log.WithField("parser", parser)
+	}
+
+	modeFunc := options.ModeFunc
+	if modeFunc == nil {
+		modeFunc = handlers.ShellMode
+	}
+
 	session := &Session{
 		conn:        options.Conn,
 		newChannels: options.NewChannels,
 		requests:    options.Requests,
 		handlerFunc: options.HandlerFunc,
+		modeFunc:    modeFunc,
 		payload:     options.Payload,
-		log:         utils.NewLogEntry("ssh.session"),
+		log:         log,
 		ctx:         ctx,
 		cancel:      cancel,
 	}
@@ -55,6 +75,18 @@ func NewSession(ctx context.Context, options *SessionOptions) *Session {
 
 // Handle new client request
 func (s *Session) Handle() error {
+	if maxDuration := s.payload.Policy.MaxDuration; maxDuration > 0 {
+		timer := time.AfterFunc(maxDuration, func() {
+			s.log.Warnf("Session exceeded the maximum duration %s", maxDuration)
+			s.cancel()
+		})
+
+		go func() {
+			<-s.ctx.Done()
+			timer.Stop()
+		}()
+	}
+
 	go func() {
 		for newChannel := range s.newChannels {
 			s.handleChannelRequest(newChannel)
@@ -110,6 +142,18 @@ func (s *Session) handleChannelRequest(newChannel ssh.NewChannel) {
 				case "window-change":
 					s.handleResizeReq(req)
 
+				case "signal":
+					s.handleSignalReq(req)
+
+				case "auth-agent-req@openssh.com":
+					if !s.payload.Policy.AllowsMode(payloads.ModeForwarding) {
+						s.log.Warn("Agent forwarding is not allowed by token policy")
+						reqReply(req, false, s.log)
+						continue
+					}
+					s.setAgent()
+					reqReply(req, true, s.log)
+
 				default:
 					reqReply(req, false, s.log)
 				}
@@ -147,6 +191,36 @@ func (s *Session) handleResizeReq(req *ssh.Request) {
 	reqReply(req, true, s.log)
 }
 
+func (s *Session) handleSignalReq(req *ssh.Request) {
+	if !s.isHandled() {
+		s.log.Warn("'signal' request called without 'exec' request")
+		reqReply(req, false, s.log)
+		return
+	}
+
+	signaler, ok := s.handler.(handlers.Signaler)
+	if !ok {
+		s.log.Debug("'signal' request is not supported by handler")
+		reqReply(req, false, s.log)
+		return
+	}
+
+	name, err := reqParseSignalPayload(req.Payload)
+	if err != nil {
+		s.log.Errorf("Could not parse 'signal' request (%s)", err)
+		reqReply(req, false, s.log)
+		return
+	}
+
+	if err := signaler.Signal(name); err != nil {
+		s.log.Errorf("Could not handle 'signal' request (%s)", err)
+		reqReply(req, false, s.log)
+		return
+	}
+
+	reqReply(req, true, s.log)
+}
+
 func (s *Session) handleCommandReq(req *ssh.Request, channel ssh.Channel) {
 	if s.isHandled() {
 		s.log.Warn("'exec' request called multiple times")
@@ -154,22 +228,55 @@ func (s *Session) handleCommandReq(req *ssh.Request, channel ssh.Channel) {
 		return
 	}
 
+	exec := ""
+	if req.Type == "exec" {
+		execReq, err := reqParseExecPayload(req.Payload)
+		if err != nil {
+			s.log.Errorf("Could not parse request payloads (%s)", err)
+			reqReply(req, false, s.log)
+			return
+		}
+		exec = string(execReq)
+	}
+
+	policy := s.payload.Policy
+	mode := s.modeFunc(policy, exec)
+
+	if !policy.AllowsMode(mode) {
+		s.log.Warnf("Mode %s is not allowed by token policy", mode)
+		reqReply(req, false, s.log)
+		return
+	}
+
+	if mode == payloads.ModeExec && !policy.AllowsCommand(exec) {
+		s.log.Warnf("Command '%s' is not allowed by token policy", exec)
+		reqReply(req, false, s.log)
+		return
+	}
+
 	handleRequest := &handlers.Request{
 		Tty:     s.handlerTty,
 		Stdin:   channel.(io.Reader),
 		Stdout:  channel.(io.Writer),
 		Stderr:  channel.Stderr(),
+		Exec:    exec,
 		Payload: s.payload,
+		Mode:    mode,
 	}
 
-	if req.Type == "exec" {
-		execReq, err := reqParseExecPayload(req.Payload)
-		if err != nil {
-			s.log.Errorf("Could not parse request payloads (%s)", err)
-			reqReply(req, false, s.log)
-			return
-		}
-		handleRequest.Exec = string(execReq)
+	if s.hasAgent() {
+		handleRequest.Agent = s.openAgent
+	}
+
+	if policy.ReadOnly && s.payload.Privileged {
+		s.log.Warn("Privileged session is not allowed by read-only token policy")
+		reqReply(req, false, s.log)
+		return
+	}
+
+	// attach handler drops the input itself, it needs the detach key sequence
+	if policy.ReadOnly && mode != payloads.ModeAttach {
+		handleRequest.Stdin = discardInput(s.ctx, channel)
 	}
 
 	sessionHandler, err := s.handlerFunc()
@@ -212,6 +319,31 @@ func (s *Session) handleTtyReq(req *ssh.Request) {
 	reqReply(req, true, s.log)
 }
 
+// discardInput drains the client input, the returned reader blocks until the session is done
+func discardInput(ctx context.Context, input io.Reader) io.Reader {
+	go io.Copy(ioutil.Discard, input)
+
+	reader, writer := io.Pipe()
+	go func() {
+		<-ctx.Done()
+		writer.Close()
+	}()
+
+	return reader
+}
+
+// openAgent opens a channel to the agent forwarded by the client
+func (s *Session) openAgent() (io.ReadWriteCloser, error) {
+	channel, requests, err := s.conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open agent channel (%s)", err)
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	return channel, nil
+}
+
 func (s *Session) sendExitReply(channel ssh.Channel, code uint32) {
 	if _, err := channel.SendRequest("exit-status", false, buildExitStatus(code)); err != nil {
 		s.log.Warnf("Could not send 'exit-status' request (%s)", err)
@@ -261,3 +393,15 @@ func (s *Session) setTTY(tty *handlers.Tty) {
 	defer s.Unlock()
 	s.handlerTty = tty
 }
+
+func (s *Session) hasAgent() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.agent
+}
+
+func (s *Session) setAgent() {
+	s.Lock()
+	defer s.Unlock()
+	s.agent = true
+}
@@ -2,6 +2,7 @@ package sshd
 
 import (
 	"context"
+	"crypto/rand"
 	"dmexe.me/payloads"
 	"dmexe.me/sshd/handlers"
 	"dmexe.me/utils"
@@ -9,12 +10,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
+	"time"
 )
 
 func Test_Session(t *testing.T) {
@@ -99,6 +104,452 @@ func Test_Session(t *testing.T) {
 	})
 }
 
+// keyBindingParser returns payloads bound to the key
+type keyBindingParser struct {
+	fingerprint string
+}
+
+func (p *keyBindingParser) Parse(token string) (payloads.Payload, error) {
+	return payloads.Payload{KeyFingerprint: p.fingerprint}, nil
+}
+
+func (p *keyBindingParser) BoundKey(token string) string {
+	return p.fingerprint
+}
+
+func Test_SessionKeyBinding(t *testing.T) {
+	bound := newTestSigner(t)
+	other := newTestSigner(t)
+
+	newServer := func(ctx context.Context, wg *sync.WaitGroup, keyBinding bool, fingerprint string) *Server {
+		server, err := NewServer(ctx, ServerOptions{
+			Host:        "localhost",
+			PrivateKey:  newRsaPrivateKey(),
+			HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+			Parser:      &keyBindingParser{fingerprint: fingerprint},
+			KeyBinding:  keyBinding,
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.Run(wg))
+		return server
+	}
+
+	noQuestions := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return nil, nil
+	})
+
+	t.Run("should accept client authenticated by the bound key", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, true, ssh.FingerprintSHA256(bound.PublicKey()))
+
+		client, err := newTestClient(server.Addr(), "username", ssh.PublicKeys(other, bound))
+		require.NoError(t, err)
+		defer client.Close()
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.Close())
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("should accept client without keys when token isn't bound", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, true, "")
+
+		client, err := newTestClient(server.Addr(), "username", noQuestions)
+		require.NoError(t, err)
+		defer client.Close()
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.Close())
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on client authenticated by other key", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, true, ssh.FingerprintSHA256(bound.PublicKey()))
+
+		_, err := newTestClient(server.Addr(), "username", ssh.PublicKeys(other), noQuestions)
+		require.Error(t, err)
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on bound token when key binding is disabled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, false, ssh.FingerprintSHA256(bound.PublicKey()))
+
+		client, err := newTestClient(server.Addr(), "username")
+		require.NoError(t, err)
+		defer client.Close()
+
+		_, err = client.NewSession()
+		require.Error(t, err)
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+func Test_SessionPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	server, err := NewServer(ctx, ServerOptions{
+		Host:        "localhost",
+		PrivateKey:  newRsaPrivateKey(),
+		HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+		Parser: &payloads.EchoParser{
+			Payload: payloads.Payload{Policy: payloads.Policy{Commands: []string{"echo *"}}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Run(&wg))
+
+	t.Run("should run allowed command", func(t *testing.T) {
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+
+		pipe := setupSessionPipe(t, session)
+
+		require.NoError(t, session.Start("echo complete."))
+		require.NoError(t, pipe.WaitString("complete."))
+	})
+
+	t.Run("fail on command not allowed by policy", func(t *testing.T) {
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+
+		require.Error(t, session.Start("echo; sh"))
+	})
+
+	t.Run("fail on shell not allowed by policy", func(t *testing.T) {
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+
+		require.EqualError(t, session.Shell(), "ssh: could not start shell")
+	})
+
+	cancel()
+	wg.Wait()
+}
+
+func Test_SessionModes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	server, err := NewServer(ctx, ServerOptions{
+		Host:        "localhost",
+		PrivateKey:  newRsaPrivateKey(),
+		HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+		ModeFunc:    handlers.DockerModeFunc(handlers.DockerModeExec),
+		Parser: &payloads.EchoParser{
+			Payload: payloads.Payload{Policy: payloads.Policy{Modes: []string{payloads.ModeLogs}}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Run(&wg))
+
+	t.Run("should run logs request without exec mode", func(t *testing.T) {
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+
+		require.NoError(t, session.Start("logs --tail 10"))
+	})
+
+	t.Run("fail on other commands and shell", func(t *testing.T) {
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+		require.Error(t, session.Start("ls"))
+
+		session, closer = newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+		require.EqualError(t, session.Shell(), "ssh: could not start shell")
+	})
+
+	cancel()
+	wg.Wait()
+}
+
+func Test_SessionReadOnlyPolicy(t *testing.T) {
+	newServer := func(ctx context.Context, wg *sync.WaitGroup, payload payloads.Payload) *Server {
+		server, err := NewServer(ctx, ServerOptions{
+			Host:        "localhost",
+			PrivateKey:  newRsaPrivateKey(),
+			HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+			Parser:      &payloads.EchoParser{Payload: payload},
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.Run(wg))
+		return server
+	}
+
+	t.Run("should run allowed command without input", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, payloads.Payload{Policy: payloads.Policy{ReadOnly: true, Commands: []string{"echo *"}}})
+
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+
+		pipe := setupSessionPipe(t, session)
+
+		require.NoError(t, session.Start("echo complete."))
+		require.NoError(t, pipe.WaitString("complete."))
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on shell and unrestricted exec", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, payloads.Payload{Policy: payloads.Policy{ReadOnly: true}})
+
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+		require.EqualError(t, session.Shell(), "ssh: could not start shell")
+
+		session, closer = newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+		require.Error(t, session.Start("rm -rf /"))
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("should pass raw input to attach sessions", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server, err := NewServer(ctx, ServerOptions{
+			Host:        "localhost",
+			PrivateKey:  newRsaPrivateKey(),
+			HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+			ModeFunc:    handlers.DockerModeFunc(handlers.DockerModeAttach),
+			Parser: &payloads.EchoParser{
+				Payload: payloads.Payload{Policy: payloads.Policy{ReadOnly: true, Modes: []string{payloads.ModeAttach}}},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.Run(&wg))
+
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+
+		pipe := setupSessionPipe(t, session)
+
+		require.NoError(t, session.Shell())
+		pipe.SendString("complete.\n")
+		require.NoError(t, pipe.WaitString("complete."))
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on privileged session", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		payload := payloads.Payload{Privileged: true, Policy: payloads.Policy{ReadOnly: true, Commands: []string{"echo *"}}}
+		server := newServer(ctx, &wg, payload)
+
+		session, closer := newTestSession(t, server.Addr(), "username")
+		defer closer.Close()
+		require.Error(t, session.Start("echo complete."))
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+func Test_SessionSourceNetworks(t *testing.T) {
+	newServer := func(ctx context.Context, wg *sync.WaitGroup, allowed string, sourceNetworks ...string) *Server {
+		networks, err := utils.ParseNetworks([]string{allowed})
+		require.NoError(t, err)
+
+		server, err := NewServer(ctx, ServerOptions{
+			Host:        "localhost",
+			PrivateKey:  newRsaPrivateKey(),
+			HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+			Parser: &payloads.EchoParser{
+				Payload: payloads.Payload{SourceNetworks: sourceNetworks},
+			},
+			AllowedNetworks: networks,
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.Run(wg))
+		return server
+	}
+
+	t.Run("should accept client from allowed networks", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, "127.0.0.0/8", "10.8.0.0/16", "127.0.0.1")
+
+		client, err := newTestClient(server.Addr(), "username")
+		require.NoError(t, err)
+		defer client.Close()
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.Close())
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on client outside of listener networks", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, "10.8.0.0/16")
+
+		_, err := newTestClient(server.Addr(), "username")
+		require.Error(t, err)
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("fail on client outside of token networks", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		server := newServer(ctx, &wg, "127.0.0.1", "10.8.0.0/16")
+
+		client, err := newTestClient(server.Addr(), "username")
+		require.NoError(t, err)
+		defer client.Close()
+
+		_, err = client.NewSession()
+		require.Error(t, err)
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+func Test_SessionHandshakeTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	server, err := NewServer(ctx, ServerOptions{
+		Host:             "localhost",
+		PrivateKey:       newRsaPrivateKey(),
+		HandlerFunc:      newEchoHandler(handlers.EchoHandlerErrors{}),
+		Parser:           &payloads.EchoParser{},
+		HandshakeTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Run(&wg))
+
+	stalled, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer stalled.Close()
+
+	t.Run("should accept clients while other handshake is stalled", func(t *testing.T) {
+		client, err := newTestClient(server.Addr(), "username")
+		require.NoError(t, err)
+		defer client.Close()
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.Close())
+	})
+
+	t.Run("should close stalled handshake", func(t *testing.T) {
+		require.NoError(t, stalled.SetDeadline(time.Now().Add(3*time.Second)))
+		_, err := ioutil.ReadAll(stalled)
+		require.NoError(t, err)
+	})
+
+	cancel()
+	wg.Wait()
+}
+
+// consumingParser counts consumed payloads
+type consumingParser struct {
+	payloads.EchoParser
+	consumed int32
+}
+
+func (p *consumingParser) Consume(payload payloads.Payload) error {
+	atomic.AddInt32(&p.consumed, 1)
+	return nil
+}
+
+func Test_SessionConsumeToken(t *testing.T) {
+	newServer := func(ctx context.Context, wg *sync.WaitGroup, parser payloads.Parser) *Server {
+		server, err := NewServer(ctx, ServerOptions{
+			Host:        "localhost",
+			PrivateKey:  newRsaPrivateKey(),
+			HandlerFunc: newEchoHandler(handlers.EchoHandlerErrors{}),
+			Parser:      parser,
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.Run(wg))
+		return server
+	}
+
+	t.Run("should consume accepted token", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		parser := &consumingParser{}
+		server := newServer(ctx, &wg, parser)
+
+		client, err := newTestClient(server.Addr(), "username")
+		require.NoError(t, err)
+		defer client.Close()
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.Close())
+		require.Equal(t, int32(1), atomic.LoadInt32(&parser.consumed))
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("should not consume token rejected by session checks", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+
+		parser := &consumingParser{}
+		parser.Payload.SourceNetworks = []string{"10.8.0.0/16"}
+		server := newServer(ctx, &wg, parser)
+
+		client, err := newTestClient(server.Addr(), "username")
+		require.NoError(t, err)
+		defer client.Close()
+
+		_, err = client.NewSession()
+		require.Error(t, err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&parser.consumed))
+
+		cancel()
+		wg.Wait()
+	})
+}
+
 func newEchoHandler(errors handlers.EchoHandlerErrors) handlers.HandlerFunc {
 	return func() (handlers.Handler, error) {
 		return handlers.NewEchoHandler(errors), nil
@@ -147,6 +598,24 @@ func requestTty(s *ssh.Session) error {
 	return s.RequestPty("xterm", 80, 40, modes)
 }
 
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	return signer
+}
+
+func newTestClient(addr net.Addr, user string, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: auth,
+	}
+	return ssh.Dial("tcp", addr.String(), config)
+}
+
 func newTestSession(t *testing.T, addr net.Addr, user string) (*ssh.Session, io.Closer) {
 	config := &ssh.ClientConfig{
 		User: user,
@@ -0,0 +1,288 @@
+package tunnel
+
+import (
+	"context"
+	"dmexe.me/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	docker "github.com/fsouza/go-dockerclient"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultAgentInterval is a period of containers reports and reconnects
+const DefaultAgentInterval = 10 * time.Second
+
+// AgentOptions keeps parameters for agent instance
+type AgentOptions struct {
+	// Server is an address of the tunnel server (eg. proxy.example.com:2202)
+	Server string
+
+	// Name identifies the agent on the server, it's used as a docker daemon name in payloads
+	Name string
+
+	// Host is reported to the server, it's informational only
+	Host string
+
+	PrivateKey []byte
+
+	// ServerKeys are trusted host keys of the tunnel server
+	ServerKeys []ssh.PublicKey
+
+	// DockerEndpoint is a local docker daemon url (eg. unix:///var/run/docker.sock)
+	DockerEndpoint string
+
+	Interval time.Duration
+}
+
+// Agent keeps a connection to the tunnel server and proxies docker api connections
+// opened by the server to the local docker daemon
+type Agent struct {
+	server        string
+	name          string
+	host          string
+	config        *ssh.ClientConfig
+	docker        *docker.Client
+	dockerNetwork string
+	dockerAddress string
+	interval      time.Duration
+	log           *logrus.Entry
+	ctx           context.Context
+}
+
+// NewAgent creates a new agent instance using given options
+func NewAgent(ctx context.Context, opts AgentOptions) (*Agent, error) {
+	if opts.Server == "" {
+		return nil, errors.New("Server cannot be empty")
+	}
+
+	if opts.Name == "" {
+		return nil, errors.New("Name cannot be empty")
+	}
+
+	if len(opts.ServerKeys) == 0 {
+		return nil, errors.New("Server keys cannot be empty")
+	}
+
+	signer, err := ssh.ParsePrivateKey(opts.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key (%s)", err)
+	}
+
+	endpoint, err := url.Parse(opts.DockerEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse docker endpoint '%s' (%s)", opts.DockerEndpoint, err)
+	}
+
+	network, address := endpoint.Scheme, endpoint.Host
+	switch endpoint.Scheme {
+	case "unix":
+		address = endpoint.Path
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("Docker endpoint must be unix or tcp url, got '%s'", opts.DockerEndpoint)
+	}
+
+	cli, err := docker.NewClient(opts.DockerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := opts.Interval
+	if interval == 0 {
+		interval = DefaultAgentInterval
+	}
+
+	config := &ssh.ClientConfig{
+		User: opts.Name,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if !containsKey(opts.ServerKeys, key) {
+				return errors.New("Unknown server key")
+			}
+			return nil
+		},
+	}
+
+	agent := &Agent{
+		server:        opts.Server,
+		name:          opts.Name,
+		host:          opts.Host,
+		config:        config,
+		docker:        cli,
+		dockerNetwork: network,
+		dockerAddress: address,
+		interval:      interval,
+		log:           utils.NewLogEntry("tunnel.agent").WithField("server", opts.Server),
+		ctx:           ctx,
+	}
+
+	return agent, nil
+}
+
+// Run agent, it reconnects to the server until the context done
+func (a *Agent) Run(wg *sync.WaitGroup) error {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			if err := a.connect(); err != nil {
+				a.log.Errorf("Connection to server lost (%s)", err)
+			}
+
+			select {
+			case <-a.ctx.Done():
+				a.log.Debug("Context done")
+				return
+			case <-time.After(a.interval):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// connect registers the agent and serves the connection until it closed
+func (a *Agent) connect() error {
+	tcpConn, err := net.DialTimeout("tcp", a.server, 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(tcpConn, a.server, a.config)
+	if err != nil {
+		tcpConn.Close()
+		return err
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	reg, err := json.Marshal(registration{Host: a.host})
+	if err != nil {
+		return err
+	}
+
+	if ok, _, err := sshConn.SendRequest(registerRequest, true, reg); err != nil || !ok {
+		return fmt.Errorf("Could not register agent %s (%v)", a.name, err)
+	}
+
+	a.log.Infof("Agent %s connected", a.name)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go a.report(sshConn, done)
+
+	go func() {
+		select {
+		case <-a.ctx.Done():
+			sshConn.Close()
+		case <-done:
+		}
+	}()
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != dockerChannel {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		go a.proxy(newChannel)
+	}
+
+	return sshConn.Wait()
+}
+
+// report sends containers of the local daemon to the server periodically
+func (a *Agent) report(conn ssh.Conn, done <-chan struct{}) {
+	for {
+		containers, err := a.containers()
+		if err != nil {
+			a.log.Errorf("Could not list containers (%s)", err)
+		} else {
+			payload, err := json.Marshal(containers)
+			if err == nil {
+				_, _, err = conn.SendRequest(containersRequest, false, payload)
+			}
+			if err != nil {
+				a.log.Errorf("Could not report containers (%s)", err)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(a.interval):
+		}
+	}
+}
+
+func (a *Agent) containers() ([]containerRecord, error) {
+	containers, err := a.docker.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]containerRecord, 0)
+	for _, container := range containers {
+		inspect, err := a.docker.InspectContainer(container.ID)
+		if err != nil {
+			continue
+		}
+
+		record := containerRecord{ID: inspect.ID}
+		if inspect.Config != nil {
+			record.Env = inspect.Config.Env
+			record.Labels = inspect.Config.Labels
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// proxy connects the channel to the local docker daemon
+func (a *Agent) proxy(newChannel ssh.NewChannel) {
+	local, err := net.Dial(a.dockerNetwork, a.dockerAddress)
+	if err != nil {
+		a.log.Errorf("Could not connect to docker (%s)", err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer local.Close()
+
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		a.log.Errorf("Could not accept channel (%s)", err)
+		return
+	}
+	defer ch.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	complete := make(chan struct{})
+
+	// hijacked docker sessions rely on half-closed connections
+	go func() {
+		io.Copy(local, ch)
+		if conn, ok := local.(interface {
+			CloseWrite() error
+		}); ok {
+			conn.CloseWrite()
+		}
+		close(complete)
+	}()
+
+	io.Copy(ch, local)
+	ch.CloseWrite()
+
+	<-complete
+}
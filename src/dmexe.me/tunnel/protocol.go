@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Agents use ssh connections as a multiplexed transport, the agent name is the ssh user
+// and it must match the name bound to the agent key.
+// After connect the agent sends registerRequest and periodically containersRequest,
+// the server opens dockerChannel for every docker api connection.
+const (
+	registerRequest   = "register@dmexe.me"
+	containersRequest = "containers@dmexe.me"
+	dockerChannel     = "docker@dmexe.me"
+)
+
+// registration is a payload of registerRequest
+type registration struct {
+	Host string `json:"host"`
+}
+
+// containerRecord describes a container on the agent, it's used for routing
+type containerRecord struct {
+	ID     string            `json:"id"`
+	Env    []string          `json:"env"`
+	Labels map[string]string `json:"labels"`
+}
+
+// ParseAuthorizedKeys reads public keys in authorized_keys format
+func ParseAuthorizedKeys(filename string) ([]ssh.PublicKey, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]ssh.PublicKey, 0)
+	for len(bytes.TrimSpace(raw)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		raw = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No keys found")
+	}
+
+	return keys, nil
+}
+
+// AgentKey is an authorized key of the named agent
+type AgentKey struct {
+	Name string
+	Key  ssh.PublicKey
+}
+
+// ParseAgentKeys reads agent keys in authorized_keys format, the key comment is the agent name
+// (eg. ecdsa-sha2-nistp256 AAAA... agent-1), an agent may have several keys
+func ParseAgentKeys(filename string) ([]AgentKey, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]AgentKey, 0)
+	for len(bytes.TrimSpace(raw)) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSpace(comment)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Key %s must have an agent name in the comment", ssh.FingerprintSHA256(key))
+		}
+
+		for _, it := range keys {
+			if bytes.Equal(it.Key.Marshal(), key.Marshal()) {
+				return nil, fmt.Errorf("Key %s is used by agents %s and %s", ssh.FingerprintSHA256(key), it.Name, name)
+			}
+		}
+
+		keys = append(keys, AgentKey{Name: name, Key: key})
+		raw = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No keys found")
+	}
+
+	return keys, nil
+}
+
+func containsAgentKey(keys []AgentKey, name string, key ssh.PublicKey) bool {
+	for _, it := range keys {
+		if it.Name == name && bytes.Equal(it.Key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, known := range keys {
+		if bytes.Equal(known.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelConn adapts ssh channel to net.Conn, deadlines are not supported,
+// CloseWrite of the channel is used by hijacked docker sessions
+type channelConn struct {
+	ssh.Channel
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *channelConn) SetDeadline(_ time.Time) error {
+	return nil
+}
+
+func (c *channelConn) SetReadDeadline(_ time.Time) error {
+	return nil
+}
+
+func (c *channelConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
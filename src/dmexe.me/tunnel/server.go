@@ -0,0 +1,358 @@
+package tunnel
+
+import (
+	"context"
+	"dmexe.me/payloads"
+	"dmexe.me/sshd/handlers"
+	"dmexe.me/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	docker "github.com/fsouza/go-dockerclient"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServerOptions keeps parameters for tunnel server instance
+type ServerOptions struct {
+	PrivateKey []byte
+
+	// AuthorizedKeys bind agent names to their keys, an agent connects only under its own name
+	AuthorizedKeys []AgentKey
+
+	Host string
+	Port uint
+}
+
+// permKeyFingerprint keeps the fingerprint of the key authenticated the agent
+const permKeyFingerprint = "key-fingerprint"
+
+// Server accepts connections from agents and routes docker sessions through them
+type Server struct {
+	sync.Mutex
+	config        *ssh.ServerConfig
+	listenAddress string
+	listener      net.Listener
+	agents        map[string]*agentConn
+	log           *logrus.Entry
+	ctx           context.Context
+}
+
+// agentConn keeps a connected agent and containers reported by it
+type agentConn struct {
+	sync.Mutex
+	name       string
+	host       string
+	key        string
+	conn       *ssh.ServerConn
+	containers []containerRecord
+	endpoint   handlers.DockerEndpoint
+}
+
+// NewServer creates a new tunnel server instance using given options
+func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
+	if len(opts.AuthorizedKeys) == 0 {
+		return nil, errors.New("Authorized keys cannot be empty")
+	}
+
+	for _, it := range opts.AuthorizedKeys {
+		if it.Name == "" || it.Key == nil {
+			return nil, errors.New("Authorized keys must have agent names")
+		}
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !containsAgentKey(opts.AuthorizedKeys, conn.User(), key) {
+				return nil, fmt.Errorf("Unknown key of agent %s", conn.User())
+			}
+
+			perms := &ssh.Permissions{
+				Extensions: map[string]string{permKeyFingerprint: ssh.FingerprintSHA256(key)},
+			}
+			return perms, nil
+		},
+	}
+
+	private, err := ssh.ParsePrivateKey(opts.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key (%s)", err)
+	}
+
+	config.AddHostKey(private)
+
+	server := &Server{
+		config:        config,
+		listenAddress: fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+		agents:        make(map[string]*agentConn),
+		log:           utils.NewLogEntry("tunnel.server"),
+		ctx:           ctx,
+	}
+
+	return server, nil
+}
+
+// Addr returns listening addr
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Run server
+func (s *Server) Run(wg *sync.WaitGroup) error {
+	listener, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s (%s)", s.listenAddress, err)
+	}
+	s.listener = listener
+
+	wg.Add(1)
+	go s.loop(wg)
+	go s.deadline()
+
+	return nil
+}
+
+// Route returns the endpoint of the agent named by the payload daemon,
+// or the agent which reported the container referenced by the payload,
+// containers reported by several agents are not routed
+func (s *Server) Route(payload payloads.Payload) (handlers.DockerEndpoint, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if payload.Daemon != "" {
+		agent, ok := s.agents[payload.Daemon]
+		if !ok {
+			return handlers.DockerEndpoint{}, false, nil
+		}
+		return agent.endpoint, true, nil
+	}
+
+	names := make([]string, 0)
+	for name := range s.agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	found := make([]string, 0)
+	for _, name := range names {
+		if s.agents[name].hasContainer(payload) {
+			found = append(found, name)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return handlers.DockerEndpoint{}, false, nil
+	case 1:
+		return s.agents[found[0]].endpoint, true, nil
+	default:
+		return handlers.DockerEndpoint{}, false, fmt.Errorf("Container is reported by several agents [%s]", strings.Join(found, "] ["))
+	}
+}
+
+func (s *Server) deadline() {
+	<-s.ctx.Done()
+
+	s.log.Debug("Context done")
+
+	if err := s.listener.Close(); err != nil {
+		s.log.Errorf("Could not close listener (%s)", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, agent := range s.agents {
+		agent.conn.Close()
+	}
+}
+
+func (s *Server) loop(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	s.log.Printf("Listening on %s...", s.listenAddress)
+
+	for {
+		tcpConn, err := s.listener.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				s.log.Errorf("Failed to accept incoming connection (%s)", err)
+			}
+			break
+		}
+
+		go s.handle(tcpConn)
+	}
+
+	s.log.Debugf("Stop accepting incoming connections")
+}
+
+func (s *Server) handle(tcpConn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, s.config)
+	if err != nil {
+		s.log.Errorf("Failed to handshake (%s)", err)
+		return
+	}
+
+	// agents never open channels
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "channels are not allowed")
+		}
+	}()
+
+	agent := &agentConn{
+		name: sshConn.User(),
+		key:  sshConn.Permissions.Extensions[permKeyFingerprint],
+		conn: sshConn,
+	}
+
+	endpoint, err := agent.newEndpoint()
+	if err != nil {
+		s.log.Errorf("Could not create endpoint for agent %s (%s)", agent.name, err)
+		sshConn.Close()
+		return
+	}
+	agent.endpoint = endpoint
+
+	if !s.register(agent) {
+		sshConn.Close()
+		return
+	}
+	defer s.unregister(agent)
+
+	go s.handleRequests(agent, reqs)
+
+	if err := sshConn.Wait(); err != nil {
+		s.log.Debugf("Agent connection closed (%s)", err)
+	}
+}
+
+// register replaces the previous connection of the agent only when it's authenticated by the same key
+func (s *Server) register(agent *agentConn) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, ok := s.agents[agent.name]; ok {
+		if previous.key != agent.key {
+			s.log.Warnf("Agent %s is already connected from %s by other key, rejecting connection from %s", agent.name, previous.conn.RemoteAddr(), agent.conn.RemoteAddr())
+			return false
+		}
+
+		s.log.Warnf("Agent %s reconnected, closing previous connection from %s", agent.name, previous.conn.RemoteAddr())
+		previous.conn.Close()
+	}
+
+	s.agents[agent.name] = agent
+	s.log.Infof("Agent %s connected from %s", agent.name, agent.conn.RemoteAddr())
+	return true
+}
+
+func (s *Server) unregister(agent *agentConn) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.agents[agent.name] == agent {
+		delete(s.agents, agent.name)
+		s.log.Infof("Agent %s disconnected", agent.name)
+	}
+}
+
+func (s *Server) handleRequests(agent *agentConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		var err error
+
+		switch req.Type {
+		case registerRequest:
+			reg := registration{}
+			if err = json.Unmarshal(req.Payload, &reg); err == nil {
+				agent.Lock()
+				agent.host = reg.Host
+				agent.Unlock()
+				s.log.Infof("Agent %s registered (host=%s)", agent.name, reg.Host)
+			}
+
+		case containersRequest:
+			containers := make([]containerRecord, 0)
+			if err = json.Unmarshal(req.Payload, &containers); err == nil {
+				agent.Lock()
+				agent.containers = containers
+				agent.Unlock()
+				s.log.Debugf("Agent %s reported %d containers", agent.name, len(containers))
+			}
+
+		default:
+			err = fmt.Errorf("Unknown request %s", req.Type)
+		}
+
+		if err != nil {
+			s.log.Warnf("Could not handle request from agent %s (%s)", agent.name, err)
+		}
+
+		if req.WantReply {
+			req.Reply(err == nil, nil)
+		}
+	}
+}
+
+func (a *agentConn) hasContainer(payload payloads.Payload) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, record := range a.containers {
+		container := &docker.Container{
+			ID: record.ID,
+			Config: &docker.Config{
+				Env:    record.Env,
+				Labels: record.Labels,
+			},
+		}
+
+		if handlers.MatchContainer(container, payload) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newEndpoint creates a docker client sending all requests through the agent connection,
+// the endpoint address is ignored
+func (a *agentConn) newEndpoint() (handlers.DockerEndpoint, error) {
+	cli, err := docker.NewClient("tcp://agent:2375")
+	if err != nil {
+		return handlers.DockerEndpoint{}, err
+	}
+
+	cli.Dialer = a
+	cli.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Dial: a.Dial,
+		},
+	}
+
+	return handlers.DockerEndpoint{Name: a.name, Client: cli}, nil
+}
+
+// Dial opens a connection to the agent docker daemon
+func (a *agentConn) Dial(_, _ string) (net.Conn, error) {
+	ch, reqs, err := a.conn.OpenChannel(dockerChannel, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open tunnel to agent %s (%s)", a.name, err)
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	conn := &channelConn{
+		Channel: ch,
+		local:   a.conn.LocalAddr(),
+		remote:  a.conn.RemoteAddr(),
+	}
+
+	return conn, nil
+}
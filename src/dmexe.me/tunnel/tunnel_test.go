@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"dmexe.me/payloads"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Tunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	serverKey, serverPublic := newTestKey(t)
+	agentKey, agentPublic := newTestKey(t)
+	otherKey, otherPublic := newTestKey(t)
+
+	dockerSocket := newTestDockerSocket(t)
+	defer os.RemoveAll(path.Dir(dockerSocket))
+
+	server, err := NewServer(ctx, ServerOptions{
+		PrivateKey:     serverKey,
+		AuthorizedKeys: []AgentKey{{Name: "agent-1", Key: agentPublic}, {Name: "agent-1", Key: otherPublic}},
+		Host:           "127.0.0.1",
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Run(&wg))
+
+	newTestAgent := func(name string, key []byte) *Agent {
+		agent, err := NewAgent(ctx, AgentOptions{
+			Server:         server.Addr().String(),
+			Name:           name,
+			Host:           "10.0.0.1",
+			PrivateKey:     key,
+			ServerKeys:     []ssh.PublicKey{serverPublic},
+			DockerEndpoint: "unix://" + dockerSocket,
+			Interval:       100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		return agent
+	}
+
+	t.Run("should register agent", func(t *testing.T) {
+		require.NoError(t, newTestAgent("agent-1", agentKey).Run(&wg))
+
+		require.NoError(t, waitTestAgent(server, "agent-1"))
+
+		server.Lock()
+		agent := server.agents["agent-1"]
+		server.Unlock()
+
+		agent.Lock()
+		require.Equal(t, "10.0.0.1", agent.host)
+		agent.Unlock()
+	})
+
+	t.Run("should route by daemon name", func(t *testing.T) {
+		endpoint, ok, err := server.Route(payloads.Payload{Daemon: "agent-1"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "agent-1", endpoint.Name)
+
+		_, ok, err = server.Route(payloads.Payload{Daemon: "agent-2"})
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("should route by container", func(t *testing.T) {
+		server.Lock()
+		agent := server.agents["agent-1"]
+		server.Unlock()
+
+		agent.Lock()
+		agent.containers = []containerRecord{{ID: "0123456789abcdef", Env: []string{"MESOS_TASK_ID=app.1"}}}
+		agent.Unlock()
+
+		endpoint, ok, err := server.Route(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "agent-1", endpoint.Name)
+
+		_, ok, err = server.Route(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.2"})
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("fail to route container reported by several agents", func(t *testing.T) {
+		server.Lock()
+		server.agents["agent-0"] = &agentConn{name: "agent-0", containers: []containerRecord{{ID: "fedcba9876543210", Env: []string{"MESOS_TASK_ID=app.1"}}}}
+		server.Unlock()
+
+		defer func() {
+			server.Lock()
+			delete(server.agents, "agent-0")
+			server.Unlock()
+		}()
+
+		_, ok, err := server.Route(payloads.Payload{ContainerEnv: "MESOS_TASK_ID=app.1"})
+		require.EqualError(t, err, "Container is reported by several agents [agent-0] [agent-1]")
+		require.False(t, ok)
+	})
+
+	t.Run("should dial agent docker", func(t *testing.T) {
+		server.Lock()
+		agent := server.agents["agent-1"]
+		server.Unlock()
+
+		conn, err := agent.Dial("tcp", "agent:2375")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		require.Equal(t, "OK", string(body))
+	})
+
+	t.Run("fail on unknown agent key", func(t *testing.T) {
+		unknownKey, _ := newTestKey(t)
+		require.Error(t, newTestAgent("agent-2", unknownKey).connect())
+	})
+
+	t.Run("fail on name not bound to agent key", func(t *testing.T) {
+		require.Error(t, newTestAgent("agent-2", agentKey).connect())
+	})
+
+	t.Run("should not replace agent connected by other key", func(t *testing.T) {
+		require.Error(t, newTestAgent("agent-1", otherKey).connect())
+
+		server.Lock()
+		agent := server.agents["agent-1"]
+		server.Unlock()
+
+		require.Equal(t, ssh.FingerprintSHA256(agentPublic), agent.key)
+	})
+
+	t.Run("fail on unknown server key", func(t *testing.T) {
+		_, unknownPublic := newTestKey(t)
+
+		agent := newTestAgent("agent-2", agentKey)
+		agent.config.HostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if !containsKey([]ssh.PublicKey{unknownPublic}, key) {
+				return fmt.Errorf("Unknown server key")
+			}
+			return nil
+		}
+		require.Error(t, agent.connect())
+	})
+
+	cancel()
+	wg.Wait()
+}
+
+func Test_ParseAgentKeys(t *testing.T) {
+	_, first := newTestKey(t)
+	_, second := newTestKey(t)
+
+	line := func(key ssh.PublicKey, name string) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + name + "\n"
+	}
+
+	parse := func(content string) ([]AgentKey, error) {
+		file, err := ioutil.TempFile("", "agent-keys")
+		require.NoError(t, err)
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(content)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		return ParseAgentKeys(file.Name())
+	}
+
+	t.Run("should parse named keys", func(t *testing.T) {
+		keys, err := parse(line(first, "agent-1") + line(second, "agent-1"))
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		require.Equal(t, "agent-1", keys[1].Name)
+		require.True(t, containsAgentKey(keys, "agent-1", second))
+		require.False(t, containsAgentKey(keys, "agent-2", second))
+	})
+
+	t.Run("fail on invalid keys", func(t *testing.T) {
+		_, err := parse(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(first))) + "\n")
+		require.EqualError(t, err, fmt.Sprintf("Key %s must have an agent name in the comment", ssh.FingerprintSHA256(first)))
+
+		_, err = parse(line(first, "agent-1") + line(first, "agent-2"))
+		require.EqualError(t, err, fmt.Sprintf("Key %s is used by agents agent-1 and agent-2", ssh.FingerprintSHA256(first)))
+
+		_, err = parse("")
+		require.EqualError(t, err, "No keys found")
+	})
+}
+
+func waitTestAgent(server *Server, name string) error {
+	for i := 0; i < 50; i++ {
+		server.Lock()
+		_, ok := server.agents[name]
+		server.Unlock()
+
+		if ok {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("Agent %s is not registered within 1s", name)
+}
+
+func newTestKey(t *testing.T) ([]byte, ssh.PublicKey) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalECPrivateKey(private)
+	require.NoError(t, err)
+
+	public, err := ssh.NewPublicKey(&private.PublicKey)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), public
+}
+
+// newTestDockerSocket serves a minimal docker api on a unix socket
+func newTestDockerSocket(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "docker")
+	require.NoError(t, err)
+
+	socket := path.Join(dir, "docker.sock")
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApiVersion":"1.25"}`))
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+
+	go http.Serve(listener, mux)
+
+	return socket
+}